@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scopes given to API keys and tokens
+const (
+	ScopeUpload = "upload"
+	ScopeRead   = "read"
+)
+
+// Authentication methods
+const (
+	AuthAPIKey = "apikey"
+	AuthHMAC   = "hmac"
+	AuthJWT    = "jwt"
+)
+
+const (
+	// hmacScheme is the Authorization scheme of signed requests
+	hmacScheme = "DMARC-HMAC-SHA256"
+	// hmacMaxSkew is how far the request timestamp can be from our clock
+	hmacMaxSkew = 5 * time.Minute
+	// jwtLeeway is the clock skew allowed on exp and nbf
+	jwtLeeway = time.Minute
+)
+
+var (
+	// ErrNoCredentials is returned when a request has no authentication
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrBadCredentials is returned for anything not matching
+	ErrBadCredentials = errors.New("invalid credentials")
+)
+
+var fAuth string
+
+func init() {
+	flag.StringVar(&fAuth, "auth", "", "JSON file with API keys, HMAC secrets and JWT settings (REST API)")
+}
+
+// AuthConfig is the content of the -auth file
+type AuthConfig struct {
+	Tenants []TenantConfig `json:"tenants"`
+	Keys    []APIKeyConfig `json:"keys"`
+	HMAC    []HMACConfig   `json:"hmac"`
+	JWT     *JWTConfig     `json:"jwt"`
+}
+
+// APIKeyConfig is a static API key, only its hash is kept
+type APIKeyConfig struct {
+	ID     string   `json:"id"`
+	Hash   string   `json:"hash"`
+	Tenant string   `json:"tenant"`
+	Scopes []string `json:"scopes"`
+}
+
+// HMACConfig is a shared secret used to sign requests, either given
+// directly or read from the SecretEnv environment variable
+type HMACConfig struct {
+	ID        string   `json:"id"`
+	Secret    string   `json:"secret"`
+	SecretEnv string   `json:"secretEnv"`
+	Tenant    string   `json:"tenant"`
+	Scopes    []string `json:"scopes"`
+}
+
+// JWTConfig describes which bearer tokens we accept, the tenant is taken
+// from the "tenant" claim
+type JWTConfig struct {
+	JWKS     string `json:"jwks"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+// Principal is who made an authenticated request, restricted to the
+// domains of Tenant if set
+type Principal struct {
+	ID     string
+	Method string
+	Tenant string
+	Scopes []string
+}
+
+// HasScope is true if p was given scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// PrincipalFrom returns who made the request, nil if authentication is
+// disabled
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+type apiKey struct {
+	id     string
+	hash   []byte
+	tenant string
+	scopes []string
+}
+
+type hmacKey struct {
+	secret []byte
+	tenant string
+	scopes []string
+}
+
+// Authenticator checks the credentials of every API request
+type Authenticator struct {
+	tenants *Tenants
+	keys    []apiKey
+	hmac    map[string]hmacKey
+	jwt     *JWTConfig
+	jwks    map[string]crypto.PublicKey
+
+	now func() time.Time
+}
+
+// authenticator is the one used by the REST API, nil means no
+// authentication
+var authenticator *Authenticator
+
+// LoadAuth reads the configuration in file
+func LoadAuth(file string) (*Authenticator, error) {
+	var cnf AuthConfig
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "auth")
+	}
+	if err := json.Unmarshal(buf, &cnf); err != nil {
+		return nil, errors.Wrapf(err, "bad auth file %s", file)
+	}
+	return NewAuthenticator(cnf)
+}
+
+// NewAuthenticator checks cnf and loads the JWKS if needed
+func NewAuthenticator(cnf AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		hmac: map[string]hmacKey{},
+		jwt:  cnf.JWT,
+		now:  time.Now,
+	}
+
+	t, err := NewTenants(cnf.Tenants)
+	if err != nil {
+		return nil, errors.Wrap(err, "tenants")
+	}
+	a.tenants = t
+
+	for _, k := range cnf.Keys {
+		if k.Tenant != "" && !t.Exists(k.Tenant) {
+			return nil, errors.Errorf("key %s: unknown tenant %s", k.ID, k.Tenant)
+		}
+		hash := strings.TrimPrefix(k.Hash, "sha256:")
+		if hash == k.Hash {
+			return nil, errors.Errorf("key %s: hash must be sha256:<hex>", k.ID)
+		}
+		b, err := hex.DecodeString(hash)
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.Errorf("key %s: invalid sha256 hash", k.ID)
+		}
+		a.keys = append(a.keys, apiKey{id: k.ID, hash: b, tenant: k.Tenant, scopes: k.Scopes})
+	}
+
+	for _, h := range cnf.HMAC {
+		if h.Tenant != "" && !t.Exists(h.Tenant) {
+			return nil, errors.Errorf("hmac %s: unknown tenant %s", h.ID, h.Tenant)
+		}
+		secret := h.Secret
+		if h.SecretEnv != "" {
+			secret = os.Getenv(h.SecretEnv)
+		}
+		if secret == "" {
+			return nil, errors.Errorf("hmac %s: empty secret", h.ID)
+		}
+		a.hmac[h.ID] = hmacKey{secret: []byte(secret), tenant: h.Tenant, scopes: h.Scopes}
+	}
+
+	if cnf.JWT != nil {
+		keys, err := loadJWKS(cnf.JWT.JWKS)
+		if err != nil {
+			return nil, errors.Wrap(err, "jwks")
+		}
+		a.jwks = keys
+	}
+	verbose("auth: %d tenants, %d API keys, %d HMAC secrets, %d JWT keys", len(t.ids), len(a.keys), len(a.hmac), len(a.jwks))
+	return a, nil
+}
+
+// Tenants returns the tenants defined along with the keys
+func (a *Authenticator) Tenants() *Tenants {
+	if a == nil {
+		return nil
+	}
+	return a.tenants
+}
+
+// HashAPIKey returns what goes in the hash field of an API key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Authenticate finds who made r.  Signed requests have their body read
+// and replaced, done must be called once the request is finished.
+func (a *Authenticator) Authenticate(r *http.Request) (p *Principal, done func(), err error) {
+	done = func() {}
+
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		p, err = a.checkAPIKey(key)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	i := strings.IndexByte(auth, ' ')
+	if i < 0 {
+		return nil, done, ErrNoCredentials
+	}
+	scheme, cred := auth[:i], strings.TrimSpace(auth[i+1:])
+
+	switch {
+	case strings.EqualFold(scheme, "ApiKey"):
+		p, err = a.checkAPIKey(cred)
+	case strings.EqualFold(scheme, "Bearer"):
+		p, err = a.checkJWT(cred)
+	case scheme == hmacScheme:
+		p, done, err = a.checkHMAC(r, cred)
+	default:
+		err = ErrNoCredentials
+	}
+	return
+}
+
+func (a *Authenticator) checkAPIKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(sum[:], k.hash) == 1 {
+			return &Principal{ID: k.id, Method: AuthAPIKey, Tenant: k.tenant, Scopes: k.scopes}, nil
+		}
+	}
+	return nil, ErrBadCredentials
+}
+
+// hmacSignature is what a client signs, the body is represented by its
+// SHA-256
+func hmacSignature(secret []byte, method, uri string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, method+"\n"+uri+"\n"+strconv.FormatInt(ts, 10)+"\n"+hex.EncodeToString(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds the HMAC authorization header to r for the given body
+func SignRequest(r *http.Request, id, secret string, body []byte) {
+	ts := time.Now().Unix()
+	sum := sha256.Sum256(body)
+	sig := hmacSignature([]byte(secret), r.Method, r.URL.RequestURI(), ts, sum[:])
+	r.Header.Set("Authorization", hmacScheme+" keyId="+id+",timestamp="+strconv.FormatInt(ts, 10)+",signature="+sig)
+}
+
+// checkHMAC verifies a signed request:
+//
+//	Authorization: DMARC-HMAC-SHA256 keyId=<id>,timestamp=<unix>,signature=<hex>
+//
+// The body is copied in a temporary file while being hashed, up to
+// -max-body on every route since the key ID is no secret.
+func (a *Authenticator) checkHMAC(r *http.Request, cred string) (*Principal, func(), error) {
+	done := func() {}
+
+	params := map[string]string{}
+	for _, kv := range strings.Split(cred, ",") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			params[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+
+	id := params["keyId"]
+	k, ok := a.hmac[id]
+	if !ok {
+		return nil, done, ErrBadCredentials
+	}
+
+	ts, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, done, ErrBadCredentials
+	}
+	skew := a.now().Sub(time.Unix(ts, 0))
+	if skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, done, errors.Wrap(ErrBadCredentials, "timestamp")
+	}
+
+	if max := fLimits.MaxBody; max > 0 {
+		if r.ContentLength > max {
+			rejections.Add(RejectBodyTooLarge, 1)
+			return nil, done, errors.Wrapf(errTooLarge, "%d bytes", r.ContentLength)
+		}
+		if _, ok := r.Body.(*countingBody); !ok {
+			r.Body = &countingBody{ReadCloser: http.MaxBytesReader(nil, r.Body, max)}
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "dmarc-body-")
+	if err != nil {
+		return nil, done, errors.Wrap(err, "TempFile")
+	}
+	done = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r.Body); err != nil {
+		return nil, done, errors.Wrap(err, "read body")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, done, errors.Wrap(err, "seek")
+	}
+	r.Body.Close()
+	r.Body = tmp
+
+	sig := hmacSignature(k.secret, r.Method, r.URL.RequestURI(), ts, h.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(params["signature"])) {
+		return nil, done, ErrBadCredentials
+	}
+	return &Principal{ID: id, Method: AuthHMAC, Tenant: k.tenant, Scopes: k.scopes}, done, nil
+}
+
+// jwk is one key of a JWKS file
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS reads the RSA and P-256 keys of a JWKS file
+func loadJWKS(file string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, errors.Wrapf(err, "bad JWKS %s", file)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := b64Int(k.N)
+			e, err2 := b64Int(k.E)
+			if err1 != nil || err2 != nil {
+				return nil, errors.Errorf("key %s: bad RSA parameters", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, errors.Errorf("key %s: unsupported curve %s", k.Kid, k.Crv)
+			}
+			x, err1 := b64Int(k.X)
+			y, err2 := b64Int(k.Y)
+			if err1 != nil || err2 != nil {
+				return nil, errors.Errorf("key %s: bad EC parameters", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			verbose("jwks: skipping key %s of type %s", k.Kid, k.Kty)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no usable key in %s", file)
+	}
+	return keys, nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad base64")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtClaims are the registered claims we check plus the scopes
+type jwtClaims struct {
+	Sub    string          `json:"sub"`
+	Iss    string          `json:"iss"`
+	Aud    json.RawMessage `json:"aud"`
+	Exp    *float64        `json:"exp"`
+	Nbf    *float64        `json:"nbf"`
+	Scope  string          `json:"scope"`
+	Scopes []string        `json:"scopes"`
+	Tenant string          `json:"tenant"`
+}
+
+// hasAudience checks aud, which is either a string or an array
+func (c jwtClaims) hasAudience(want string) bool {
+	var one string
+	if json.Unmarshal(c.Aud, &one) == nil {
+		return one == want
+	}
+
+	var list []string
+	if json.Unmarshal(c.Aud, &list) == nil {
+		for _, a := range list {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkJWT verifies an RS256 or ES256 token against the JWKS
+func (a *Authenticator) checkJWT(token string) (*Principal, error) {
+	if a.jwt == nil {
+		return nil, ErrBadCredentials
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(ErrBadCredentials, "malformed token")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jwtDecode(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrBadCredentials, "signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	key, ok := a.jwks[hdr.Kid]
+	if !ok {
+		return nil, errors.Wrapf(ErrBadCredentials, "unknown key %q", hdr.Kid)
+	}
+
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		valid = hdr.Alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if hdr.Alg == "ES256" && len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			valid = ecdsa.Verify(k, sum[:], r, s)
+		}
+	}
+	if !valid {
+		return nil, errors.Wrap(ErrBadCredentials, "signature")
+	}
+
+	var c jwtClaims
+	if err := jwtDecode(parts[1], &c); err != nil {
+		return nil, err
+	}
+
+	now := a.now()
+	if c.Exp == nil || now.After(time.Unix(int64(*c.Exp), 0).Add(jwtLeeway)) {
+		return nil, errors.Wrap(ErrBadCredentials, "token expired")
+	}
+	if c.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*c.Nbf), 0)) {
+		return nil, errors.Wrap(ErrBadCredentials, "token not yet valid")
+	}
+	if a.jwt.Issuer != "" && c.Iss != a.jwt.Issuer {
+		return nil, errors.Wrap(ErrBadCredentials, "issuer")
+	}
+	if a.jwt.Audience != "" && !c.hasAudience(a.jwt.Audience) {
+		return nil, errors.Wrap(ErrBadCredentials, "audience")
+	}
+
+	if c.Tenant != "" && !a.tenants.Exists(c.Tenant) {
+		return nil, errors.Wrapf(ErrBadCredentials, "unknown tenant %s", c.Tenant)
+	}
+
+	scopes := c.Scopes
+	if c.Scope != "" {
+		scopes = append(scopes, strings.Fields(c.Scope)...)
+	}
+	return &Principal{ID: c.Sub, Method: AuthJWT, Tenant: c.Tenant, Scopes: scopes}, nil
+}
+
+func jwtDecode(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.Wrap(ErrBadCredentials, "malformed token")
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if err := dec.Decode(v); err != nil {
+		return errors.Wrap(ErrBadCredentials, "malformed token")
+	}
+	return nil
+}
+
+// requireScope only lets requests authenticated with scope through, or
+// everything if authentication is disabled.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := authenticator
+		if a == nil {
+			next(w, r)
+			return
+		}
+
+		p, done, err := a.Authenticate(r)
+		defer done()
+		if isTooLarge(err) {
+			// Signed request with a body over -max-body
+			writeError(w, r, uploadError(err))
+			return
+		}
+		if err != nil {
+			debug("auth: %s %s: %v", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dmarc", ApiKey realm="dmarc"`)
+			writeFailure(w, Failure{Stage: StageRequest, Code: CodeUnauthorized, Message: err.Error()})
+			return
+		}
+		if !p.HasScope(scope) {
+			writeFailure(w, Failure{Stage: StageRequest, Code: CodeForbidden, Message: "missing scope " + scope})
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
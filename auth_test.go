@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signJWT creates a token signed with key, either RSA or ECDSA
+func signJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	input := b64(hdr) + "." + b64(body)
+	sum := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		require.NoError(t, err)
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return input + "." + b64(sig)
+}
+
+// testAuth returns an authenticator with one key of every kind and the
+// JWT signing keys
+func testAuth(t *testing.T) (*Authenticator, *rsa.PrivateKey, *ecdsa.PrivateKey) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ek.X.Bytes()), "y": b64(ek.Y.Bytes())},
+			{"kty": "oct", "kid": "skipped"},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "jwks.json")
+	buf, _ := json.Marshal(jwks)
+	require.NoError(t, ioutil.WriteFile(file, buf, 0600))
+
+	a, err := NewAuthenticator(AuthConfig{
+		Keys: []APIKeyConfig{
+			{ID: "uploader", Hash: HashAPIKey("s3cret"), Scopes: []string{ScopeUpload}},
+			{ID: "reader", Hash: HashAPIKey("r34d"), Scopes: []string{ScopeRead}},
+		},
+		HMAC: []HMACConfig{{ID: "ci", Secret: "shared", Scopes: []string{ScopeUpload, ScopeRead}}},
+		JWT:  &JWTConfig{JWKS: file, Issuer: "https://idp.example.com", Audience: "dmarc"},
+	})
+	require.NoError(t, err)
+	return a, rk, ek
+}
+
+func TestNewAuthenticator_Bad(t *testing.T) {
+	td := []AuthConfig{
+		{Keys: []APIKeyConfig{{ID: "a", Hash: "deadbeef"}}},
+		{Keys: []APIKeyConfig{{ID: "a", Hash: "sha256:deadbeef"}}},
+		{HMAC: []HMACConfig{{ID: "a", SecretEnv: "DMARC_TEST_NONEXISTENT"}}},
+		{JWT: &JWTConfig{JWKS: "/nonexistent"}},
+		{JWT: &JWTConfig{JWKS: "testdata/notempty.txt"}},
+	}
+
+	for _, c := range td {
+		_, err := NewAuthenticator(c)
+		assert.Error(t, err)
+	}
+}
+
+func TestLoadAuth_Bad(t *testing.T) {
+	_, err := LoadAuth("/nonexistent")
+	assert.Error(t, err)
+	_, err = LoadAuth("testdata/notempty.txt")
+	assert.Error(t, err)
+}
+
+func TestAuthenticate_APIKey(t *testing.T) {
+	a, _, _ := testAuth(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "s3cret")
+	p, _, err := a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "uploader", p.ID)
+	assert.Equal(t, AuthAPIKey, p.Method)
+	assert.True(t, p.HasScope(ScopeUpload))
+	assert.False(t, p.HasScope(ScopeRead))
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "ApiKey r34d")
+	p, _, err = a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "reader", p.ID)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	_, _, err = a.Authenticate(r)
+	assert.Equal(t, ErrBadCredentials, err)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	_, _, err = a.Authenticate(r)
+	assert.Equal(t, ErrNoCredentials, err)
+}
+
+func TestAuthenticate_HMAC(t *testing.T) {
+	a, _, _ := testAuth(t)
+
+	body := []byte("<feedback/>")
+	r := httptest.NewRequest("POST", "/api/v1/upload_bundle?wait=true", bytes.NewReader(body))
+	SignRequest(r, "ci", "shared", body)
+
+	p, done, err := a.Authenticate(r)
+	defer done()
+	require.NoError(t, err)
+	assert.Equal(t, "ci", p.ID)
+	assert.Equal(t, AuthHMAC, p.Method)
+
+	// Body is still readable
+	got, err := ioutil.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	// Tampered body
+	r = httptest.NewRequest("POST", "/api/v1/upload_bundle", strings.NewReader("<other/>"))
+	SignRequest(r, "ci", "shared", body)
+	_, done, err = a.Authenticate(r)
+	done()
+	assert.Error(t, err)
+
+	// Wrong secret
+	r = httptest.NewRequest("POST", "/api/v1/upload_bundle", bytes.NewReader(body))
+	SignRequest(r, "ci", "other", body)
+	_, done, err = a.Authenticate(r)
+	done()
+	assert.Error(t, err)
+
+	// Too old
+	r = httptest.NewRequest("POST", "/api/v1/upload_bundle", bytes.NewReader(body))
+	SignRequest(r, "ci", "shared", body)
+	a.now = func() time.Time { return time.Now().Add(time.Hour) }
+	_, done, err = a.Authenticate(r)
+	done()
+	assert.Error(t, err)
+}
+
+func TestAuthenticate_HMAC_TooLarge(t *testing.T) {
+	a, _, _ := testAuth(t)
+
+	max := fLimits.MaxBody
+	fLimits.MaxBody = 16
+	defer func() { fLimits.MaxBody = max }()
+
+	body := bytes.Repeat([]byte("x"), 64)
+
+	// Announced size
+	r := httptest.NewRequest("GET", "/api/v1/reports", bytes.NewReader(body))
+	SignRequest(r, "ci", "shared", body)
+	_, done, err := a.Authenticate(r)
+	done()
+	assert.True(t, isTooLarge(err), "%v", err)
+
+	// Chunked
+	r = httptest.NewRequest("GET", "/api/v1/reports", ioutil.NopCloser(bytes.NewReader(body)))
+	r.ContentLength = -1
+	SignRequest(r, "ci", "shared", body)
+	_, done, err = a.Authenticate(r)
+	done()
+	assert.True(t, isTooLarge(err), "%v", err)
+}
+
+func TestAuthenticate_JWT(t *testing.T) {
+	a, rk, ek := testAuth(t)
+
+	now := time.Now().Unix()
+	good := map[string]interface{}{
+		"sub":   "alice",
+		"iss":   "https://idp.example.com",
+		"aud":   []string{"other", "dmarc"},
+		"exp":   now + 60,
+		"scope": "read upload",
+	}
+
+	for _, tok := range []string{signJWT(t, rk, "rsa1", good), signJWT(t, ek, "ec1", good)} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		p, _, err := a.Authenticate(r)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", p.ID)
+		assert.Equal(t, AuthJWT, p.Method)
+		assert.True(t, p.HasScope(ScopeRead))
+		assert.True(t, p.HasScope(ScopeUpload))
+	}
+
+	claims := func(k string, v interface{}) map[string]interface{} {
+		c := map[string]interface{}{}
+		for k, v := range good {
+			c[k] = v
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	bad := []string{
+		signJWT(t, rk, "rsa1", claims("exp", now-3600)),
+		signJWT(t, rk, "rsa1", claims("exp", nil)),
+		signJWT(t, rk, "rsa1", claims("nbf", now+3600)),
+		signJWT(t, rk, "rsa1", claims("iss", "https://evil.example.com")),
+		signJWT(t, rk, "rsa1", claims("aud", "other")),
+		signJWT(t, rk, "ec1", good),
+		signJWT(t, rk, "unknown", good),
+		"not.a.token",
+		"foo",
+	}
+	for _, tok := range bad {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		_, _, err := a.Authenticate(r)
+		assert.Error(t, err, tok)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	a, _, _ := testAuth(t)
+	authenticator = a
+	defer func() { authenticator = nil }()
+
+	h := requireScope(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "reader", PrincipalFrom(r.Context()).ID)
+		w.Write([]byte("ok"))
+	})
+
+	td := []struct {
+		key    string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusForbidden},
+		{"r34d", http.StatusOK},
+	}
+	for _, e := range td {
+		r := httptest.NewRequest("GET", "/", nil)
+		if e.key != "" {
+			r.Header.Set("X-API-Key", e.key)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		assert.Equal(t, e.status, w.Code, e.key)
+	}
+}
+
+func TestRequireScope_Disabled(t *testing.T) {
+	h := requireScope(ScopeRead, func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, PrincipalFrom(r.Context()))
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
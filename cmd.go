@@ -0,0 +1,357 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
+)
+
+// Command is a subcommand of the CLI like "analyze" or "store query"
+type Command struct {
+	// Name is one or two words
+	Name string
+	// Args describes the arguments after the flags
+	Args  string
+	Short string
+	// Flags are the global flags the command accepts besides commonFlags,
+	// a trailing * matches every flag with that prefix.
+	Flags []string
+	// Setup adds the flags belonging to the command only
+	Setup func(fs *flag.FlagSet)
+	Run   func(args []string) error
+}
+
+// commonFlags are accepted by every command
+var commonFlags = []string{"D", "v", "log-*", "config"}
+
+// analyzeFlags select, resolve and display records
+var analyzeFlags = []string{"N", "j", "S", "o", "template", "validate",
+	"only-fail", "disposition", "source-ip", "header-from", "group-by"}
+
+// extractFlags limit what is read from archives
+var extractFlags = []string{"max-entries", "max-entry-size", "max-total-size", "max-ratio", "max-depth"}
+
+// commands are all the subcommands, see init
+var commands []*Command
+
+// stdout is where commands write their output
+var stdout io.Writer = os.Stdout
+
+func init() {
+	commands = []*Command{
+		{
+			Name:  "analyze",
+			Args:  "FILE...",
+			Short: "Analyze aggregate reports, compressed or in archives, - is stdin",
+			Flags: append(append([]string{"t"}, analyzeFlags...), extractFlags...),
+			Run:   runAnalyze,
+		},
+		{
+			Name:  "serve",
+			Short: "Start the REST API",
+			Flags: []string{"N", "j", "validate", "listen", "tls-*", "*-timeout", "max-*", "auth", "store", "spool",
+				"workers", "cors-*", "rate-*", "burst-*", "trust-proxy", "ready-*", "template-dir"},
+			Run: runServe,
+		},
+		{
+			Name:  "ingest maildir",
+			Args:  "DIR",
+			Short: "Store the aggregate and forensic reports mailed to a Maildir",
+			Flags: append([]string{"auth", "store", "validate"}, extractFlags...),
+			Setup: ingestFlags,
+			Run:   runIngestMaildir,
+		},
+		{
+			Name:  "dns check",
+			Args:  "DOMAIN...",
+			Short: "Check the DMARC records of domains",
+			Flags: []string{"o"},
+			Run:   runDNSCheck,
+		},
+		{
+			Name:  "store query",
+			Short: "List the aggregate reports kept in -store",
+			Flags: []string{"store", "o", "only-fail", "disposition", "source-ip", "header-from"},
+			Setup: queryFlags,
+			Run:   runStoreQuery,
+		},
+		{
+			Name:  "export",
+			Short: "Export the aggregate reports kept in -store",
+			Flags: append([]string{"store"}, analyzeFlags...),
+			Setup: exportFlags,
+			Run:   runExport,
+		},
+		{
+			Name:  "config validate",
+			Args:  "[FILE]",
+			Short: "Check a configuration file, -config by default",
+			Flags: []string{"*"},
+			Run:   runConfigValidate,
+		},
+		{
+			Name:  "version",
+			Short: "Display version",
+			Run: func(args []string) error {
+				Version()
+				return nil
+			},
+		},
+		{
+			Name:  "help",
+			Args:  "[COMMAND]",
+			Short: "Display help about a command",
+			Run:   runHelp,
+		},
+	}
+
+	flag.Usage = usage
+}
+
+// findCommand returns the command named by the first words of args and
+// the remaining arguments, nil if there is none.
+func findCommand(args []string) (*Command, []string) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.Name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.Name {
+			return cmd, args[len(words):]
+		}
+	}
+	return nil, args
+}
+
+// matchFlag is true if name is one of the flags in list
+func matchFlag(list []string, name string) bool {
+	for _, f := range list {
+		switch {
+		case f == name:
+			return true
+		case strings.HasSuffix(f, "*") && strings.HasPrefix(name, strings.TrimSuffix(f, "*")):
+			return true
+		case strings.HasPrefix(f, "*") && strings.HasSuffix(name, strings.TrimPrefix(f, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// FlagSet returns the flags of cmd, global ones set the same variables
+// whether given before or after the command.
+func (cmd *Command) FlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(MyName+" "+cmd.Name, flag.ContinueOnError)
+
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if matchFlag(commonFlags, f.Name) || matchFlag(cmd.Flags, f.Name) {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	if cmd.Setup != nil {
+		cmd.Setup(fs)
+	}
+
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]", MyName, cmd.Name)
+		if cmd.Args != "" {
+			fmt.Fprintf(out, " %s", cmd.Args)
+		}
+		fmt.Fprintf(out, "\n\n%s.\n\nFlags:\n", cmd.Short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Execute parses the flags of cmd in args then runs it
+func (cmd *Command) Execute(args []string) error {
+	fs := cmd.FlagSet()
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if err := configure(fs); err != nil {
+		return err
+	}
+	return cmd.Run(fs.Args())
+}
+
+// usage lists the commands and global flags
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, "Usage: %s [flags] COMMAND [flags] [args]\n       %s [flags] FILE\n\nCommands:\n", MyName, MyName)
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", cmd.Name, cmd.Short)
+	}
+	fmt.Fprintf(out, "\nWithout a command, FILE is analyzed and -rest-server starts the REST API.\n"+
+		"Use \"%s help COMMAND\" for the flags of a command.\n\nFlags:\n", MyName)
+	flag.PrintDefaults()
+}
+
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+
+	cmd, rest := findCommand(args)
+	if cmd == nil || len(rest) > 0 {
+		return errors.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	cmd.FlagSet().Usage()
+	return nil
+}
+
+// setupCommand checks the flags shared by all commands and returns a
+// context using them.
+func setupCommand() (*Context, error) {
+	o, err := setupOptions()
+	if err != nil {
+		return nil, err
+	}
+	return NewContext(o)
+}
+
+// setupOptions sets logging up and returns the options given by the
+// flags, template and filter compiled.
+func setupOptions() (Options, error) {
+	o := flagOptions()
+
+	c := fLog
+	c.Verbose = fVerbose
+	if err := setupLogging(c); err != nil {
+		return o, err
+	}
+	debug("debug mode")
+
+	if err := analyze.CheckOutput(o.Format); err != nil {
+		return o, err
+	}
+
+	if fTemplate != "" {
+		t, err := LoadTemplate(fTemplate)
+		if err != nil {
+			return o, err
+		}
+		o.Template = t
+		o.Format = analyze.OutputTemplate
+	}
+
+	filter, err := analyze.NewFilter(fFilter)
+	if err != nil {
+		return o, err
+	}
+	o.Filter = filter
+	return o, nil
+}
+
+// runAnalyze displays every file given
+func runAnalyze(args []string) error {
+	ctx, err := Setup(args)
+	if ctx == nil {
+		return errors.Wrap(err, "analyze")
+	}
+
+	for _, file := range args {
+		txt, err := analyzeFile(ctx, file)
+		if err != nil {
+			return err
+		}
+
+		if format := ctx.opts.Format; analyze.IsTable(format) || format == analyze.OutputHTML {
+			fmt.Fprint(stdout, txt)
+			continue
+		}
+		fmt.Fprintln(stdout, txt)
+	}
+	return nil
+}
+
+// analyzeFile returns the output for all the reports of file
+func analyzeFile(ctx *Context, file string) (string, error) {
+	verbose("Analyzing %s", file)
+
+	in, err := SelectInput(ctx, file)
+	if err != nil {
+		return "", errors.Wrap(err, "SelectInput")
+	}
+	defer in.Close()
+
+	// Format is guessed from the content so -t is only a hint for stdin
+	if ctx.opts.Filter.Grouping() {
+		txt, err := HandleGroups(ctx, file, in)
+		if err != nil {
+			return "", errors.Wrapf(err, "file %s:", file)
+		}
+		return txt, nil
+	}
+
+	out, err := HandleReports(ctx, file, in)
+	if err != nil {
+		return "", errors.Wrapf(err, "file %s:", file)
+	}
+	txt, err := ctx.a.Join(filepath.Base(file), out)
+	if err != nil {
+		return "", errors.Wrap(err, "output")
+	}
+	return txt, nil
+}
+
+// runServe starts the REST API
+func runServe(args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("serve takes no argument, got %q", args)
+	}
+
+	fServer = true
+	ctx, err := Setup(args)
+	if ctx == nil {
+		return errors.Wrap(err, "serve")
+	}
+
+	if fAuth != "" {
+		authenticator, err = LoadAuth(fAuth)
+		if err != nil {
+			return errors.Wrap(err, "LoadAuth")
+		}
+	} else {
+		logger.Warn("no -auth file, the API is open to anyone")
+	}
+
+	reportStore, err = OpenStore(fStore)
+	if err != nil {
+		return errors.Wrap(err, "OpenStore")
+	}
+	if fStore == "" {
+		logger.Warn("no -store, only the last reports are kept in memory", "max", memRetention)
+	}
+
+	router, err := newRouter()
+	if err != nil {
+		return errors.Wrap(err, "serve")
+	}
+
+	o := ctx.opts
+	o.Tenants = authenticator.Tenants()
+	jobQueue, err = NewJobQueue(reportStore, fSpool, fWorkers, o)
+	if err != nil {
+		return errors.Wrap(err, "NewJobQueue")
+	}
+	if err := jobQueue.Start(); err != nil {
+		return errors.Wrap(err, "jobQueue")
+	}
+
+	logger.Info("starting DMARC REST API", "version", MyVersion)
+	return runServer(fServerConfig, recoverPanics(router))
+}
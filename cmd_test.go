@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindCommand(t *testing.T) {
+	cmd, rest := findCommand([]string{"store", "query", "-o", "json"})
+	require.NotNil(t, cmd)
+	assert.Equal(t, "store query", cmd.Name)
+	assert.Equal(t, []string{"-o", "json"}, rest)
+
+	cmd, rest = findCommand([]string{"analyze"})
+	require.NotNil(t, cmd)
+	assert.Empty(t, rest)
+
+	// Legacy invocation
+	cmd, rest = findCommand([]string{"testdata/google.com!keltia.net!1538438400!1538524799.xml"})
+	assert.Nil(t, cmd)
+	assert.Len(t, rest, 1)
+
+	cmd, _ = findCommand([]string{"store"})
+	assert.Nil(t, cmd)
+}
+
+func TestMatchFlag(t *testing.T) {
+	list := []string{"store", "cors-*", "*-timeout"}
+
+	assert.True(t, matchFlag(list, "store"))
+	assert.True(t, matchFlag(list, "cors-origins"))
+	assert.True(t, matchFlag(list, "read-timeout"))
+	assert.False(t, matchFlag(list, "spool"))
+	assert.False(t, matchFlag(list, "stores"))
+}
+
+func TestCommand_FlagSet(t *testing.T) {
+	cmd, _ := findCommand([]string{"analyze"})
+	fs := cmd.FlagSet()
+
+	// Own and common flags only
+	assert.NotNil(t, fs.Lookup("N"))
+	assert.NotNil(t, fs.Lookup("log-level"))
+	assert.Nil(t, fs.Lookup("listen"))
+
+	// Shared with the global flag
+	require.NoError(t, fs.Parse([]string{"-N", "-o", "csv", "file.xml"}))
+	assert.True(t, fNoResolv)
+	assert.Equal(t, analyze.OutputCSV, fOutput)
+	assert.Equal(t, []string{"file.xml"}, fs.Args())
+	fNoResolv = false
+	fOutput = analyze.OutputText
+
+	var buf bytes.Buffer
+	fs.SetOutput(&buf)
+	fs.Usage()
+	assert.Contains(t, buf.String(), "analyze [flags] FILE...")
+}
+
+func TestCommand_Execute(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() {
+		stdout = os.Stdout
+		fNoResolv = false
+		fValidate = report.ValidateLenient
+	}()
+
+	file := "testdata/google.com!keltia.net!1538438400!1538524799.xml"
+	require.NoError(t, realmain([]string{"analyze", "-N", "-validate", "none", file}))
+	assert.Contains(t, buf.String(), "keltia.net")
+
+	assert.NoError(t, realmain([]string{"analyze", "-h"}))
+	assert.Error(t, realmain([]string{"analyze", "-listen", ":80", file}))
+	assert.Error(t, realmain([]string{"serve", "extra"}))
+	assert.NoError(t, realmain([]string{"help", "dns", "check"}))
+	assert.Error(t, realmain([]string{"help", "nope"}))
+}
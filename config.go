@@ -0,0 +1,437 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fConfig is the configuration file, YAML or TOML
+var fConfig string
+
+func init() {
+	flag.StringVar(&fConfig, "config", "", "YAML or TOML configuration file")
+}
+
+// configSections lists the flags each section of the configuration file
+// sets, under their long name, see settingName.
+var configSections = map[string][]string{
+	"server": {"listen", "tls-cert", "tls-key", "tls-client-ca", "read-timeout", "write-timeout", "idle-timeout",
+		"shutdown-timeout", "max-header-bytes", "max-body", "max-inflight", "workers", "auth",
+		"rate-client", "burst-client", "rate-key", "burst-key", "trust-proxy",
+		"cors-origins", "cors-methods", "cors-headers", "cors-credentials", "cors-max-age",
+		"ready-dns-probe", "ready-timeout", "ready-max-queue", "template-dir"},
+	"resolver":  {"N", "j"},
+	"storage":   {"store", "spool"},
+	"ingestion": {"t", "validate", "max-entries", "max-entry-size", "max-total-size", "max-ratio", "max-depth"},
+	"output":    {"o", "S", "template", "only-fail", "disposition", "source-ip", "header-from", "group-by"},
+	"log":       {"D", "v", "log-level", "log-format", "log-reports"},
+}
+
+// longNames are the names of short flags in configuration files and
+// environment variables.
+var longNames = map[string]string{
+	"D":    "debug",
+	"v":    "verbose",
+	"N":    "no-resolve",
+	"j":    "jobs",
+	"o":    "format",
+	"S":    "sort",
+	"t":    "type",
+	"auth": "auth-file",
+}
+
+// unconfigured flags only make sense on the command line
+var unconfigured = map[string]bool{"config": true, "version": true}
+
+// settingName is the name of flag name in configuration files
+func settingName(name string) string {
+	if long, ok := longNames[name]; ok {
+		return long
+	}
+	return name
+}
+
+// envName is the environment variable setting flag name, -tls-cert is
+// DMARC_TLS_CERT.
+func envName(name string) string {
+	return "DMARC_" + strings.ToUpper(strings.Replace(settingName(name), "-", "_", -1))
+}
+
+// configFlag returns the flag set by key in section, underscores may be
+// used instead of dashes.
+func configFlag(section, key string) (string, bool) {
+	key = strings.Replace(key, "_", "-", -1)
+	for _, name := range configSections[section] {
+		if settingName(name) == key {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Config is a parsed configuration file
+type Config struct {
+	File string
+	// Values are flag values by flag name
+	Values map[string]string
+}
+
+// LoadConfig reads file, its format is given by its extension
+func LoadConfig(file string) (*Config, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	var settings []setting
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		settings, err = parseYAML(string(raw))
+	case ".toml":
+		settings, err = parseTOML(string(raw))
+	default:
+		return nil, errors.Errorf("config %s: unknown format, use .yaml, .yml or .toml", file)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "config %s", file)
+	}
+
+	c := &Config{File: file, Values: map[string]string{}}
+	for _, s := range settings {
+		if _, ok := configSections[s.section]; !ok {
+			return nil, errors.Errorf("config %s:%d: unknown section %q", file, s.line, s.section)
+		}
+		name, ok := configFlag(s.section, s.key)
+		if !ok {
+			return nil, errors.Errorf("config %s:%d: unknown setting %s.%s", file, s.line, s.section, s.key)
+		}
+		if _, dup := c.Values[name]; dup {
+			return nil, errors.Errorf("config %s:%d: %s.%s set twice", file, s.line, s.section, s.key)
+		}
+		c.Values[name] = s.value
+	}
+	return c, nil
+}
+
+// applyConfig sets the flags not given on the command line, listed in
+// set, from their DMARC_* variable then from c if not nil.
+func applyConfig(fs *flag.FlagSet, set map[string]bool, c *Config) error {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if !set[f.Name] && !unconfigured[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	for _, name := range names {
+		if v, ok := os.LookupEnv(envName(name)); ok {
+			if err := fs.Set(name, v); err != nil {
+				return errors.Errorf("%s: %v", envName(name), err)
+			}
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		if v, ok := c.Values[name]; ok {
+			if err := fs.Set(name, v); err != nil {
+				return errors.Errorf("config %s: %s: %v", c.File, settingName(name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagsGiven are the flags set on the command line, see configure
+var flagsGiven = map[string]bool{}
+
+// configure applies the environment and -config to the global flags,
+// fs holds the flags of the command if any.
+func configure(fs *flag.FlagSet) error {
+	flagsGiven = map[string]bool{}
+	visit := func(f *flag.Flag) { flagsGiven[f.Name] = true }
+	flag.Visit(visit)
+	if fs != nil {
+		fs.Visit(visit)
+	}
+
+	// -config itself may only come from the command line or DMARC_CONFIG
+	if v, ok := os.LookupEnv(envName("config")); ok && !flagsGiven["config"] {
+		fConfig = v
+	}
+
+	var c *Config
+	if fConfig != "" {
+		var err error
+		if c, err = LoadConfig(fConfig); err != nil {
+			return err
+		}
+	}
+	return applyConfig(flag.CommandLine, flagsGiven, c)
+}
+
+// setting is one key = value of a configuration file
+type setting struct {
+	line    int
+	section string
+	key     string
+	// value is a flag value, lists are comma-separated
+	value string
+}
+
+// stripComment removes a # comment outside of quotes
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseScalar returns a string, number or boolean without its quotes
+func parseScalar(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return s, nil
+	}
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", errors.Errorf("bad string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if s[len(s)-1] != '\'' {
+			return "", errors.Errorf("bad string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return s, nil
+}
+
+// parseValue returns a scalar or a one-line [a, b] list as a flag value
+func parseValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "[") {
+		return parseScalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return "", errors.Errorf("unterminated list %s", s)
+	}
+
+	var (
+		items []string
+		quote byte
+		start = 1
+	)
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',' || i == len(s)-1:
+			item := strings.TrimSpace(s[start:i])
+			start = i + 1
+			if item == "" {
+				continue
+			}
+			v, err := parseScalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+	}
+	if quote != 0 {
+		return "", errors.Errorf("unterminated string in %s", s)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// parseTOML reads the TOML subset used by configuration files: [section]
+// tables of key = value with strings, numbers, booleans and arrays.
+func parseTOML(txt string) ([]setting, error) {
+	var (
+		list    []setting
+		section string
+	)
+	for n, line := range strings.Split(txt, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.Errorf("line %d: bad table %s", n+1, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 1 {
+			return nil, errors.Errorf("line %d: expected key = value", n+1)
+		}
+		if section == "" {
+			return nil, errors.Errorf("line %d: setting outside of a table", n+1)
+		}
+		v, err := parseValue(line[i+1:])
+		if err != nil {
+			return nil, errors.Errorf("line %d: %v", n+1, err)
+		}
+		list = append(list, setting{n + 1, section, strings.TrimSpace(line[:i]), v})
+	}
+	return list, nil
+}
+
+// parseYAML reads the YAML subset used by configuration files: top-level
+// sections of key: value with scalars, [a, b] lists and "- item" lists.
+func parseYAML(txt string) ([]setting, error) {
+	var (
+		list    []setting
+		section string
+		// items is the index in list of a key waiting for "- item" lines
+		items = -1
+	)
+	for n, raw := range strings.Split(txt, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(raw), "---") && section == "" {
+			continue
+		}
+		line := strings.TrimRight(stripComment(raw), " \t\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, errors.Errorf("line %d: tabs are not allowed for indentation", n+1)
+		}
+		indented := strings.HasPrefix(line, " ")
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "- ") || line == "-" {
+			if !indented || items < 0 {
+				return nil, errors.Errorf("line %d: list item without a key", n+1)
+			}
+			v, err := parseScalar(strings.TrimPrefix(line, "-"))
+			if err != nil {
+				return nil, errors.Errorf("line %d: %v", n+1, err)
+			}
+			if list[items].value != "" {
+				v = "," + v
+			}
+			list[items].value += v
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 1 {
+			return nil, errors.Errorf("line %d: expected key: value", n+1)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		if !indented {
+			if value != "" {
+				return nil, errors.Errorf("line %d: %s must be a section", n+1, key)
+			}
+			section, items = key, -1
+			continue
+		}
+		if section == "" {
+			return nil, errors.Errorf("line %d: setting outside of a section", n+1)
+		}
+
+		v, err := parseValue(value)
+		if err != nil {
+			return nil, errors.Errorf("line %d: %v", n+1, err)
+		}
+		list = append(list, setting{n + 1, section, key, v})
+		items = -1
+		if value == "" {
+			items = len(list) - 1
+		}
+	}
+	return list, nil
+}
+
+// runConfigValidate is config validate
+func runConfigValidate(args []string) error {
+	switch len(args) {
+	case 0:
+		if fConfig == "" {
+			return errors.New("config validate needs a file or -config")
+		}
+	case 1:
+		fConfig = args[0]
+	default:
+		return errors.New("config validate takes one file")
+	}
+
+	c, err := LoadConfig(fConfig)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(flag.CommandLine, flagsGiven, c); err != nil {
+		return err
+	}
+	if err := checkConfig(); err != nil {
+		return errors.Wrapf(err, "config %s", fConfig)
+	}
+
+	fmt.Fprintf(stdout, "%s: OK, %d settings\n", fConfig, len(c.Values))
+	return nil
+}
+
+// checkConfig checks the settings that would only fail when used
+func checkConfig() error {
+	if _, err := setupCommand(); err != nil {
+		return err
+	}
+	if (fServerConfig.CertFile == "") != (fServerConfig.KeyFile == "") {
+		return errors.New("tls-cert and tls-key go together")
+	}
+	if fAuth != "" {
+		if _, err := LoadAuth(fAuth); err != nil {
+			return errors.Wrap(err, "auth-file")
+		}
+	}
+	if fTemplateDir != "" {
+		if fi, err := os.Stat(fTemplateDir); err != nil || !fi.IsDir() {
+			return errors.Errorf("template-dir %s is not a directory", fTemplateDir)
+		}
+	}
+	if _, err := newCORS(fCORS); err != nil {
+		return err
+	}
+	if fJobs < 1 || fWorkers < 1 {
+		return errors.New("jobs and workers must be at least 1")
+	}
+	return nil
+}
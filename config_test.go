@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "DMARC_TLS_CERT", envName("tls-cert"))
+	assert.Equal(t, "DMARC_NO_RESOLVE", envName("N"))
+	assert.Equal(t, "DMARC_AUTH_FILE", envName("auth"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	want := map[string]string{
+		"listen":           ":8443",
+		"shutdown-timeout": "45s",
+		"cors-origins":     "https://dmarc.example.com,https://*.example.net",
+		"N":                "true",
+		"j":                "4",
+		"store":            "/var/lib/dmarc/reports.json",
+		"max-entries":      "500",
+		"o":                "json",
+		"disposition":      "quarantine,reject",
+		"log-level":        "debug",
+	}
+
+	for _, file := range []string{"testdata/config.yaml", "testdata/config.toml"} {
+		c, err := LoadConfig(file)
+		require.NoError(t, err, file)
+		assert.Equal(t, want, c.Values, file)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for name, txt := range map[string]string{
+		"section.yaml":  "alerting:\n  url: x\n",
+		"setting.yaml":  "server:\n  port: 80\n",
+		"wrong.yaml":    "output:\n  listen: :80\n",
+		"twice.yaml":    "server:\n  listen: :80\n  listen: :81\n",
+		"top.yaml":      "listen: :80\n",
+		"item.yaml":     "server:\n- a\n",
+		"quote.toml":    "[server]\nlisten = \":80\n",
+		"list.toml":     "[server]\ncors-origins = [\"a\", \"b]\n",
+		"table.toml":    "listen = \":80\"\n",
+		"format.json":   "{}",
+		"notfound.toml": "",
+	} {
+		file := filepath.Join(dir, name)
+		if name != "notfound.toml" {
+			require.NoError(t, ioutil.WriteFile(file, []byte(txt), 0644))
+		}
+		_, err := LoadConfig(file)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParseYAML_Comments(t *testing.T) {
+	list, err := parseYAML("---\nserver: # the API\n  listen: \"#:80\" # quoted\n")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, setting{3, "server", "listen", "#:80"}, list[0])
+}
+
+func TestApplyConfig(t *testing.T) {
+	var (
+		listen, store string
+		jobs          int
+		timeout       time.Duration
+	)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&listen, "listen", ":8080", "")
+	fs.StringVar(&store, "store", "", "")
+	fs.IntVar(&jobs, "j", 1, "")
+	fs.DurationVar(&timeout, "shutdown-timeout", time.Second, "")
+
+	c := &Config{File: "test.yaml", Values: map[string]string{
+		"listen": ":1", "store": "file.json", "j": "2",
+	}}
+
+	os.Setenv("DMARC_STORE", "env.json")
+	os.Setenv("DMARC_JOBS", "3")
+	defer os.Unsetenv("DMARC_STORE")
+	defer os.Unsetenv("DMARC_JOBS")
+
+	// Flags > env > file > defaults
+	require.NoError(t, fs.Parse([]string{"-j", "4"}))
+	require.NoError(t, applyConfig(fs, map[string]bool{"j": true}, c))
+	assert.Equal(t, 4, jobs)
+	assert.Equal(t, "env.json", store)
+	assert.Equal(t, ":1", listen)
+	assert.Equal(t, time.Second, timeout)
+
+	os.Setenv("DMARC_JOBS", "many")
+	assert.Error(t, applyConfig(fs, nil, c))
+	os.Unsetenv("DMARC_JOBS")
+
+	c.Values["j"] = "many"
+	assert.Error(t, applyConfig(fs, nil, c))
+}
+
+func TestConfigValidate(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = &buf
+	server, extract, filter, log, jobs := fServerConfig, fExtract, fFilter, fLog, fJobs
+	defer func() {
+		stdout = os.Stdout
+		fConfig = ""
+		fOutput = analyze.OutputText
+		fNoResolv = false
+		fStore = ""
+		fServerConfig, fExtract, fFilter, fLog, fJobs = server, extract, filter, log, jobs
+		setupLogging(fLog)
+	}()
+
+	require.NoError(t, realmain([]string{"config", "validate", "testdata/config.toml"}))
+	assert.Equal(t, "testdata/config.toml: OK, 10 settings\n", buf.String())
+	assert.Equal(t, analyze.OutputJSON, fOutput)
+	assert.Equal(t, []string{"quarantine", "reject"}, fFilter.Dispositions)
+
+	fConfig = ""
+	assert.Error(t, realmain([]string{"config", "validate"}))
+	assert.Error(t, realmain([]string{"config", "validate", "testdata/notfound.yaml"}))
+}
+
+func TestApplyConfig_Env(t *testing.T) {
+	server, cors := fServerConfig, fCORS
+	defer func() {
+		fServerConfig, fCORS = server, cors
+	}()
+
+	os.Setenv("DMARC_LISTEN", ":9090")
+	os.Setenv("DMARC_CORS_METHODS", "GET")
+	defer os.Unsetenv("DMARC_LISTEN")
+	defer os.Unsetenv("DMARC_CORS_METHODS")
+
+	// The environment is only read by applyConfig, not by the defaults
+	assert.Equal(t, ":8080", flag.Lookup("listen").DefValue)
+	assert.Equal(t, "GET,POST", flag.Lookup("cors-methods").DefValue)
+
+	require.NoError(t, applyConfig(flag.CommandLine, nil, nil))
+	assert.Equal(t, ":9090", fServerConfig.Addr)
+	assert.Equal(t, []string{"GET"}, fCORS.Methods)
+	assert.Equal(t, []string{"Authorization", "Content-Type", "X-API-Key", "X-Request-ID"}, fCORS.Headers)
+}
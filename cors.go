@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CORSConfig lets browser applications on other origins call the API
+type CORSConfig struct {
+	// Origins allowed, "*" for any or "https://*.example.com" for subdomains
+	Origins []string
+	Methods []string
+	Headers []string
+	// Credentials allows cookies and Authorization headers
+	Credentials bool
+	// MaxAge is how long in seconds preflight results can be cached
+	MaxAge int
+}
+
+var fCORS CORSConfig
+
+// corsExposed are the response headers scripts can read
+const corsExposed = "Location, Retry-After, X-Request-ID"
+
+func init() {
+	c := &fCORS
+
+	c.Methods = []string{"GET", "POST"}
+	c.Headers = []string{"Authorization", "Content-Type", "X-API-Key", "X-Request-ID"}
+
+	flag.Var((*listFlag)(&c.Origins), "cors-origins", "Comma-separated origins allowed to call the API, empty disables CORS")
+	flag.Var((*listFlag)(&c.Methods), "cors-methods", "Comma-separated methods allowed for CORS")
+	flag.Var((*listFlag)(&c.Headers), "cors-headers", "Comma-separated request headers allowed for CORS")
+	flag.BoolVar(&c.Credentials, "cors-credentials", false, "Allow credentials in CORS requests")
+	flag.IntVar(&c.MaxAge, "cors-max-age", 600, "Seconds browsers can cache preflight responses")
+
+}
+
+// listFlag is a comma-separated flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping empty elements
+func splitList(s string) []string {
+	var list []string
+
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// cors answers preflight requests and adds the CORS headers
+type cors struct {
+	cnf     CORSConfig
+	methods string
+	headers string
+}
+
+// newCORS refuses credentials for any origin, client certificates and
+// API keys kept by browsers would be usable by every web site.
+func newCORS(cnf CORSConfig) (*cors, error) {
+	if cnf.Credentials {
+		for _, o := range cnf.Origins {
+			if o == "*" {
+				return nil, errors.New("cors-credentials can not be used with * in cors-origins")
+			}
+		}
+	}
+	return &cors{
+		cnf:     cnf,
+		methods: strings.Join(cnf.Methods, ", "),
+		headers: strings.Join(cnf.Headers, ", "),
+	}, nil
+}
+
+// allowOrigin is true if origin matches one of the configured ones
+func (c *cors) allowOrigin(origin string) bool {
+	for _, o := range c.cnf.Origins {
+		switch {
+		case o == "*", strings.EqualFold(o, origin):
+			return true
+		case strings.Contains(o, "://*."):
+			// https://*.example.com matches https://app.example.com
+			i := strings.Index(o, "*")
+			if strings.HasPrefix(origin, o[:i]) && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(o[i+1:])) &&
+				len(origin) > len(o)-1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *cors) allowMethod(method string) bool {
+	for _, m := range c.cnf.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) allowHeaders(req string) bool {
+	for _, h := range splitList(req) {
+		ok := false
+		for _, a := range c.cnf.Headers {
+			if strings.EqualFold(a, h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin adds the headers common to all CORS answers
+func (c *cors) setOrigin(w http.ResponseWriter, origin string) {
+	h := w.Header()
+
+	if len(c.cnf.Origins) != 1 || c.cnf.Origins[0] != "*" {
+		h.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if c.cnf.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight answers OPTIONS on every route, before authentication as
+// browsers never send credentials there.
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	w.Header().Set("Allow", "OPTIONS, "+c.methods)
+	if origin == "" || method == "" {
+		// Not a CORS preflight
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if len(c.cnf.Origins) == 0 || !c.allowOrigin(origin) || !c.allowMethod(method) ||
+		!c.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		debug("cors: rejected preflight from %s for %s", origin, method)
+		w.Header().Del("Access-Control-Allow-Origin")
+		w.Header().Del("Access-Control-Allow-Credentials")
+		w.Header().Del("Access-Control-Expose-Headers")
+		writeFailure(w, Failure{Stage: StageRequest, Code: CodeForbidden, Message: "CORS request not allowed"})
+		return
+	}
+
+	c.setOrigin(w, origin)
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", c.methods)
+	h.Set("Access-Control-Allow-Headers", c.headers)
+	h.Set("Access-Control-Max-Age", strconv.Itoa(c.cnf.MaxAge))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handler adds the CORS headers to answers for allowed origins
+func (c *cors) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin != "" && len(c.cnf.Origins) > 0 && c.allowOrigin(origin) {
+			c.setOrigin(w, origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withCORS(t *testing.T, c CORSConfig) func() {
+	old := fCORS
+	fCORS = c
+	return func() { fCORS = old }
+}
+
+func preflight(t *testing.T, url, origin, method, headers string) *http.Response {
+	req, err := http.NewRequest("OPTIONS", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	defer withCORS(t, CORSConfig{
+		Origins: []string{"https://dash.example.com", "https://*.example.org"},
+		Methods: []string{"GET", "POST"},
+		Headers: []string{"Authorization", "Content-Type", "X-API-Key"},
+		MaxAge:  60,
+	})()
+	ts, done := setupTestServer(t)
+	defer done()
+
+	// Every route answers, even those limited to GET or POST
+	for _, path := range []string{"/api/v1/upload_bundle", "/api/v1/reports", "/api/v1/jobs/x"} {
+		resp := preflight(t, ts.URL+path, "https://dash.example.com", "POST", "content-type, x-api-key")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode, path)
+		assert.Equal(t, "https://dash.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, POST", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+	}
+
+	resp := preflight(t, ts.URL+"/api/v1/reports", "https://app.example.org", "GET", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://app.example.org", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	tests := []struct {
+		name, origin, method, headers string
+	}{
+		{"origin", "https://evil.example.com", "GET", ""},
+		{"suffix", "https://example.org", "GET", ""},
+		{"method", "https://dash.example.com", "DELETE", ""},
+		{"header", "https://dash.example.com", "GET", "X-Custom"},
+	}
+	for _, tt := range tests {
+		resp := preflight(t, ts.URL+"/api/v1/reports", tt.origin, tt.method, tt.headers)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, tt.name)
+		assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), tt.name)
+	}
+}
+
+func TestCORS_Request(t *testing.T) {
+	defer withCORS(t, CORSConfig{Origins: []string{"*"}, Methods: []string{"GET"}})()
+
+	c, err := newCORS(fCORS)
+	require.NoError(t, err)
+	h := c.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/api/v1/reports", nil)
+	req.Header.Set("Origin", "https://any.example.net")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "Location")
+
+	// Credentials only go to listed origins, which are echoed
+	_, err = newCORS(CORSConfig{Origins: []string{"https://dash.example.com", "*"}, Credentials: true})
+	assert.Error(t, err)
+
+	c, err = newCORS(CORSConfig{Origins: []string{"https://*.example.net"}, Methods: []string{"GET"}, Credentials: true})
+	require.NoError(t, err)
+	h = c.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "https://any.example.net", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// CORS disabled by default
+	c.cnf.Origins = nil
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
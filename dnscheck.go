@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
+)
+
+// lookupTXT is net.LookupTXT, replaced in tests
+var lookupTXT = net.LookupTXT
+
+// DNSCheck is the result of checking the DMARC record of a domain
+type DNSCheck struct {
+	Domain   string            `json:"domain"`
+	Record   string            `json:"record,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Errors   []string          `json:"errors,omitempty"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// OK is true if the record has no error
+func (c DNSCheck) OK() bool {
+	return len(c.Errors) == 0
+}
+
+func (c *DNSCheck) errorf(format string, a ...interface{}) {
+	c.Errors = append(c.Errors, fmt.Sprintf(format, a...))
+}
+
+func (c *DNSCheck) warnf(format string, a ...interface{}) {
+	c.Warnings = append(c.Warnings, fmt.Sprintf(format, a...))
+}
+
+// parseDMARCTags splits a DMARC record in tag=value pairs, see RFC 7489
+// section 6.4.
+func parseDMARCTags(record string) (map[string]string, []string, error) {
+	tags := map[string]string{}
+
+	var order []string
+	for _, part := range strings.Split(record, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 1 {
+			return nil, nil, errors.Errorf("bad tag %q", part)
+		}
+		k := strings.ToLower(strings.TrimSpace(part[:i]))
+		if _, ok := tags[k]; ok {
+			return nil, nil, errors.Errorf("duplicate tag %s", k)
+		}
+		tags[k] = strings.TrimSpace(part[i+1:])
+		order = append(order, k)
+	}
+	return tags, order, nil
+}
+
+// isDMARCRecord is true for TXT records meant to be DMARC ones
+func isDMARCRecord(txt string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(txt)), "v=dmarc1")
+}
+
+// CheckDMARC looks the DMARC record of domain up and checks it
+func CheckDMARC(domain string) DNSCheck {
+	c := DNSCheck{Domain: normDomain(domain)}
+
+	txt, err := lookupTXT("_dmarc." + c.Domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			c.errorf("lookup failed: %v", err)
+			return c
+		}
+	}
+
+	var records []string
+	for _, t := range txt {
+		if isDMARCRecord(t) {
+			records = append(records, t)
+		}
+	}
+	switch len(records) {
+	case 0:
+		c.errorf("no DMARC record at _dmarc.%s", c.Domain)
+		return c
+	case 1:
+	default:
+		c.errorf("%d DMARC records, receivers ignore them all", len(records))
+		return c
+	}
+	c.Record = records[0]
+
+	tags, order, err := parseDMARCTags(c.Record)
+	if err != nil {
+		c.errorf("%v", err)
+		return c
+	}
+	c.Tags = tags
+	checkTags(&c, tags, order)
+	return c
+}
+
+// checkTags checks the values of a parsed record
+func checkTags(c *DNSCheck, tags map[string]string, order []string) {
+	if order[0] != "v" || tags["v"] != "DMARC1" {
+		c.errorf("record must start with v=DMARC1")
+	}
+
+	policies := map[string]bool{"none": true, "quarantine": true, "reject": true}
+	switch p, ok := tags["p"]; {
+	case !ok:
+		c.errorf("missing p tag")
+	case !policies[p]:
+		c.errorf("bad p=%s, must be none, quarantine or reject", p)
+	case p == "none":
+		c.warnf("p=none only monitors, failing messages are delivered")
+	}
+	for _, k := range []string{"sp", "np"} {
+		if v, ok := tags[k]; ok && !policies[v] {
+			c.errorf("bad %s=%s, must be none, quarantine or reject", k, v)
+		}
+	}
+
+	for _, k := range []string{"adkim", "aspf"} {
+		if v, ok := tags[k]; ok && v != "r" && v != "s" {
+			c.errorf("bad %s=%s, must be r or s", k, v)
+		}
+	}
+
+	if v, ok := tags["pct"]; ok {
+		n, err := strconv.Atoi(v)
+		switch {
+		case err != nil || n < 0 || n > 100:
+			c.errorf("bad pct=%s, must be 0 to 100", v)
+		case n < 100:
+			c.warnf("pct=%d, the policy only applies to %d%% of failing messages", n, n)
+		}
+	}
+
+	if v, ok := tags["fo"]; ok {
+		for _, o := range strings.Split(v, ":") {
+			if o = strings.TrimSpace(o); o != "0" && o != "1" && o != "d" && o != "s" {
+				c.errorf("bad fo=%s, must be 0, 1, d or s separated by :", v)
+				break
+			}
+		}
+	}
+
+	if v, ok := tags["ri"]; ok {
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			c.errorf("bad ri=%s, must be a number of seconds", v)
+		}
+	}
+
+	if _, ok := tags["rua"]; !ok {
+		c.warnf("no rua tag, no aggregate report will be sent")
+	}
+	for _, k := range []string{"rua", "ruf"} {
+		if v, ok := tags[k]; ok {
+			checkURIs(c, k, v)
+		}
+	}
+}
+
+// checkURIs checks the report addresses of tag k, and that other domains
+// agreed to receive reports, see RFC 7489 section 7.1.
+func checkURIs(c *DNSCheck, k, v string) {
+	for _, uri := range strings.Split(v, ",") {
+		uri = strings.TrimSpace(uri)
+		// Size limits like "!10m" are optional
+		if i := strings.IndexByte(uri, '!'); i >= 0 {
+			uri = uri[:i]
+		}
+
+		if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+			c.errorf("bad %s URI %q, must be mailto:", k, uri)
+			continue
+		}
+		addr := uri[len("mailto:"):]
+		at := strings.LastIndexByte(addr, '@')
+		if at < 1 || at == len(addr)-1 {
+			c.errorf("bad %s address %q", k, addr)
+			continue
+		}
+
+		dest := normDomain(addr[at+1:])
+		if dest == c.Domain || strings.HasSuffix(c.Domain, "."+dest) || strings.HasSuffix(dest, "."+c.Domain) {
+			continue
+		}
+
+		auth := c.Domain + "._report._dmarc." + dest
+		txt, _ := lookupTXT(auth)
+		found := false
+		for _, t := range txt {
+			found = found || isDMARCRecord(t)
+		}
+		if !found {
+			c.warnf("%s goes to %s but %s does not authorize it, reports will not be sent there", k, dest, auth)
+		}
+	}
+}
+
+// renderChecks displays checks as text or JSON
+func renderChecks(format string, checks []DNSCheck) (string, error) {
+	if format == analyze.OutputJSON {
+		out, err := json.MarshalIndent(checks, "", "\t")
+		if err != nil {
+			return "", errors.Wrap(err, "json")
+		}
+		return string(out) + "\n", nil
+	}
+
+	var buf bytes.Buffer
+	for _, c := range checks {
+		status := "OK"
+		if !c.OK() {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", c.Domain, status)
+		if c.Record != "" {
+			fmt.Fprintf(&buf, "  record: %s\n", c.Record)
+		}
+		for _, e := range c.Errors {
+			fmt.Fprintf(&buf, "  error: %s\n", e)
+		}
+		for _, w := range c.Warnings {
+			fmt.Fprintf(&buf, "  warning: %s\n", w)
+		}
+	}
+	return buf.String(), nil
+}
+
+// runDNSCheck is dns check
+func runDNSCheck(args []string) error {
+	if len(args) == 0 {
+		return errors.New("dns check needs at least one domain")
+	}
+	if fOutput != analyze.OutputText && fOutput != analyze.OutputJSON {
+		return errors.New("dns check only supports -o text or json")
+	}
+	if _, err := setupCommand(); err != nil {
+		return err
+	}
+
+	var (
+		checks []DNSCheck
+		failed int
+	)
+	for _, domain := range args {
+		c := CheckDMARC(domain)
+		if !c.OK() {
+			failed++
+		}
+		checks = append(checks, c)
+	}
+
+	txt, err := renderChecks(fOutput, checks)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, txt)
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d domains have a bad DMARC record", failed, len(args))
+	}
+	return nil
+}
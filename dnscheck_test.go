@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTXT answers TXT lookups from a map
+func fakeTXT(records map[string][]string) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		if txt, ok := records[name]; ok {
+			return txt, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+func TestParseDMARCTags(t *testing.T) {
+	tags, order, err := parseDMARCTags("v=DMARC1; p=reject;rua=mailto:a@example.com ;")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v", "p", "rua"}, order)
+	assert.Equal(t, "mailto:a@example.com", tags["rua"])
+
+	_, _, err = parseDMARCTags("v=DMARC1; p=none; p=reject")
+	assert.Error(t, err)
+	_, _, err = parseDMARCTags("v=DMARC1; reject")
+	assert.Error(t, err)
+}
+
+func TestCheckDMARC(t *testing.T) {
+	lookupTXT = fakeTXT(map[string][]string{
+		"_dmarc.good.example":                   {"v=spf1 -all", "v=DMARC1; p=reject; rua=mailto:dmarc@good.example; fo=1:d"},
+		"_dmarc.weak.example":                   {"v=DMARC1; p=none; pct=50; rua=mailto:r@reports.example"},
+		"_dmarc.bad.example":                    {"v=DMARC1; p=drop; adkim=x; pct=200; fo=2; rua=https://example.com"},
+		"_dmarc.twice.example":                  {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		"_dmarc.order.example":                  {"v=DMARC1 ; p=none; rua=mailto:a@order.example"},
+		"_dmarc.ext.example":                    {"v=DMARC1; p=reject; rua=mailto:a@ok.example"},
+		"ext.example._report._dmarc.ok.example": {"v=DMARC1"},
+	})
+	defer func() { lookupTXT = net.LookupTXT }()
+
+	c := CheckDMARC("Good.Example.")
+	assert.True(t, c.OK(), c.Errors)
+	assert.Empty(t, c.Warnings)
+	assert.Equal(t, "reject", c.Tags["p"])
+
+	c = CheckDMARC("weak.example")
+	assert.True(t, c.OK(), c.Errors)
+	assert.Len(t, c.Warnings, 3)
+
+	c = CheckDMARC("bad.example")
+	assert.False(t, c.OK())
+	assert.Len(t, c.Errors, 5)
+
+	c = CheckDMARC("twice.example")
+	assert.False(t, c.OK())
+
+	c = CheckDMARC("none.example")
+	assert.False(t, c.OK())
+
+	assert.True(t, CheckDMARC("order.example").OK())
+	c = CheckDMARC("ext.example")
+	assert.True(t, c.OK())
+	assert.Empty(t, c.Warnings)
+}
+
+func TestRenderChecks(t *testing.T) {
+	checks := []DNSCheck{{Domain: "bad.example", Errors: []string{"missing p tag"}, Warnings: []string{"no rua"}}}
+
+	txt, err := renderChecks(analyze.OutputText, checks)
+	require.NoError(t, err)
+	assert.Equal(t, "bad.example: FAIL\n  error: missing p tag\n  warning: no rua\n", txt)
+
+	txt, err = renderChecks(analyze.OutputJSON, checks)
+	require.NoError(t, err)
+	assert.Contains(t, txt, `"errors": [`)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	rdebug "runtime/debug"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// Stages where processing an upload can fail
+const (
+	StageUpload     = "upload"
+	StageDecompress = "decompress"
+	StageParse      = "parse"
+	StageAnalyze    = "analyze"
+	StageRequest    = "request"
+)
+
+// Machine-readable error codes
+const (
+	CodeBadRequest        = "bad_request"
+	CodeMissingFile       = "missing_file"
+	CodeTooLarge          = "too_large"
+	CodeUnsupportedType   = "unsupported_media_type"
+	CodeQueueFull         = "queue_full"
+	CodeUnsupportedFormat = "unsupported_format"
+	CodeBadArchive        = "bad_archive"
+	CodeLimitExceeded     = "limit_exceeded"
+	CodeUnsafeArchive     = "unsafe_archive"
+	CodeNoReport          = "no_report"
+	CodeBadXML            = "bad_xml"
+	CodeInvalidReport     = "invalid_report"
+	CodeEmptyReport       = "empty_report"
+	CodeBadReport         = "bad_report"
+	CodeNotFound          = "not_found"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeRateLimited       = "rate_limited"
+	CodeTooBusy           = "too_busy"
+	CodeStore             = "store_failed"
+	CodeAnalyze           = "analyze_failed"
+	CodeInternal          = "internal"
+	CodePanic             = "panic"
+)
+
+// codeStatus is the HTTP status returned for every code
+var codeStatus = map[string]int{
+	CodeBadRequest:        http.StatusBadRequest,
+	CodeMissingFile:       http.StatusBadRequest,
+	CodeTooLarge:          http.StatusRequestEntityTooLarge,
+	CodeUnsupportedType:   http.StatusUnsupportedMediaType,
+	CodeQueueFull:         http.StatusServiceUnavailable,
+	CodeUnsupportedFormat: http.StatusUnsupportedMediaType,
+	CodeBadArchive:        http.StatusUnprocessableEntity,
+	CodeLimitExceeded:     http.StatusRequestEntityTooLarge,
+	CodeUnsafeArchive:     http.StatusUnprocessableEntity,
+	CodeNoReport:          http.StatusUnprocessableEntity,
+	CodeBadXML:            http.StatusUnprocessableEntity,
+	CodeInvalidReport:     http.StatusUnprocessableEntity,
+	CodeEmptyReport:       http.StatusUnprocessableEntity,
+	CodeBadReport:         http.StatusUnprocessableEntity,
+	CodeNotFound:          http.StatusNotFound,
+	CodeUnauthorized:      http.StatusUnauthorized,
+	CodeForbidden:         http.StatusForbidden,
+	CodeRateLimited:       http.StatusTooManyRequests,
+	CodeTooBusy:           http.StatusTooManyRequests,
+	CodeStore:             http.StatusInternalServerError,
+	CodeAnalyze:           http.StatusInternalServerError,
+	CodeInternal:          http.StatusInternalServerError,
+	CodePanic:             http.StatusInternalServerError,
+}
+
+// Failure describes why something could not be processed
+type Failure struct {
+	Stage   string `json:"stage"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+}
+
+// HTTPStatus is the status code matching the failure
+func (f Failure) HTTPStatus() int {
+	if st, ok := codeStatus[f.Code]; ok {
+		return st
+	}
+	return http.StatusInternalServerError
+}
+
+// errorBody is what every endpoint answers on error
+type errorBody struct {
+	Status string `json:"status"`
+	Failure
+}
+
+// StageError ties an error to the stage and code it failed with
+type StageError struct {
+	Stage string
+	Code  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+// Cause is for github.com/pkg/errors
+func (e *StageError) Cause() error {
+	return e.Err
+}
+
+// stageError wraps err, keeping any stage it already has
+func stageError(stage, code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := asStageError(err); ok {
+		return err
+	}
+	return &StageError{Stage: stage, Code: code, Err: err}
+}
+
+// asStageError looks for a StageError through the wrapped errors
+func asStageError(err error) (*StageError, bool) {
+	type causer interface {
+		Cause() error
+	}
+
+	for err != nil {
+		if se, ok := err.(*StageError); ok {
+			return se, true
+		}
+		c, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
+
+// uploadError classifies errors from receiving an upload
+func uploadError(err error) error {
+	cause := errors.Cause(err)
+	switch {
+	case cause == ErrQueueFull:
+		return stageError(StageUpload, CodeQueueFull, err)
+	case cause == http.ErrMissingFile:
+		return stageError(StageUpload, CodeMissingFile, err)
+	case cause == http.ErrNotMultipart, cause == multipart.ErrMessageTooLarge:
+		return stageError(StageUpload, CodeBadRequest, err)
+	case isTooLarge(cause):
+		return stageError(StageUpload, CodeTooLarge, err)
+	}
+	return stageError(StageUpload, CodeInternal, err)
+}
+
+// parseError classifies errors from decoding and validating a report,
+// which can also come from decompressing it on the fly
+func parseError(err error) error {
+	switch errors.Cause(err).(type) {
+	case *report.ValidationError:
+		return stageError(StageParse, CodeInvalidReport, err)
+	case *LimitError:
+		return decompressError(err)
+	}
+	return stageError(StageParse, CodeBadXML, err)
+}
+
+// analyzeError classifies errors from rendering an analysis
+func analyzeError(err error) error {
+	if errors.Cause(err) == analyze.ErrEmptyReport {
+		return stageError(StageParse, CodeEmptyReport, err)
+	}
+	return stageError(StageAnalyze, CodeAnalyze, err)
+}
+
+// decompressError classifies errors from going through an upload
+func decompressError(err error) error {
+	switch errors.Cause(err) {
+	case ErrUnknownFormat:
+		return stageError(StageDecompress, CodeUnsupportedFormat, err)
+	case ErrNoReport:
+		return stageError(StageDecompress, CodeNoReport, err)
+	case ErrUnsafeEntry:
+		return stageError(StageDecompress, CodeUnsafeArchive, err)
+	}
+	if _, ok := errors.Cause(err).(*LimitError); ok {
+		return stageError(StageDecompress, CodeLimitExceeded, err)
+	}
+	return stageError(StageDecompress, CodeBadArchive, err)
+}
+
+// failureOf describes err, anything unclassified is an internal error
+func failureOf(err error) Failure {
+	if se, ok := asStageError(err); ok {
+		return Failure{Stage: se.Stage, Code: se.Code, Message: se.Err.Error()}
+	}
+	return Failure{Stage: StageAnalyze, Code: CodeInternal, Message: err.Error()}
+}
+
+// writeFailure answers with f and the matching status
+func writeFailure(w http.ResponseWriter, f Failure) {
+	writeJSON(w, f.HTTPStatus(), errorBody{Status: "failed", Failure: f})
+}
+
+// writeError answers with the failure described by err, logging it with
+// the request
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	f := failureOf(err)
+	l := logFrom(r.Context())
+	if f.HTTPStatus() >= http.StatusInternalServerError {
+		l.Error("request failed", "stage", f.Stage, "code", f.Code, "error", err)
+	} else {
+		l.Info("request rejected", "stage", f.Stage, "code", f.Code, "error", err)
+	}
+	writeFailure(w, f)
+}
+
+// recoverPanics turns a panic in a handler into a 500 instead of killing
+// the server.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logFrom(r.Context()).Error("panic", "method", r.Method, "path", r.URL.Path,
+					"error", fmt.Sprint(v), "stack", string(rdebug.Stack()))
+				writeFailure(w, Failure{Stage: StageRequest, Code: CodePanic, Message: "internal error"})
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
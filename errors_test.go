@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureOf(t *testing.T) {
+	td := []struct {
+		err    error
+		stage  string
+		code   string
+		status int
+	}{
+		{uploadError(http.ErrMissingFile), StageUpload, CodeMissingFile, http.StatusBadRequest},
+		{uploadError(errors.Wrap(ErrQueueFull, "submit")), StageUpload, CodeQueueFull, http.StatusServiceUnavailable},
+		{uploadError(errors.New("http: request body too large")), StageUpload, CodeTooLarge, http.StatusRequestEntityTooLarge},
+		{decompressError(errors.Wrap(ErrUnknownFormat, "foo")), StageDecompress, CodeUnsupportedFormat, http.StatusUnsupportedMediaType},
+		{decompressError(ErrNoReport), StageDecompress, CodeNoReport, http.StatusUnprocessableEntity},
+		{decompressError(errors.New("zip: not a valid zip file")), StageDecompress, CodeBadArchive, http.StatusUnprocessableEntity},
+		{decompressError(errors.Wrap(ErrUnsafeEntry, "link")), StageDecompress, CodeUnsafeArchive, http.StatusUnprocessableEntity},
+		{decompressError(&LimitError{Name: "foo", Limit: "entries", Max: 1}), StageDecompress, CodeLimitExceeded, http.StatusRequestEntityTooLarge},
+		{parseError(errors.Wrap(&LimitError{Name: "foo", Limit: "entry size", Max: 1}, "token")), StageDecompress, CodeLimitExceeded, http.StatusRequestEntityTooLarge},
+		{parseError(errors.New("XML syntax error")), StageParse, CodeBadXML, http.StatusUnprocessableEntity},
+		{parseError(errors.Wrap(&report.ValidationError{}, "validate")), StageParse, CodeInvalidReport, http.StatusUnprocessableEntity},
+		{analyzeError(analyze.ErrEmptyReport), StageParse, CodeEmptyReport, http.StatusUnprocessableEntity},
+		{analyzeError(errors.New("template")), StageAnalyze, CodeAnalyze, http.StatusInternalServerError},
+		{errors.New("anything"), StageAnalyze, CodeInternal, http.StatusInternalServerError},
+	}
+
+	for _, e := range td {
+		f := failureOf(e.err)
+		assert.Equal(t, e.stage, f.Stage, e.err.Error())
+		assert.Equal(t, e.code, f.Code, e.err.Error())
+		assert.Equal(t, e.status, f.HTTPStatus(), e.err.Error())
+	}
+}
+
+func TestStageError_Keep(t *testing.T) {
+	err := parseError(errors.New("foo"))
+	err = decompressError(errors.Wrap(err, "walk"))
+
+	f := failureOf(err)
+	assert.Equal(t, StageParse, f.Stage)
+	assert.Equal(t, "foo", f.Message)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), `"code": "panic"`))
+}
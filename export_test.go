@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReports_TSV(t *testing.T) {
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	ctx = withFormat(t, ctx, analyze.OutputTSV)
+	out, err := HandleReports(ctx, "reports.tar.gz", fh)
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+
+	txt, err := ctx.a.Join("", out)
+	require.NoError(t, err)
+
+	cr := csv.NewReader(strings.NewReader(txt))
+	cr.Comma = '\t'
+	lines, err := cr.ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, analyze.CSVHeader, lines[0])
+	assert.True(t, len(lines) > 2)
+	// Not resolved with NullResolver
+	assert.Equal(t, "source_name", lines[0][18])
+	assert.Empty(t, lines[1][18])
+}
+
+func TestListReports_CSV(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	_, err := reportStore.AddFeedback("", goodFeedback())
+	require.NoError(t, err)
+
+	resp, err := http.Get(ts.URL + "/api/v1/reports?format=csv")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	lines, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, lines, 1+len(goodFeedback().Records))
+
+	resp, err = http.Get(ts.URL + "/api/v1/reports?format=xls")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// Format is a content type detected from magic bytes
+type Format int
+
+// Formats we know about
+const (
+	FormatUnknown Format = iota
+	FormatXML
+	FormatGzip
+	FormatZip
+	FormatTar
+	FormatBzip2
+	FormatXz
+	FormatZstd
+)
+
+var formatNames = map[Format]string{
+	FormatUnknown: "unknown",
+	FormatXML:     "xml",
+	FormatGzip:    "gzip",
+	FormatZip:     "zip",
+	FormatTar:     "tar",
+	FormatBzip2:   "bzip2",
+	FormatXz:      "xz",
+	FormatZstd:    "zstd",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+const (
+	// sniffLen is how much we look at to guess the format, tar needs 262
+	sniffLen = 512
+	// ratioMinSize is the decompressed size below which the compression
+	// ratio is not checked, tiny files compress very well
+	ratioMinSize = 1 << 20
+)
+
+var (
+	// ErrUnknownFormat is returned for content we can not identify
+	ErrUnknownFormat = errors.New("unknown format")
+	// ErrNoReport is returned when nothing looking like a report was found
+	ErrNoReport = errors.New("no report found")
+	// ErrUnsafeEntry is returned for links and paths escaping the archive
+	ErrUnsafeEntry = errors.New("unsafe archive entry")
+)
+
+// ExtractLimits protects against archive and compression bombs
+type ExtractLimits struct {
+	// MaxEntries is the number of archive entries and reports in an upload
+	MaxEntries int
+	// MaxEntrySize is the decompressed size of one entry or report
+	MaxEntrySize int64
+	// MaxTotalSize is the decompressed size of all reports of an upload
+	MaxTotalSize int64
+	// MaxRatio is the maximum decompressed/compressed ratio of every layer
+	MaxRatio int64
+	// MaxDepth is how many compression/archive layers we go through
+	MaxDepth int
+}
+
+// DefaultLimits are the limits unless -max-* say otherwise
+var DefaultLimits = ExtractLimits{
+	MaxEntries:   1000,
+	MaxEntrySize: 256 << 20,
+	MaxTotalSize: 1 << 30,
+	MaxRatio:     200,
+	MaxDepth:     4,
+}
+
+var fExtract ExtractLimits
+
+func init() {
+	l, d := &fExtract, DefaultLimits
+
+	flag.IntVar(&l.MaxEntries, "max-entries", d.MaxEntries, "Maximum number of files in an upload")
+	flag.Int64Var(&l.MaxEntrySize, "max-entry-size", d.MaxEntrySize, "Maximum decompressed size of one file")
+	flag.Int64Var(&l.MaxTotalSize, "max-total-size", d.MaxTotalSize, "Maximum decompressed size of an upload")
+	flag.Int64Var(&l.MaxRatio, "max-ratio", d.MaxRatio, "Maximum compression ratio")
+	flag.IntVar(&l.MaxDepth, "max-depth", d.MaxDepth, "Maximum nesting of archives and compression")
+}
+
+// LimitError is returned when an upload goes over one of the limits
+type LimitError struct {
+	Name  string
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s limit of %d exceeded", e.Name, e.Limit, e.Max)
+}
+
+// Sniff guesses the format of head, the beginning of some content
+func Sniff(head []byte) Format {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return FormatZip
+	case bytes.HasPrefix(head, []byte("BZh")):
+		return FormatBzip2
+	case bytes.HasPrefix(head, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatXz
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return FormatTar
+	}
+
+	// Skip UTF-8 BOM and leading whitespace
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) > 0 && head[0] == '<' {
+		return FormatXML
+	}
+	return FormatUnknown
+}
+
+// ReportFunc is called for every XML document found in an upload
+type ReportFunc func(name string, r io.Reader) error
+
+// WalkReports looks through every compression layer and archive in r,
+// identified by content and not by file name, and calls fn for every XML
+// document found.  Everything happens in memory but zip archives, which
+// are spooled to a temporary file, and lim applies.  Skipped entries are
+// logged to l, the default logger if nil.
+func WalkReports(l *Logger, name string, r io.Reader, lim ExtractLimits, fn ReportFunc) error {
+	w := &walker{log: l, lim: lim, fn: fn}
+
+	n, err := w.walk(name, r, 0, false)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoReport
+	}
+	return nil
+}
+
+// walker keeps the counters of one upload
+type walker struct {
+	log     *Logger
+	lim     ExtractLimits
+	fn      ReportFunc
+	entries int
+	total   int64
+}
+
+// entry counts one more entry
+func (w *walker) entry(name string) error {
+	w.entries++
+	if w.lim.MaxEntries > 0 && w.entries > w.lim.MaxEntries {
+		return &LimitError{Name: name, Limit: "entries", Max: int64(w.lim.MaxEntries)}
+	}
+	return nil
+}
+
+// walk returns the number of reports found, counted is set for archive
+// entries already counted by check.
+func (w *walker) walk(name string, r io.Reader, depth int, counted bool) (int, error) {
+	if w.lim.MaxDepth > 0 && depth > w.lim.MaxDepth {
+		return 0, &LimitError{Name: name, Limit: "nesting depth", Max: int64(w.lim.MaxDepth)}
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, errors.Wrapf(err, "%s: read", name)
+	}
+
+	format := Sniff(head)
+	w.log.Debug("sniffed", "file", name, "format", format.String(), "depth", depth)
+	if depth == 0 {
+		uploads.Inc(format.String())
+	}
+
+	// Compressed input for the ratio check
+	in := &countReader{r: br}
+
+	switch format {
+	case FormatXML:
+		if !counted {
+			if err := w.entry(name); err != nil {
+				return 0, err
+			}
+		}
+		return 1, w.fn(name, w.report(name, br))
+
+	case FormatGzip:
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: gzip", name)
+		}
+		defer gz.Close()
+		return w.walk(trimExt(name), w.ratio(name, gz, in), depth+1, counted)
+
+	case FormatBzip2:
+		return w.walk(trimExt(name), w.ratio(name, bzip2.NewReader(in), in), depth+1, counted)
+
+	case FormatXz:
+		xr, err := xz.NewReader(in)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: xz", name)
+		}
+		return w.walk(trimExt(name), w.ratio(name, xr, in), depth+1, counted)
+
+	case FormatZstd:
+		zr, err := zstd.NewReader(in)
+		if err != nil {
+			return 0, errors.Wrapf(err, "%s: zstd", name)
+		}
+		defer zr.Close()
+		return w.walk(trimExt(name), w.ratio(name, zr, in), depth+1, counted)
+
+	case FormatTar:
+		return w.walkTar(name, br, depth)
+
+	case FormatZip:
+		return w.walkZip(name, br, depth)
+	}
+	return 0, errors.Wrap(ErrUnknownFormat, name)
+}
+
+// walkTar goes through every regular file in a tar archive
+func (w *walker) walkTar(name string, r io.Reader, depth int) (int, error) {
+	found := 0
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return found, errors.Wrapf(err, "%s: tar", name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeSymlink, tar.TypeLink:
+			return found, errors.Wrapf(ErrUnsafeEntry, "%s: link %s -> %s", name, hdr.Name, hdr.Linkname)
+		default:
+			w.log.Verbose("skipping entry", "archive", name, "entry", hdr.Name, "type", string(hdr.Typeflag))
+			continue
+		}
+
+		if err := w.check(name, hdr.Name, hdr.Size); err != nil {
+			return found, err
+		}
+
+		n, err := w.walk(hdr.Name, tr, depth+1, true)
+		if errors.Cause(err) == ErrUnknownFormat {
+			w.log.Verbose("skipping entry", "archive", name, "entry", hdr.Name)
+			continue
+		}
+		if err != nil {
+			return found, err
+		}
+		found += n
+	}
+}
+
+// walkZip goes through every file in a zip archive, which needs random
+// access so it is spooled to a temporary file.
+func (w *walker) walkZip(name string, r io.Reader, depth int) (int, error) {
+	found := 0
+
+	tmp, err := ioutil.TempFile("", "dmarc-zip-")
+	if err != nil {
+		return 0, errors.Wrap(err, "TempFile")
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	size, err := io.Copy(tmp, w.limit(name, r, "total size", w.lim.MaxTotalSize))
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s: read", name)
+	}
+
+	// The compressed bytes read for every entry are counted
+	ra := &countReaderAt{r: tmp, in: &countReader{}}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s: zip", name)
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			return found, errors.Wrapf(ErrUnsafeEntry, "%s: link %s", name, f.Name)
+		}
+		if err := w.check(name, f.Name, int64(f.UncompressedSize64)); err != nil {
+			return found, err
+		}
+
+		off, err := f.DataOffset()
+		if err != nil {
+			return found, errors.Wrapf(err, "%s: open %s", name, f.Name)
+		}
+		if f.CompressedSize64 > uint64(size-off) {
+			return found, errors.Wrapf(ErrUnsafeEntry, "%s: %s is larger than the archive", name, f.Name)
+		}
+
+		// The sizes in the header can not be trusted
+		in := &countReader{}
+		ra.in = in
+		rc, err := f.Open()
+		if err != nil {
+			return found, errors.Wrapf(err, "%s: open %s", name, f.Name)
+		}
+
+		n, err := w.walk(f.Name, w.ratio(f.Name, rc, in), depth+1, true)
+		rc.Close()
+		if errors.Cause(err) == ErrUnknownFormat {
+			w.log.Verbose("skipping entry", "archive", name, "entry", f.Name)
+			continue
+		}
+		if err != nil {
+			return found, err
+		}
+		found += n
+	}
+	return found, nil
+}
+
+// check looks at an archive entry before reading it
+func (w *walker) check(archive, name string, size int64) error {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return errors.Wrapf(ErrUnsafeEntry, "%s: absolute path %s", archive, name)
+	}
+	for _, p := range strings.Split(filepath.ToSlash(name), "/") {
+		if p == ".." {
+			return errors.Wrapf(ErrUnsafeEntry, "%s: path %s escapes the archive", archive, name)
+		}
+	}
+	if err := w.entry(name); err != nil {
+		return err
+	}
+	if w.lim.MaxEntrySize > 0 && size > w.lim.MaxEntrySize {
+		return &LimitError{Name: name, Limit: "entry size", Max: w.lim.MaxEntrySize}
+	}
+	return nil
+}
+
+// report limits the size of one report and of all of them
+func (w *walker) report(name string, r io.Reader) io.Reader {
+	return &limitReader{r: r, name: name, w: w}
+}
+
+// ratio checks r, decompressed from in, does not grow too fast
+func (w *walker) ratio(name string, r io.Reader, in *countReader) io.Reader {
+	return &ratioReader{r: r, in: in, name: name, max: w.lim.MaxRatio}
+}
+
+// limit fails reading r past max bytes
+func (w *walker) limit(name string, r io.Reader, what string, max int64) io.Reader {
+	return &limitReader{r: r, name: name, what: what, max: max}
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countReaderAt counts the bytes read through it in the countReader of
+// the zip entry being read
+type countReaderAt struct {
+	r  io.ReaderAt
+	in *countReader
+}
+
+func (c *countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.in.n += int64(n)
+	return n, err
+}
+
+// ratioReader fails once more than max times the compressed input has
+// been produced
+type ratioReader struct {
+	r    io.Reader
+	in   *countReader
+	name string
+	max  int64
+	n    int64
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if rr.max > 0 && rr.n > ratioMinSize && rr.n > rr.max*rr.in.n {
+		return n, &LimitError{Name: rr.name, Limit: "compression ratio", Max: rr.max}
+	}
+	return n, err
+}
+
+// limitReader fails past max bytes, or for reports past the entry size
+// and the total size of the walker
+type limitReader struct {
+	r    io.Reader
+	name string
+	what string
+	max  int64
+	n    int64
+	w    *walker
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+
+	if lr.w == nil {
+		if lr.max > 0 && lr.n > lr.max {
+			return n, &LimitError{Name: lr.name, Limit: lr.what, Max: lr.max}
+		}
+		return n, err
+	}
+
+	lim := lr.w.lim
+	lr.w.total += int64(n)
+	if lim.MaxEntrySize > 0 && lr.n > lim.MaxEntrySize {
+		return n, &LimitError{Name: lr.name, Limit: "entry size", Max: lim.MaxEntrySize}
+	}
+	if lim.MaxTotalSize > 0 && lr.w.total > lim.MaxTotalSize {
+		return n, &LimitError{Name: lr.name, Limit: "total size", Max: lim.MaxTotalSize}
+	}
+	return n, err
+}
+
+// trimExt removes the compression suffix from a file name
+func trimExt(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz", ".tgz", ".bz2", ".xz", ".zst":
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
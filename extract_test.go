@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniff(t *testing.T) {
+	td := []struct {
+		File string
+		Out  Format
+	}{
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml", FormatXML},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.gz", FormatGzip},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.bz2", FormatBzip2},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.xz", FormatXz},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.zst", FormatZstd},
+		{"testdata/google.com!keltia.net!1538438400!1538524799.zip", FormatZip},
+		{"testdata/mislabeled.zip", FormatXz},
+		{"testdata/notempty.txt", FormatUnknown},
+		{"testdata/empty.txt", FormatUnknown},
+	}
+	for _, e := range td {
+		body, err := ioutil.ReadFile(e.File)
+		require.NoError(t, err)
+		if len(body) > sniffLen {
+			body = body[:sniffLen]
+		}
+		assert.Equal(t, e.Out, Sniff(body), e.File)
+	}
+}
+
+func TestSniff_Tar(t *testing.T) {
+	head := make([]byte, sniffLen)
+	copy(head[257:], "ustar")
+	assert.Equal(t, FormatTar, Sniff(head))
+}
+
+func TestSniff_BOM(t *testing.T) {
+	assert.Equal(t, FormatXML, Sniff([]byte("\xef\xbb\xbf\n  <?xml version=\"1.0\"?>")))
+}
+
+func collect(t *testing.T, file string) ([]string, error) {
+	var names []string
+
+	fh, err := os.Open(file)
+	require.NoError(t, err)
+	defer fh.Close()
+
+	err = WalkReports(nil, file, fh, DefaultLimits, func(name string, r io.Reader) error {
+		body, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.True(t, bytes.Contains(body, []byte("<feedback>")), name)
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+func TestWalkReports(t *testing.T) {
+	td := []struct {
+		File string
+		N    int
+	}{
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml", 1},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.gz", 1},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.bz2", 1},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.xz", 1},
+		{"testdata/example.com!keltia.net!1538604008!1538690408.xml.zst", 1},
+		{"testdata/google.com!keltia.net!1538438400!1538524799.zip", 1},
+		{"testdata/mislabeled.zip", 1},
+		{"testdata/reports.tar.gz", 2},
+	}
+	for _, e := range td {
+		names, err := collect(t, e.File)
+		assert.NoError(t, err, e.File)
+		assert.Len(t, names, e.N, e.File)
+	}
+}
+
+func TestWalkReports_Names(t *testing.T) {
+	names, err := collect(t, "testdata/example.com!keltia.net!1538604008!1538690408.xml.zst")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"testdata/example.com!keltia.net!1538604008!1538690408.xml"}, names)
+}
+
+func TestWalkReports_Bad(t *testing.T) {
+	for _, file := range []string{"testdata/notempty.txt", "testdata/empty.txt", "testdata/bad.xml"} {
+		_, err := collect(t, file)
+		assert.Error(t, err, file)
+	}
+}
+
+func TestWalkReports_NoReport(t *testing.T) {
+	_, err := collect(t, "testdata/notempty.zip")
+	assert.Equal(t, ErrNoReport, err)
+
+	_, err = collect(t, "testdata/notempty.txt.gz")
+	assert.Error(t, err)
+}
+
+// testLimits are small enough to be hit by the test data
+var testLimits = ExtractLimits{MaxEntries: 10, MaxEntrySize: 1 << 30, MaxTotalSize: 1 << 30, MaxRatio: 100, MaxDepth: 4}
+
+// readAll reads every report and returns the first error
+func readAll(name string, r io.Reader, lim ExtractLimits) error {
+	return WalkReports(nil, name, r, lim, func(name string, r io.Reader) error {
+		_, err := ioutil.ReadAll(r)
+		return err
+	})
+}
+
+type tarEntry struct {
+	Name string
+	Type byte
+	Body []byte
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Typeflag: e.Type, Mode: 0644, Size: int64(len(e.Body))}
+		if e.Type != tar.TypeReg {
+			hdr.Size = 0
+			hdr.Linkname = "/etc/passwd"
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if e.Type == tar.TypeReg {
+			_, err := tw.Write(e.Body)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, body []byte) []byte {
+	var buf bytes.Buffer
+
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// limitOf returns the limit hit by err
+func limitOf(err error) string {
+	if le, ok := errors.Cause(err).(*LimitError); ok {
+		return le.Limit
+	}
+	return ""
+}
+
+func TestWalkReports_Ratio(t *testing.T) {
+	// Looks like XML and compresses a lot
+	bomb := gzipped(t, append([]byte("<feedback>"), make([]byte, 10<<20)...))
+
+	err := readAll("bomb.xml.gz", bytes.NewReader(bomb), testLimits)
+	assert.Equal(t, "compression ratio", limitOf(err))
+
+	lim := testLimits
+	lim.MaxRatio = 0
+	assert.NoError(t, readAll("bomb.xml.gz", bytes.NewReader(bomb), lim))
+}
+
+// forgeZip sets the compressed size of the first file in the central
+// directory of body to size
+func forgeZip(body []byte, size uint32) {
+	i := bytes.Index(body, []byte("PK\x01\x02"))
+	binary.LittleEndian.PutUint32(body[i+20:], size)
+}
+
+func TestWalkReports_ZipRatio(t *testing.T) {
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("bomb.xml")
+	require.NoError(t, err)
+	w.Write(append([]byte("<feedback>"), make([]byte, 10<<20)...))
+
+	// Incompressible padding for the forged size to fit in the archive
+	pad := make([]byte, 100<<10)
+	rand.New(rand.NewSource(1)).Read(pad)
+	w, err = zw.CreateHeader(&zip.FileHeader{Name: "pad.bin", Method: zip.Store})
+	require.NoError(t, err)
+	w.Write(pad)
+	require.NoError(t, zw.Close())
+
+	body := buf.Bytes()
+	forgeZip(body, 90<<10)
+	err = readAll("bomb.zip", bytes.NewReader(body), testLimits)
+	assert.Equal(t, "compression ratio", limitOf(err))
+
+	forgeZip(body, uint32(len(body)))
+	err = readAll("bomb.zip", bytes.NewReader(body), testLimits)
+	assert.Equal(t, ErrUnsafeEntry, errors.Cause(err))
+}
+
+func TestWalkReports_Limits(t *testing.T) {
+	xml, err := ioutil.ReadFile("testdata/example.com!keltia.net!1538604008!1538690408.xml")
+	require.NoError(t, err)
+
+	three := makeTar(t,
+		tarEntry{"a.xml", tar.TypeReg, xml},
+		tarEntry{"b.xml", tar.TypeReg, xml},
+		tarEntry{"c.xml", tar.TypeReg, xml})
+
+	lim := testLimits
+	lim.MaxEntries = 2
+	err = readAll("three.tar", bytes.NewReader(three), lim)
+	assert.Equal(t, "entries", limitOf(err))
+
+	// Every report is one entry
+	lim.MaxEntries = 3
+	assert.NoError(t, readAll("three.tar", bytes.NewReader(three), lim))
+
+	// Size declared in the tar header
+	lim = testLimits
+	lim.MaxEntrySize = 100
+	err = readAll("three.tar", bytes.NewReader(three), lim)
+	assert.Equal(t, "entry size", limitOf(err))
+
+	// Actual size of a plain report
+	err = readAll("a.xml", bytes.NewReader(xml), lim)
+	assert.Equal(t, "entry size", limitOf(err))
+
+	lim = testLimits
+	lim.MaxTotalSize = int64(len(xml)) * 2
+	err = readAll("three.tar", bytes.NewReader(three), lim)
+	assert.Equal(t, "total size", limitOf(err))
+
+	// Four layers of gzip
+	nested := xml
+	for i := 0; i < 4; i++ {
+		nested = gzipped(t, nested)
+	}
+	lim = testLimits
+	lim.MaxDepth = 3
+	err = readAll("nested.xml.gz", bytes.NewReader(nested), lim)
+	assert.Equal(t, "nesting depth", limitOf(err))
+
+	lim.MaxDepth = 4
+	assert.NoError(t, readAll("nested.xml.gz", bytes.NewReader(nested), lim))
+}
+
+func TestWalkReports_Unsafe(t *testing.T) {
+	xml := []byte("<feedback></feedback>")
+
+	td := [][]byte{
+		makeTar(t, tarEntry{"link.xml", tar.TypeSymlink, nil}),
+		makeTar(t, tarEntry{"hard.xml", tar.TypeLink, nil}),
+		makeTar(t, tarEntry{"../../etc/evil.xml", tar.TypeReg, xml}),
+		makeTar(t, tarEntry{"/etc/evil.xml", tar.TypeReg, xml}),
+	}
+	for _, body := range td {
+		err := readAll("evil.tar", bytes.NewReader(body), testLimits)
+		assert.Equal(t, ErrUnsafeEntry, errors.Cause(err))
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: "link.xml"}
+	fh.SetMode(os.ModeSymlink | 0777)
+	w, err := zw.CreateHeader(fh)
+	require.NoError(t, err)
+	w.Write([]byte("/etc/passwd"))
+	require.NoError(t, zw.Close())
+
+	err = readAll("evil.zip", &buf, testLimits)
+	assert.Equal(t, ErrUnsafeEntry, errors.Cause(err))
+}
+
+func TestHandleReports(t *testing.T) {
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	out, err := HandleReports(withFormat(t, ctx, analyze.OutputText), "reports.tar.gz", fh)
+	require.NoError(t, err)
+	assert.Len(t, out, 2)
+}
+
+func TestTrimExt(t *testing.T) {
+	assert.Equal(t, "foo.xml", trimExt("foo.xml.gz"))
+	assert.Equal(t, "foo.xml", trimExt("foo.xml.zst"))
+	assert.Equal(t, "foo.zip", trimExt("foo.zip"))
+}
@@ -2,18 +2,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/xml"
 	"io"
-	"io/ioutil"
 	"path/filepath"
 	"regexp"
 
-	"github.com/keltia/archive"
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
 	"github.com/pkg/errors"
 )
 
 const (
-	reFileName = `^([\w\.]+)!([\w\.]+)!([\d]+)!([\d]+)*(\.(gz|zip|xml))*$`
+	reFileName = `^([\w\.]+)!([\w\.]+)!([\d]+)!([\d]+)*(\.(gz|zip|xml|tar|tgz|bz2|xz|zst))*$`
 )
 
 var reFN *regexp.Regexp
@@ -27,115 +26,128 @@ func checkFilename(file string) (ok bool) {
 	return reFN.MatchString(base)
 }
 
-// HandleZipFile is here for zip files because archive.NewFromReader() does not work here
-func HandleZipFile(ctx *Context, file string) (string, error) {
-	debug("HandleZipFile")
-
-	var body []byte
-
-	a, err := archive.New(file)
-	if err == nil {
+// warnViolations logs the violations of a report kept in lenient mode
+func warnViolations(l *Logger, id string, list []report.Violation) {
+	for _, vi := range list {
+		l.Warn("invalid report", "report_id", id, "violation", vi)
+	}
+}
 
-		body, err = a.Extract(".xml")
-		if err != nil {
-			return "", errors.Wrap(err, "extract")
-		}
-	} else {
-		// Got plain text (i.e. xml)
-		if body, err = ioutil.ReadFile(file); err != nil {
-			return "", errors.Wrap(err, "ReadFile")
+// streamReport decodes one XML report and hands the records kept by the
+// filter of ctx to fn as they come, see analyze.Analyzer.StreamRecords.
+// With the Store option, every record is stored as well, one at a time,
+// and the report is attributed to the tenant owning its domain; if owner
+// is set, that tenant must be the same.
+func streamReport(ctx *Context, in io.Reader, owner string, fn analyze.RecordFunc) (report.Feedback, error) {
+	var (
+		fw     FeedbackWriter
+		tally  reportTally
+		tenant string
+		n      int
+	)
+
+	o := ctx.opts
+	if o.Store != nil {
+		var err error
+		if fw, err = o.Store.NewFeedback(); err != nil {
+			return report.Feedback{}, stageError(StageAnalyze, CodeStore, errors.Wrap(err, "store"))
 		}
+		defer fw.Abort()
 	}
 
-	debug("xml=%s", string(body))
-
-	var report Feedback
+	r, list, err := ctx.a.StreamRecords(in, func(hdr *report.Feedback, rec report.Record, row analyze.Entry) error {
+		n++
+		if fw != nil {
+			// Reports for another tenant are refused before going further
+			if n == 1 {
+				var err error
+				if tenant, err = o.Tenants.attribute(hdr.Policy.Domain, owner); err != nil {
+					return err
+				}
+			}
+			if err := fw.Add(rec); err != nil {
+				return stageError(StageAnalyze, CodeStore, errors.Wrap(err, "store"))
+			}
+			tally.add(rec)
+		}
 
-	if err := xml.Unmarshal(body, &report); err != nil {
-		return "", errors.Wrap(err, "unmarshall")
+		if !o.Filter.Match(rec) {
+			return nil
+		}
+		return analyzeError(fn(hdr, rec, row))
+	})
+	if err != nil {
+		return r, parseError(err)
 	}
+	l := ctx.logger()
+	l.Debug("decoded report", "report_id", r.Metadata.ReportID, "content", l.reportContent(r))
+	l.Verbose("streamed and resolved records", "report_id", r.Metadata.ReportID, "records", n)
+	warnViolations(ctx.logger(), r.Metadata.ReportID, list)
 
-	debug("report=%v\n", report)
-
-	return Analyze(ctx, report)
-}
-
-// HandleSingleFile creates a tempdir and dispatch csv/zip files to handler.
-func HandleSingleFile(ctx *Context, r io.ReadCloser, typ int) (string, error) {
-	debug("HandleSingleFile")
-
-	var body []byte
-
-	debug("typ=%d", typ)
-	if typ == archive.ArchiveZip {
-		return "", errors.New("unsupported")
+	if fw == nil {
+		return r, nil
 	}
-
-	a, err := archive.NewFromReader(r, typ)
-	if err == nil {
-
-		debug("a=%#v", a)
-		body, err = a.Extract("")
-		if err != nil {
-			return "", errors.Wrap(err, "extract")
-		}
-	} else {
-		// Got plain text (i.e. xml)
-		buf := bytes.NewBuffer(body)
-		_, err := io.Copy(buf, r)
-		if err != nil {
-			return "", errors.Wrap(err, "copy")
+	if n == 0 {
+		if tenant, err = o.Tenants.attribute(r.Policy.Domain, owner); err != nil {
+			return r, err
 		}
 	}
-	debug("xml=%#v", body)
 
-	var report Feedback
-
-	if err := xml.Unmarshal(body, &report); err != nil {
-		return "", errors.Wrap(err, "unmarshall")
+	id, err := fw.Commit(tenant, r)
+	switch err {
+	case nil:
+		ctx.logger().Info("stored report", "report_id", r.Metadata.ReportID, "id", id, "tenant", tenant)
+		countReport(o.Tenants, r.Policy.Domain, tally)
+	case ErrDuplicate:
+		// Sent again or ingested from a message that failed before
+		ctx.logger().Verbose("report already stored", "report_id", r.Metadata.ReportID, "id", id, "tenant", tenant)
+	default:
+		return r, stageError(StageAnalyze, CodeStore, errors.Wrap(err, "store"))
 	}
+	return r, nil
+}
 
-	debug("report=%v\n", report)
+// processReport streams one XML report and renders it, see streamReport.
+// JSON, CSV and TSV are rendered record by record, see
+// analyze.Analyzer.NewReportWriter.  Reports without any record left by
+// the filter are empty.
+func processReport(ctx *Context, in io.Reader, owner string) (string, error) {
+	var buf bytes.Buffer
+
+	rw := ctx.a.NewReportWriter(&buf)
+	r, err := streamReport(ctx, in, owner, rw.Write)
+	if err != nil {
+		return "", err
+	}
 
-	return Analyze(ctx, report)
+	err = rw.Close(r)
+	if errors.Cause(err) == analyze.ErrEmptyReport && ctx.opts.Filter.Active() {
+		return "", nil
+	}
+	if err != nil {
+		return "", analyzeError(err)
+	}
+	return buf.String(), nil
 }
 
-// HandleSingleFile creates a tempdir and dispatch csv/zip files to handler.
-func HandleSingleFileJSON(ctx *Context, r io.ReadCloser, typ int) (string, error) {
-	debug("HandleSingleFile")
-
-	var body []byte
+// HandleReports finds every report in r, whatever the compression or
+// archive format, and returns the output for each of them.
+func HandleReports(ctx *Context, name string, r io.Reader) ([]string, error) {
+	var out []string
 
-	debug("typ=%d", typ)
-	if typ == archive.ArchiveZip {
-		return "", errors.New("unsupported")
-	}
+	ctx.logger().Debug("HandleReports", "file", name)
 
-	a, err := archive.NewFromReader(r, typ)
-	if err == nil {
+	err := WalkReports(ctx.logger(), name, r, ctx.opts.Limits, func(file string, in io.Reader) error {
+		ctx.logger().Verbose("analyzing", "file", file)
 
-		debug("a=%#v", a)
-		body, err = a.Extract("")
+		txt, err := processReport(ctx, in, "")
 		if err != nil {
-			return "", errors.Wrap(err, "extract")
+			return errors.Wrapf(err, "file %s", file)
 		}
-	} else {
-		// Got plain text (i.e. xml)
-		buf := bytes.NewBuffer(body)
-		_, err := io.Copy(buf, r)
-		if err != nil {
-			return "", errors.Wrap(err, "copy")
+		if txt != "" {
+			out = append(out, txt)
 		}
-	}
-	debug("xml=%#v", body)
-
-	var report Feedback
-
-	if err := xml.Unmarshal(body, &report); err != nil {
-		return "", errors.Wrap(err, "unmarshall")
-	}
-
-	debug("report=%v\n", report)
-
-	return AnalyzeJSON(ctx, report)
+		return nil
+	})
+	return out, err
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"io"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
+)
+
+var fFilter analyze.FilterConfig
+
+func init() {
+	f := &fFilter
+
+	flag.BoolVar(&f.OnlyFail, "only-fail", false, "Only display records failing DMARC")
+	flag.Var((*listFlag)(&f.Dispositions), "disposition", "Comma-separated dispositions to display: none, quarantine or reject")
+	flag.Var((*listFlag)(&f.SourceIPs), "source-ip", "Comma-separated CIDRs or IPs records must come from")
+	flag.Var((*listFlag)(&f.HeaderFrom), "header-from", "Comma-separated header From: domains to display, subdomains included")
+	flag.StringVar(&f.GroupBy, "group-by", "", "Sum records by ip, ptr, asn, header_from or reporter")
+
+}
+
+// HandleGroups sums the records of every report in r, see HandleReports,
+// and returns the groups.
+func HandleGroups(ctx *Context, name string, r io.Reader) (string, error) {
+	g := ctx.a.NewGrouper(ctx.opts.Filter.GroupBy())
+
+	err := WalkReports(ctx.logger(), name, r, ctx.opts.Limits, func(file string, in io.Reader) error {
+		ctx.logger().Verbose("analyzing", "file", file)
+
+		_, err := streamReport(ctx, in, "", g.AddRecord)
+		return errors.Wrapf(err, "file %s", file)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	txt, err := ctx.a.RenderGroups(g)
+	return txt, analyzeError(err)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReports_Filter(t *testing.T) {
+	f, err := analyze.NewFilter(analyze.FilterConfig{Dispositions: []string{"reject"}})
+	require.NoError(t, err)
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+	ctx.opts.Filter = f
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	// Nothing rejected, no output but no error either
+	out, err := HandleReports(withFormat(t, ctx, analyze.OutputCSV), "reports.tar.gz", fh)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestHandleGroups(t *testing.T) {
+	f, err := analyze.NewFilter(analyze.FilterConfig{GroupBy: analyze.GroupReporter})
+	require.NoError(t, err)
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+	ctx.opts.Filter = f
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	txt, err := HandleGroups(withFormat(t, ctx, analyze.OutputCSV), "reports.tar.gz", fh)
+	require.NoError(t, err)
+	lines, err := csv.NewReader(strings.NewReader(txt)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "group_by", lines[0][0])
+	assert.True(t, len(lines) > 1)
+}
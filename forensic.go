@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// ForensicReport is a single DMARC failure report (RUF) as sent in the
+// Abuse Reporting Format, see RFC 5965 and RFC 6591.
+type ForensicReport struct {
+	ID                string    `json:"id"`
+	Tenant            string    `json:"tenant,omitempty"`
+	FeedbackType      string    `json:"feedbackType"`
+	UserAgent         string    `json:"userAgent"`
+	Version           string    `json:"version"`
+	ReportingMTA      string    `json:"reportingMTA"`
+	OriginalMailFrom  string    `json:"originalMailFrom"`
+	OriginalRcptTo    string    `json:"originalRcptTo"`
+	ArrivalDate       time.Time `json:"arrivalDate"`
+	SourceIP          net.IP    `json:"sourceIP"`
+	ReportedDomain    string    `json:"reportedDomain"`
+	AuthFailure       string    `json:"authFailure"`
+	DeliveryResult    string    `json:"deliveryResult"`
+	DKIMDomain        string    `json:"dkimDomain"`
+	DKIMIdentity      string    `json:"dkimIdentity"`
+	DKIMSelector      string    `json:"dkimSelector"`
+	SPFDNS            string    `json:"spfDNS"`
+	IdentityAlignment string    `json:"identityAlignment"`
+	AuthResults       string    `json:"authenticationResults"`
+	HeaderFrom        string    `json:"headerFrom"`
+	Subject           string    `json:"subject"`
+	MessageID         string    `json:"messageID"`
+	Description       string    `json:"description"`
+	Headers           string    `json:"originalHeaders"`
+}
+
+// Correlation links a forensic report to an aggregate report row
+type Correlation struct {
+	ReportID string        `json:"reportID"`
+	OrgName  string        `json:"reportingOrg"`
+	Domain   string        `json:"reportedDomain"`
+	Begin    int64         `json:"reportStartDate"`
+	End      int64         `json:"reportEndDate"`
+	InRange  bool          `json:"arrivalInRange"`
+	Record   report.Record `json:"record"`
+}
+
+// HeaderFromDomain returns the RFC5322.From domain of the failed message,
+// falling back to the Reported-Domain field.
+func (fr *ForensicReport) HeaderFromDomain() string {
+	if fr.HeaderFrom != "" {
+		if i := strings.LastIndex(fr.HeaderFrom, "@"); i != -1 {
+			return strings.ToLower(fr.HeaderFrom[i+1:])
+		}
+		return strings.ToLower(fr.HeaderFrom)
+	}
+	return strings.ToLower(fr.ReportedDomain)
+}
+
+// ParseForensic reads a multipart/report message with a
+// message/feedback-report part and returns the decoded report.  What cannot
+// be decoded is logged to l, the default logger if nil.
+func ParseForensic(l *Logger, r io.Reader) (*ForensicReport, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadMessage")
+	}
+
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseMediaType")
+	}
+	if mt != "multipart/report" {
+		return nil, errors.Errorf("not a report: %s", mt)
+	}
+	if rt := params["report-type"]; !strings.EqualFold(rt, "feedback-report") {
+		return nil, errors.Errorf("unsupported report-type: %s", rt)
+	}
+
+	fr := &ForensicReport{}
+	found := false
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "NextPart")
+		}
+
+		body, err := ioutil.ReadAll(partReader(p))
+		if err != nil {
+			return nil, errors.Wrap(err, "read part")
+		}
+
+		pt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		l.Debug("forensic part", "type", pt)
+
+		switch pt {
+		case "text/plain":
+			if fr.Description == "" {
+				fr.Description = strings.TrimSpace(string(body))
+			}
+		case "message/feedback-report":
+			if err := fr.parseFeedbackReport(l, body); err != nil {
+				return nil, errors.Wrap(err, "feedback-report")
+			}
+			found = true
+		case "message/rfc822", "text/rfc822-headers":
+			fr.parseOriginal(l, body)
+		}
+	}
+
+	if !found {
+		return nil, errors.New("no message/feedback-report part")
+	}
+	return fr, nil
+}
+
+// partReader undoes any base64 transfer encoding, quoted-printable is
+// already handled by multipart.
+func partReader(p *multipart.Part) io.Reader {
+	if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+		return base64.NewDecoder(base64.StdEncoding, p)
+	}
+	return p
+}
+
+// parseFeedbackReport decodes the machine-readable part
+func (fr *ForensicReport) parseFeedbackReport(l *Logger, body []byte) error {
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(body), strings.NewReader("\r\n\r\n"))))
+	h, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	fr.FeedbackType = strings.ToLower(h.Get("Feedback-Type"))
+	fr.UserAgent = h.Get("User-Agent")
+	fr.Version = h.Get("Version")
+	fr.ReportingMTA = h.Get("Reporting-MTA")
+	fr.OriginalMailFrom = strings.Trim(h.Get("Original-Mail-From"), "<>")
+	fr.OriginalRcptTo = strings.Trim(h.Get("Original-Rcpt-To"), "<>")
+	fr.SourceIP = net.ParseIP(h.Get("Source-IP"))
+	fr.ReportedDomain = strings.ToLower(h.Get("Reported-Domain"))
+	fr.AuthFailure = strings.ToLower(h.Get("Auth-Failure"))
+	fr.DeliveryResult = strings.ToLower(h.Get("Delivery-Result"))
+	fr.DKIMDomain = h.Get("DKIM-Domain")
+	fr.DKIMIdentity = h.Get("DKIM-Identity")
+	fr.DKIMSelector = h.Get("DKIM-Selector")
+	fr.SPFDNS = h.Get("SPF-DNS")
+	fr.IdentityAlignment = h.Get("Identity-Alignment")
+	fr.AuthResults = h.Get("Authentication-Results")
+
+	if d := h.Get("Arrival-Date"); d != "" {
+		if t, err := mail.ParseDate(d); err == nil {
+			fr.ArrivalDate = t.UTC()
+		} else {
+			l.Verbose("bad Arrival-Date", "date", d, "error", err)
+		}
+	}
+
+	if fr.FeedbackType == "" {
+		return errors.New("missing Feedback-Type")
+	}
+	return nil
+}
+
+// parseOriginal extracts what we need from the original message headers
+func (fr *ForensicReport) parseOriginal(l *Logger, body []byte) {
+	// Only keep the headers, never the body of the original message
+	hdr := body
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i != -1 {
+		hdr = body[:i+2]
+	} else if i := bytes.Index(body, []byte("\n\n")); i != -1 {
+		hdr = body[:i+1]
+	}
+	fr.Headers = strings.TrimSpace(string(hdr))
+
+	msg, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(hdr), strings.NewReader("\r\n")))
+	if err != nil {
+		l.Verbose("bad original headers", "error", err)
+		return
+	}
+
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		fr.HeaderFrom = strings.ToLower(addr.Address)
+	} else {
+		fr.HeaderFrom = strings.ToLower(strings.Trim(msg.Header.Get("From"), "<> "))
+	}
+	fr.Subject = msg.Header.Get("Subject")
+	fr.MessageID = msg.Header.Get("Message-Id")
+}
+
+// Correlate finds aggregate rows matching the forensic report source IP
+// and header-from domain.
+func Correlate(s Store, fr *ForensicReport) ([]Correlation, error) {
+	var found []Correlation
+
+	if fr.SourceIP == nil {
+		return found, nil
+	}
+
+	reports, err := s.Feedbacks()
+	if err != nil {
+		return nil, errors.Wrap(err, "Feedbacks")
+	}
+
+	domain := fr.HeaderFromDomain()
+	for _, sf := range reports {
+		// Never leak data from another tenant
+		if fr.Tenant != "" && sf.Tenant != fr.Tenant {
+			continue
+		}
+
+		r := sf.Report
+		for _, rec := range r.Records {
+			if !rec.Row.SourceIP.Equal(fr.SourceIP) {
+				continue
+			}
+			if !strings.EqualFold(rec.Identifiers.HeaderFrom, domain) {
+				continue
+			}
+
+			c := Correlation{
+				ReportID: r.Metadata.ReportID,
+				OrgName:  r.Metadata.OrgName,
+				Domain:   r.Policy.Domain,
+				Begin:    r.Metadata.Date.Begin,
+				End:      r.Metadata.Date.End,
+				Record:   rec,
+			}
+			if !fr.ArrivalDate.IsZero() {
+				at := fr.ArrivalDate.Unix()
+				c.InRange = at >= r.Metadata.Date.Begin && at <= r.Metadata.Date.End
+			}
+			found = append(found, c)
+		}
+	}
+	return found, nil
+}
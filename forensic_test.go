@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForensic(t *testing.T) {
+	fh, err := os.Open("testdata/forensic.eml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	fr, err := ParseForensic(nil, fh)
+	require.NoError(t, err)
+
+	assert.Equal(t, "auth-failure", fr.FeedbackType)
+	assert.Equal(t, "bounce@example.org", fr.OriginalMailFrom)
+	assert.True(t, net.ParseIP("195.154.227.159").Equal(fr.SourceIP))
+	assert.Equal(t, "keltia.net", fr.ReportedDomain)
+	assert.Equal(t, "dmarc", fr.AuthFailure)
+	assert.Equal(t, "roberto@keltia.net", fr.HeaderFrom)
+	assert.Equal(t, "keltia.net", fr.HeaderFromDomain())
+	assert.Equal(t, "Hello there", fr.Subject)
+	assert.Equal(t, int64(1538514070), fr.ArrivalDate.Unix())
+	assert.Contains(t, fr.Description, "authentication failure report")
+}
+
+func TestParseForensic_NotReport(t *testing.T) {
+	msg := "From: a@example.net\r\nContent-Type: text/plain\r\n\r\nhello\r\n"
+
+	_, err := ParseForensic(nil, strings.NewReader(msg))
+	assert.Error(t, err)
+}
+
+func TestParseForensic_NoFeedback(t *testing.T) {
+	msg := "Content-Type: multipart/report; report-type=feedback-report; boundary=XX\r\n\r\n" +
+		"--XX\r\nContent-Type: text/plain\r\n\r\nhello\r\n--XX--\r\n"
+
+	_, err := ParseForensic(nil, strings.NewReader(msg))
+	assert.Error(t, err)
+}
+
+func TestParseForensic_Garbage(t *testing.T) {
+	_, err := ParseForensic(nil, strings.NewReader(""))
+	assert.Error(t, err)
+}
+
+func TestCorrelate(t *testing.T) {
+	s := NewMemStore()
+
+	fh, err := os.Open("testdata/google.com!keltia.net!1538438400!1538524799.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+	r, err := report.Parse(fh)
+	require.NoError(t, err)
+	_, err = s.AddFeedback("", r)
+	require.NoError(t, err)
+
+	fh, err = os.Open("testdata/forensic.eml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	fr, err := ParseForensic(nil, fh)
+	require.NoError(t, err)
+
+	corr, err := Correlate(s, fr)
+	require.NoError(t, err)
+	require.Len(t, corr, 1)
+	assert.Equal(t, "15591417298178277408", corr[0].ReportID)
+	assert.True(t, corr[0].InRange)
+
+	fr.SourceIP = net.ParseIP("192.0.2.1")
+	corr, err = Correlate(s, fr)
+	require.NoError(t, err)
+	assert.Empty(t, corr)
+}
@@ -4,9 +4,11 @@ require (
 	github.com/gorilla/mux v1.7.3
 	github.com/intel/tfortools v0.2.0
 	github.com/keltia/archive v0.7.0
+	github.com/klauspost/compress v1.11.13
 	github.com/pkg/errors v0.8.1
 	github.com/proglottis/gpgme v0.0.0-20190226023825-8e0937a489db // indirect
 	github.com/stretchr/testify v1.3.0
+	github.com/ulikunitz/xz v0.5.10
 )
 
 go 1.13
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	rdebug "runtime/debug"
+	"time"
+
+	"github.com/keltia/archive"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/pkg/errors"
+)
+
+// HealthConfig tunes the readiness checks
+type HealthConfig struct {
+	// DNSProbe is the address looked up to check the resolver
+	DNSProbe string
+	// Timeout of every check
+	Timeout time.Duration
+	// MaxQueue is how full the job queue can be, as a ratio of its size
+	MaxQueue float64
+}
+
+var fHealth HealthConfig
+
+func init() {
+	h := &fHealth
+
+	flag.StringVar(&h.DNSProbe, "ready-dns-probe", "8.8.8.8", "Address looked up by /readyz to check DNS, empty to skip")
+	flag.DurationVar(&h.Timeout, "ready-timeout", time.Second, "Timeout of every /readyz check")
+	flag.Float64Var(&h.MaxQueue, "ready-max-queue", 0.9, "Job queue usage above which the server is not ready")
+}
+
+// probePaths are polled by the orchestrator, they are neither
+// rate-limited nor logged but at debug level.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+}
+
+// Check states
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// Check is the result of one readiness check
+type Check struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// Readiness is what /readyz answers
+type Readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+// errSkipped marks a check not applying to this configuration
+var errSkipped = errors.New("skipped")
+
+// readyCheck is one dependency of the server
+type readyCheck struct {
+	name string
+	fn   func() error
+}
+
+// readyChecks lists what must work to accept uploads
+func readyChecks(c HealthConfig) []readyCheck {
+	return []readyCheck{
+		{"store", checkStore},
+		{"dns", func() error { return checkDNS(c) }},
+		{"spool", checkSpool},
+		{"queue", func() error { return checkQueue(c) }},
+	}
+}
+
+func checkStore() error {
+	if reportStore == nil {
+		return errSkipped
+	}
+	return reportStore.Ping()
+}
+
+// checkDNS does a reverse lookup of the probe address, a missing name is
+// fine as long as the resolver answered.
+func checkDNS(c HealthConfig) error {
+	if fNoResolv || c.DNSProbe == "" {
+		return errSkipped
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := resolve.RealResolver{}.LookupAddr(c.DNSProbe)
+		if dnsErr, ok := err.(interface{ IsNotFound() bool }); ok && dnsErr.IsNotFound() {
+			err = nil
+		}
+		res <- err
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(c.Timeout):
+		return errors.Errorf("no answer for %s after %v", c.DNSProbe, c.Timeout)
+	}
+}
+
+// checkSpool makes sure uploads can be saved
+func checkSpool() error {
+	if jobQueue == nil {
+		return errSkipped
+	}
+	return checkWritable(jobQueue.spool)
+}
+
+func checkWritable(dir string) error {
+	fh, err := ioutil.TempFile(dir, ".ready-*")
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+	defer os.Remove(fh.Name())
+
+	_, err = fh.Write([]byte("ok"))
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrap(err, "write")
+}
+
+// checkQueue fails when new uploads are about to be refused
+func checkQueue(c HealthConfig) error {
+	if jobQueue == nil || c.MaxQueue <= 0 {
+		return errSkipped
+	}
+	if n, max := jobQueue.Len(), jobQueue.Cap(); float64(n) >= c.MaxQueue*float64(max) {
+		return errors.Errorf("%d of %d jobs waiting", n, max)
+	}
+	return nil
+}
+
+// readiness runs every check
+func readiness(checks []readyCheck) Readiness {
+	ready := Readiness{Status: "ready", Checks: map[string]Check{}}
+
+	for _, c := range checks {
+		start := time.Now()
+		err := c.fn()
+
+		switch {
+		case err == errSkipped:
+			ready.Checks[c.name] = Check{Status: CheckSkipped}
+		case err != nil:
+			ready.Status = "not ready"
+			ready.Checks[c.name] = Check{Status: CheckFailed, Error: err.Error(), Duration: time.Since(start).String()}
+		default:
+			ready.Checks[c.name] = Check{Status: CheckOK, Duration: time.Since(start).String()}
+		}
+	}
+	return ready
+}
+
+// readyz tells whether uploads can be accepted, with 503 if not
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ready := readiness(readyChecks(fHealth))
+
+	status := http.StatusOK
+	if ready.Status != "ready" {
+		logFrom(r.Context()).Warn("not ready", "checks", ready.Checks)
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
+
+// VersionInfo is what /version answers
+type VersionInfo struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	Module    string `json:"module,omitempty"`
+	Go        string `json:"go"`
+	Archive   string `json:"archive"`
+}
+
+// version returns our version and how we were built
+func version() VersionInfo {
+	v := VersionInfo{
+		Name:      MyName,
+		Version:   MyVersion,
+		Commit:    GitCommit,
+		BuildDate: BuildDate,
+		Go:        runtime.Version(),
+		Archive:   archive.Version(),
+	}
+	if bi, ok := rdebug.ReadBuildInfo(); ok {
+		v.Module = bi.Main.Path + "@" + bi.Main.Version
+	}
+	return v
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getReadiness(t *testing.T, url string) (int, Readiness) {
+	resp, err := http.Get(url + "/readyz")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var ready Readiness
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ready))
+	return resp.StatusCode, ready
+}
+
+func TestReadyz(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	code, ready := getReadiness(t, ts.URL)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", ready.Status)
+	assert.Equal(t, CheckOK, ready.Checks["store"].Status)
+	assert.Equal(t, CheckOK, ready.Checks["spool"].Status)
+	assert.Equal(t, CheckOK, ready.Checks["queue"].Status)
+	// -N in tests
+	assert.Equal(t, CheckSkipped, ready.Checks["dns"].Status)
+
+	// Spool gone
+	require.NoError(t, os.RemoveAll(jobQueue.spool))
+	code, ready = getReadiness(t, ts.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", ready.Status)
+	assert.Equal(t, CheckFailed, ready.Checks["spool"].Status)
+	assert.NotEmpty(t, ready.Checks["spool"].Error)
+}
+
+func TestCheckQueue(t *testing.T) {
+	old := jobQueue
+	defer func() { jobQueue = old }()
+
+	jobQueue = &JobQueue{queue: make(chan string, 10)}
+	c := HealthConfig{MaxQueue: 0.5}
+	assert.NoError(t, checkQueue(c))
+
+	for i := 0; i < 5; i++ {
+		jobQueue.queue <- "x"
+	}
+	assert.Error(t, checkQueue(c))
+
+	c.MaxQueue = 0
+	assert.Equal(t, errSkipped, checkQueue(c))
+}
+
+func TestFileStore_Ping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(filepath.Join(dir, "store.json"))
+	require.NoError(t, err)
+	assert.NoError(t, s.Ping())
+
+	require.NoError(t, os.RemoveAll(dir))
+	assert.Error(t, s.Ping())
+}
+
+func TestLivezVersion(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	resp, err := http.Get(ts.URL + "/livez")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/version")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var v VersionInfo
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&v))
+	assert.Equal(t, MyVersion, v.Version)
+	assert.True(t, strings.HasPrefix(v.Go, "go"))
+	assert.NotEmpty(t, v.Archive)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReports_HTML(t *testing.T) {
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	ctx = withFormat(t, ctx, analyze.OutputHTML)
+	out, err := HandleReports(ctx, "reports.tar.gz", fh)
+	require.NoError(t, err)
+
+	page, err := ctx.a.Join("reports.tar.gz", out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(page, `<section class="report">`))
+	assert.Equal(t, 1, strings.Count(page, "<html"))
+}
+
+func TestListReports_HTML(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	_, err := reportStore.AddFeedback("", goodFeedback())
+	require.NoError(t, err)
+
+	resp, err := http.Get(ts.URL + "/api/v1/reports?format=html")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "keltia.net")
+	assert.Contains(t, string(body), "<svg")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// IngestConfig is what ingest maildir does with messages
+type IngestConfig struct {
+	// All also reads messages already in cur/
+	All bool
+	// Keep leaves messages in new/ instead of moving them to cur/
+	Keep bool
+}
+
+var fIngest IngestConfig
+
+func ingestFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&fIngest.All, "all", false, "Also ingest messages already seen, in cur/")
+	fs.BoolVar(&fIngest.Keep, "keep", false, "Do not move ingested messages from new/ to cur/")
+}
+
+// IngestResult counts what was found in messages
+type IngestResult struct {
+	Messages  int
+	Aggregate int
+	Forensic  int
+	Failed    int
+}
+
+// reportTypes are attachments holding aggregate reports
+var reportTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip":            true,
+	"application/x-zip-compressed": true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-tar":            true,
+	"application/x-gtar":           true,
+	"application/xml":              true,
+	"text/xml":                     true,
+}
+
+// reportExts are the extensions of generic attachments worth a look
+var reportExts = []string{".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".tar", ".xml"}
+
+// isReportPart is true if a part of type mt named file may be a report
+func isReportPart(mt, file string) bool {
+	if reportTypes[mt] {
+		return true
+	}
+	if mt != "application/octet-stream" {
+		return false
+	}
+	for _, ext := range reportExts {
+		if strings.HasSuffix(strings.ToLower(file), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBody undoes the transfer encoding of a message or part body
+func decodeBody(enc string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// partName is the file name of a part, from either of its headers
+func partName(h map[string][]string) string {
+	get := func(k string) string {
+		if v := h[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if _, params, err := mime.ParseMediaType(get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if _, params, err := mime.ParseMediaType(get("Content-Type")); err == nil {
+		return params["name"]
+	}
+	return ""
+}
+
+// ingestMessage stores the reports of one message, forensic reports as
+// a whole and aggregate reports found in its attachments.
+func ingestMessage(ctx *Context, raw []byte) (IngestResult, error) {
+	res := IngestResult{Messages: 1}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return res, errors.Wrap(err, "ReadMessage")
+	}
+
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		mt = "text/plain"
+	}
+
+	if mt == "multipart/report" && strings.EqualFold(params["report-type"], "feedback-report") {
+		fr, err := ParseForensic(ctx.logger(), bytes.NewReader(raw))
+		if err != nil {
+			return res, stageError(StageParse, CodeBadReport, err)
+		}
+		if fr.Tenant, err = ctx.opts.Tenants.attribute(fr.HeaderFromDomain(), ""); err != nil {
+			return res, err
+		}
+		// The same message read again replaces the report
+		sum := sha256.Sum256(raw)
+		fr.ID = hex.EncodeToString(sum[:12])
+		if _, err := ctx.opts.Store.AddForensic(fr); err != nil {
+			return res, stageError(StageAnalyze, CodeStore, err)
+		}
+		ctx.logger().Info("stored forensic report", "id", fr.ID, "tenant", fr.Tenant)
+		res.Forensic++
+		return res, nil
+	}
+
+	body := decodeBody(msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	n, err := ingestPart(ctx, mt, params, partName(msg.Header), body)
+	res.Aggregate = n
+	if err == nil && n == 0 {
+		err = ErrNoReport
+	}
+	return res, err
+}
+
+// ingestPart stores the aggregate reports in a part, walking multipart
+// ones, and returns how many were found.
+func ingestPart(ctx *Context, mt string, params map[string]string, name string, r io.Reader) (int, error) {
+	if strings.HasPrefix(mt, "multipart/") {
+		total := 0
+
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return total, nil
+			}
+			if err != nil {
+				return total, errors.Wrap(err, "NextPart")
+			}
+
+			pt, pp, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			if err != nil {
+				continue
+			}
+			n, err := ingestPart(ctx, pt, pp, partName(p.Header), partReader(p))
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	if !isReportPart(mt, name) {
+		return 0, nil
+	}
+
+	n := 0
+	err := WalkReports(ctx.logger(), name, r, ctx.opts.Limits, func(file string, in io.Reader) error {
+		r, err := streamReport(ctx, in, "", func(*report.Feedback, report.Record, analyze.Entry) error {
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "file %s", file)
+		}
+		ctx.logger().Verbose("ingested", "file", file, "report_id", r.Metadata.ReportID)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// maildirMessages lists the messages to read in dir
+func maildirMessages(dir string, all bool) ([]string, error) {
+	subdirs := []string{"new"}
+	if all {
+		subdirs = append(subdirs, "cur")
+	}
+
+	var files []string
+	for _, sub := range subdirs {
+		list, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, errors.Wrap(err, "maildir")
+		}
+		for _, fi := range list {
+			if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, fi.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// markSeen moves a message of new/ to cur/ with the Seen flag
+func markSeen(file string) error {
+	dir, name := filepath.Split(file)
+	if filepath.Base(filepath.Clean(dir)) != "new" {
+		return nil
+	}
+	if !strings.Contains(name, ":2,") {
+		name += ":2,S"
+	}
+	return os.Rename(file, filepath.Join(dir, "..", "cur", name))
+}
+
+// IngestMaildir stores the reports of all messages in dir in the store of
+// ctx, messages that cannot be read are logged and left where they are.
+func IngestMaildir(ctx *Context, dir string, c IngestConfig) (IngestResult, error) {
+	var total IngestResult
+	if ctx.opts.Store == nil {
+		return total, errors.New("ingest needs a store")
+	}
+
+	files, err := maildirMessages(dir, c.All)
+	if err != nil {
+		return total, err
+	}
+
+	for _, file := range files {
+		l := ctx.logger().With("message", file)
+
+		raw, err := ioutil.ReadFile(file)
+		if err == nil {
+			var res IngestResult
+			res, err = ingestMessage(ctx, raw)
+			total.Aggregate += res.Aggregate
+			total.Forensic += res.Forensic
+		}
+		total.Messages++
+
+		if err != nil {
+			total.Failed++
+			l.Warn("cannot ingest message", "error", err)
+			continue
+		}
+		if !c.Keep {
+			if err := markSeen(file); err != nil {
+				l.Warn("cannot move message to cur/", "error", err)
+			}
+		}
+	}
+	return total, nil
+}
+
+// runIngestMaildir is ingest maildir
+func runIngestMaildir(args []string) error {
+	if len(args) != 1 {
+		return errors.New("ingest maildir needs one Maildir")
+	}
+	if fStore == "" {
+		return errors.New("ingest needs -store")
+	}
+
+	o, err := setupOptions()
+	if err != nil {
+		return err
+	}
+	// Rows are not displayed
+	o.NoResolve = true
+
+	if fAuth != "" {
+		a, err := LoadAuth(fAuth)
+		if err != nil {
+			return errors.Wrap(err, "LoadAuth")
+		}
+		o.Tenants = a.Tenants()
+	}
+
+	o.Store, err = OpenStore(fStore)
+	if err != nil {
+		return errors.Wrap(err, "OpenStore")
+	}
+	ctx, err := NewContext(o)
+	if err != nil {
+		return err
+	}
+
+	res, err := IngestMaildir(ctx, args[0], fIngest)
+	if err != nil {
+		return err
+	}
+	logger.Info("ingested maildir", "dir", args[0], "messages", res.Messages,
+		"aggregate", res.Aggregate, "forensic", res.Forensic, "failed", res.Failed)
+
+	if res.Failed > 0 {
+		return errors.Errorf("%d of %d messages could not be ingested", res.Failed, res.Messages)
+	}
+	return nil
+}
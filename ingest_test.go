@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMaildir creates a Maildir with an aggregate report, a forensic
+// report and a message without any report.
+func testMaildir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "maildir")
+	require.NoError(t, err)
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, sub), 0755))
+	}
+
+	xml, err := ioutil.ReadFile("testdata/google.com!keltia.net!1538438400!1538524799.xml")
+	require.NoError(t, err)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(xml)
+	require.NoError(t, zw.Close())
+
+	msg := strings.Join([]string{
+		"From: noreply-dmarc-support@google.com",
+		"Subject: Report domain: keltia.net",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain",
+		"",
+		"This is an aggregate report.",
+		"--b1",
+		`Content-Type: application/octet-stream; name="report.xml.gz"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString(gz.Bytes()),
+		"--b1--",
+		"",
+	}, "\r\n")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new", "1"), []byte(msg), 0644))
+
+	eml, err := ioutil.ReadFile("testdata/forensic.eml")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new", "2"), eml, 0644))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "new", "3"), []byte("Subject: hi\r\n\r\nhello\r\n"), 0644))
+	return dir
+}
+
+func TestIsReportPart(t *testing.T) {
+	assert.True(t, isReportPart("application/zip", ""))
+	assert.True(t, isReportPart("application/octet-stream", "report.XML.GZ"))
+	assert.True(t, isReportPart("application/x-xz", ""))
+	assert.True(t, isReportPart("application/octet-stream", "reports.tar.zst"))
+	assert.False(t, isReportPart("application/octet-stream", "invoice.pdf"))
+	assert.False(t, isReportPart("text/plain", "report.xml"))
+}
+
+func TestIngestMaildir(t *testing.T) {
+	dir := testMaildir(t)
+	defer os.RemoveAll(dir)
+
+	s := NewMemStore()
+	ctx, err := NewContext(Options{Options: analyze.Options{NoResolve: true, Jobs: 1, Validate: report.ValidateNone}, Store: s})
+	require.NoError(t, err)
+	res, err := IngestMaildir(ctx, dir, IngestConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, IngestResult{Messages: 3, Aggregate: 1, Forensic: 1, Failed: 1}, res)
+
+	list, _ := s.Feedbacks()
+	require.Len(t, list, 1)
+	assert.Equal(t, "15591417298178277408", list[0].Report.Metadata.ReportID)
+	fr, _ := s.ForensicReports()
+	assert.Len(t, fr, 1)
+
+	// Ingested messages are seen, the other one is left for a look
+	_, err = os.Stat(filepath.Join(dir, "cur", "1:2,S"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "new", "3"))
+	assert.NoError(t, err)
+
+	// Nothing new
+	res, err = IngestMaildir(ctx, dir, IngestConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Messages)
+
+	// Reports read again are not stored twice
+	res, err = IngestMaildir(ctx, dir, IngestConfig{All: true})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Messages)
+	list, _ = s.Feedbacks()
+	assert.Len(t, list, 1)
+	fr, _ = s.ForensicReports()
+	assert.Len(t, fr, 1)
+}
+
+func TestIngestMaildir_Bad(t *testing.T) {
+	_, err := IngestMaildir(newTestContext(resolve.NullResolver{}, 1), "/nonexistent", IngestConfig{})
+	assert.Error(t, err)
+}
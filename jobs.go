@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	rdebug "runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
+)
+
+// Job states
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+const (
+	// jobQueueSize is how many jobs can wait for a worker
+	jobQueueSize = 256
+)
+
+// ErrQueueFull is returned when no more jobs can be accepted
+var ErrQueueFull = errors.New("job queue full")
+
+// Job is an uploaded bundle processed in the background
+type Job struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	FileName  string            `json:"fileName"`
+	Tenant    string            `json:"tenant,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	Created   time.Time         `json:"created"`
+	Updated   time.Time         `json:"updated"`
+	Found     int               `json:"filesFound"`
+	Parsed    int               `json:"filesParsed"`
+	Failed    int               `json:"filesFailed"`
+	Errors    []Failure         `json:"errors,omitempty"`
+	Results   []json.RawMessage `json:"results,omitempty"`
+	Options   *JobOptions       `json:"options,omitempty"`
+}
+
+// JobOptions are the analysis options of one upload, see Options
+type JobOptions struct {
+	NoResolve bool   `json:"noResolve,omitempty"`
+	Sort      string `json:"sort,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// Finished is true once the job will not change anymore
+func (j Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// JobQueue runs uploaded bundles through a pool of workers
+type JobQueue struct {
+	store   Store
+	spool   string
+	workers int
+	opts    Options
+	queue   chan string
+	wg      sync.WaitGroup
+	stop    sync.Once
+
+	mu   sync.Mutex
+	done map[string]chan struct{}
+}
+
+// jobQueue is the one used by the REST API
+var jobQueue *JobQueue
+
+// NewJobQueue creates the queue, uploads are saved in spool until processed
+// and analyzed with o, see options.
+func NewJobQueue(s Store, spool string, workers int, o Options) (*JobQueue, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if err := os.MkdirAll(spool, 0700); err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+	return &JobQueue{
+		store:   s,
+		spool:   spool,
+		workers: workers,
+		opts:    o,
+		queue:   make(chan string, jobQueueSize),
+		done:    map[string]chan struct{}{},
+	}, nil
+}
+
+// Start launches the workers and requeues jobs interrupted by a restart
+func (q *JobQueue) Start() error {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(i)
+	}
+
+	jobs, err := q.store.Jobs()
+	if err != nil {
+		return errors.Wrap(err, "Jobs")
+	}
+
+	for _, j := range jobs {
+		if j.Finished() {
+			continue
+		}
+
+		if _, err := os.Stat(q.spoolFile(j.ID)); err != nil {
+			j.Status = JobFailed
+			j.Errors = append(j.Errors, Failure{Stage: StageUpload, Code: CodeInternal, Message: "upload lost during restart"})
+			q.save(&j)
+			continue
+		}
+
+		jobLogger(j).Info("resuming job")
+		j.Status = JobQueued
+		j.Found, j.Parsed, j.Failed = 0, 0, 0
+		j.Errors, j.Results = nil, nil
+		q.save(&j)
+		if err := q.enqueue(j.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop waits for queued jobs to be processed
+func (q *JobQueue) Stop() {
+	q.stop.Do(func() {
+		close(q.queue)
+	})
+	q.wg.Wait()
+}
+
+// Shutdown is Stop giving up when ctx is done, remaining jobs stay in the
+// spool to be resumed on restart.
+func (q *JobQueue) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "%d jobs not processed", q.Len())
+	}
+}
+
+// Len is the number of jobs waiting for a worker
+func (q *JobQueue) Len() int {
+	return len(q.queue)
+}
+
+// Cap is the maximum number of waiting jobs
+func (q *JobQueue) Cap() int {
+	return cap(q.queue)
+}
+
+// Submit saves the upload and queues a new job for it, reports in it must
+// belong to tenant if set.  reqID is the ID of the upload request, for logs,
+// and o the options of the upload if any.
+func (q *JobQueue) Submit(name, tenant, reqID string, o *JobOptions, r io.Reader) (Job, error) {
+	now := time.Now().UTC()
+	j := Job{
+		ID:        newID(),
+		Status:    JobQueued,
+		FileName:  filepath.Base(name),
+		Tenant:    tenant,
+		RequestID: reqID,
+		Created:   now,
+		Updated:   now,
+		Options:   o,
+	}
+
+	fh, err := os.OpenFile(q.spoolFile(j.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return j, errors.Wrap(err, "spool")
+	}
+	_, err = io.Copy(fh, r)
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return j, errors.Wrap(err, "spool")
+	}
+
+	if err := q.store.SaveJob(j); err != nil {
+		os.Remove(fh.Name())
+		return j, errors.Wrap(err, "SaveJob")
+	}
+
+	if err := q.enqueue(j.ID); err != nil {
+		os.Remove(fh.Name())
+		j.Status = JobFailed
+		j.Errors = []Failure{failureOf(uploadError(err))}
+		countFailure(j.Errors[0])
+		q.save(&j)
+		return j, err
+	}
+	return j, nil
+}
+
+// Get returns the current state of a job
+func (q *JobQueue) Get(id string) (Job, error) {
+	return q.store.Job(id)
+}
+
+// Wait blocks until the job is finished
+func (q *JobQueue) Wait(id string) (Job, error) {
+	q.mu.Lock()
+	ch, ok := q.done[id]
+	q.mu.Unlock()
+
+	if ok {
+		<-ch
+	}
+	return q.store.Job(id)
+}
+
+func (q *JobQueue) enqueue(id string) error {
+	q.mu.Lock()
+	q.done[id] = make(chan struct{})
+	q.mu.Unlock()
+
+	select {
+	case q.queue <- id:
+		return nil
+	default:
+		q.finish(id)
+		return ErrQueueFull
+	}
+}
+
+// finish wakes up anyone waiting on id
+func (q *JobQueue) finish(id string) {
+	q.mu.Lock()
+	if ch, ok := q.done[id]; ok {
+		close(ch)
+		delete(q.done, id)
+	}
+	q.mu.Unlock()
+}
+
+func (q *JobQueue) spoolFile(id string) string {
+	return filepath.Join(q.spool, id+".upload")
+}
+
+// save records the job state, errors are only logged as the job goes on
+func (q *JobQueue) save(j *Job) {
+	j.Updated = time.Now().UTC()
+	if err := q.store.SaveJob(*j); err != nil {
+		jobLogger(*j).Error("cannot save job", "error", err)
+	}
+}
+
+// options returns what the reports of j are analyzed with: the resolution,
+// sort and limits of the queue changed by the upload options.  Results are
+// JSON unless asked otherwise, reports are always stored and lookups logged
+// with the job and request IDs.
+func (q *JobQueue) options(j Job) Options {
+	o := Options{
+		Options: analyze.Options{
+			NoResolve: q.opts.NoResolve,
+			Resolver:  q.opts.Resolver,
+			Jobs:      q.opts.Jobs,
+			Sort:      q.opts.Sort,
+			Format:    analyze.OutputJSON,
+			Validate:  q.opts.Validate,
+			Program:   q.opts.Program,
+			Log:       jobLogger(j),
+		},
+		Limits:  q.opts.Limits,
+		Store:   q.store,
+		Tenants: q.opts.Tenants,
+	}
+
+	if jo := j.Options; jo != nil {
+		// The server may resolve less, never more
+		o.NoResolve = o.NoResolve || jo.NoResolve
+		if jo.Sort != "" {
+			o.Sort = jo.Sort
+		}
+		if jo.Format != "" {
+			o.Format = jo.Format
+		}
+	}
+	return o
+}
+
+// jobLogger logs with the job and request IDs
+func jobLogger(j Job) *Logger {
+	if j.RequestID == "" {
+		return logger.With("job", j.ID)
+	}
+	return logger.With("job", j.ID, "request_id", j.RequestID)
+}
+
+func (q *JobQueue) worker(n int) {
+	defer q.wg.Done()
+
+	for id := range q.queue {
+		logger.Debug("running job", "worker", n, "job", id)
+		q.run(id)
+		q.finish(id)
+	}
+}
+
+// run processes every report found in the job upload
+func (q *JobQueue) run(id string) {
+	j, err := q.store.Job(id)
+	if err != nil {
+		logger.Error("cannot load job", "job", id, "error", err)
+		return
+	}
+	l := jobLogger(j)
+
+	j.Status = JobRunning
+	q.save(&j)
+
+	file := q.spoolFile(id)
+	defer os.Remove(file)
+
+	fail := func(err error) {
+		f := failureOf(err)
+		countFailure(f)
+		j.Status = JobFailed
+		j.Errors = append(j.Errors, f)
+		q.save(&j)
+	}
+
+	// One bad file must not take the server down
+	defer func() {
+		if v := recover(); v != nil {
+			l.Error("panic", "error", fmt.Sprint(v), "stack", string(rdebug.Stack()))
+			fail(stageError(StageAnalyze, CodePanic, errors.Errorf("panic: %v", v)))
+		}
+	}()
+
+	fh, err := os.Open(file)
+	if err != nil {
+		fail(stageError(StageUpload, CodeInternal, errors.Wrap(err, "open upload")))
+		return
+	}
+	defer fh.Close()
+
+	ctx, err := NewContext(q.options(j))
+	if err != nil {
+		fail(stageError(StageRequest, CodeBadRequest, err))
+		return
+	}
+	err = WalkReports(l, j.FileName, fh, ctx.opts.Limits, func(name string, in io.Reader) error {
+		j.Found++
+		q.save(&j)
+
+		txt, err := processReport(ctx, in, j.Tenant)
+		if _, ok := errors.Cause(err).(*LimitError); ok {
+			// Stop there, the whole upload is suspicious
+			return err
+		}
+		if err != nil {
+			f := failureOf(err)
+			f.File = name
+			countFailure(f)
+			j.Failed++
+			j.Errors = append(j.Errors, f)
+		} else {
+			j.Parsed++
+			j.Results = append(j.Results, rawResult(txt))
+		}
+		q.save(&j)
+		return nil
+	})
+	if err != nil {
+		fail(decompressError(err))
+		return
+	}
+	if _, ok := tableTypes[ctx.opts.Format]; ok && len(j.Results) > 0 {
+		// The rows of every report go in one table under one header
+		txt, err := ctx.a.Join(j.FileName, resultTexts(j.Results))
+		if err != nil {
+			fail(analyzeError(err))
+			return
+		}
+		j.Results = []json.RawMessage{rawResult(txt)}
+	}
+
+	j.Status = JobDone
+	if j.Parsed == 0 {
+		j.Status = JobFailed
+	}
+	q.save(&j)
+	l.Info("job finished", "status", j.Status, "found", j.Found, "parsed", j.Parsed, "failed", j.Failed)
+}
+
+// rawResult keeps a JSON analysis as is or as a string if it is not valid
+func rawResult(txt string) json.RawMessage {
+	if json.Valid([]byte(txt)) {
+		return json.RawMessage(txt)
+	}
+	b, _ := json.Marshal(txt)
+	return b
+}
+
+// resultTexts are the analyses rawResult wrapped as strings
+func resultTexts(results []json.RawMessage) []string {
+	out := make([]string, 0, len(results))
+	for _, r := range results {
+		var txt string
+		if err := json.Unmarshal(r, &txt); err != nil {
+			txt = string(r)
+		}
+		out = append(out, txt)
+	}
+	return out
+}
+
+// resultFormat is the format the results of j are rendered in
+func resultFormat(j Job) string {
+	if j.Options != nil && j.Options.Format != "" {
+		return j.Options.Format
+	}
+	return analyze.OutputJSON
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestQueue(t *testing.T, s Store) (*JobQueue, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+
+	q, err := NewJobQueue(s, dir, 2, Options{Options: analyze.Options{NoResolve: true}})
+	require.NoError(t, err)
+	return q, dir
+}
+
+func TestJobQueue(t *testing.T) {
+	q, dir := newTestQueue(t, NewMemStore())
+	defer os.RemoveAll(dir)
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	j, err := q.Submit("reports.tar.gz", "", "", nil, fh)
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, j.Status)
+
+	j, err = q.Wait(j.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, j.Status)
+	assert.Equal(t, 2, j.Found)
+	assert.Equal(t, 2, j.Parsed)
+	assert.Equal(t, 0, j.Failed)
+	assert.Len(t, j.Results, 2)
+
+	// Upload is gone once processed
+	_, err = os.Stat(q.spoolFile(j.ID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestJobQueue_Table(t *testing.T) {
+	q, dir := newTestQueue(t, NewMemStore())
+	defer os.RemoveAll(dir)
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	j, err := q.Submit("reports.tar.gz", "", "", &JobOptions{Format: analyze.OutputCSV}, fh)
+	require.NoError(t, err)
+
+	j, err = q.Wait(j.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, j.Status)
+	assert.Equal(t, 2, j.Parsed)
+
+	// Both reports in one table with a single header
+	require.Len(t, j.Results, 1)
+	txt := resultTexts(j.Results)[0]
+	assert.True(t, strings.HasPrefix(txt, "org_name,"), txt)
+	assert.Equal(t, 1, strings.Count(txt, "org_name,"))
+}
+
+func TestJobQueue_Bad(t *testing.T) {
+	q, dir := newTestQueue(t, NewMemStore())
+	defer os.RemoveAll(dir)
+	require.NoError(t, q.Start())
+	defer q.Stop()
+
+	j, err := q.Submit("foo.txt", "", "", nil, strings.NewReader("not a report"))
+	require.NoError(t, err)
+
+	j, err = q.Wait(j.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobFailed, j.Status)
+	assert.NotEmpty(t, j.Errors)
+}
+
+func TestJobQueue_Get(t *testing.T) {
+	q, dir := newTestQueue(t, NewMemStore())
+	defer os.RemoveAll(dir)
+
+	_, err := q.Get("nonexistent")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestJobQueue_Resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenStore(filepath.Join(dir, "store.json"))
+	require.NoError(t, err)
+
+	// Simulate a job interrupted by a restart and one whose upload is gone
+	q, err := NewJobQueue(s, dir, 1, Options{Options: analyze.Options{NoResolve: true}})
+	require.NoError(t, err)
+
+	body, err := ioutil.ReadFile("testdata/google.com!keltia.net!1538438400!1538524799.zip")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(q.spoolFile("running"), body, 0600))
+	require.NoError(t, s.SaveJob(Job{ID: "running", Status: JobRunning, FileName: "foo.zip", Created: time.Now()}))
+	require.NoError(t, s.SaveJob(Job{ID: "lost", Status: JobQueued, FileName: "bar.zip", Created: time.Now()}))
+
+	s1, err := OpenStore(filepath.Join(dir, "store.json"))
+	require.NoError(t, err)
+	q1, err := NewJobQueue(s1, dir, 1, Options{Options: analyze.Options{NoResolve: true}})
+	require.NoError(t, err)
+	require.NoError(t, q1.Start())
+
+	j, err := q1.Wait("running")
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, j.Status)
+	assert.Equal(t, 1, j.Parsed)
+
+	j, err = q1.Get("lost")
+	require.NoError(t, err)
+	assert.Equal(t, JobFailed, j.Status)
+	q1.Stop()
+}
+
+func TestRawResult(t *testing.T) {
+	assert.Equal(t, `{"a": 1}`, string(rawResult(`{"a": 1}`)))
+	assert.Equal(t, `"foo"`, string(rawResult(`foo`)))
+}
+
+func TestResultTexts(t *testing.T) {
+	assert.Equal(t, []string{`{"a": 1}`, "foo\n"}, resultTexts([]json.RawMessage{rawResult(`{"a": 1}`), rawResult("foo\n")}))
+}
+
+func TestJobQueue_Shutdown(t *testing.T) {
+	q, dir := newTestQueue(t, NewMemStore())
+	defer os.RemoveAll(dir)
+	require.NoError(t, q.Start())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, q.Shutdown(ctx))
+}
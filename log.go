@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level of a log message
+type Level int
+
+// Log levels, from the most verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (lv Level) String() string {
+	return levelNames[lv]
+}
+
+// ParseLevel returns the level named s
+func ParseLevel(s string) (Level, error) {
+	for lv, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return lv, nil
+		}
+	}
+	return LevelInfo, errors.Errorf("unknown log level %q", s)
+}
+
+// Log formats
+const (
+	LogFmt  = "logfmt"
+	LogJSON = "json"
+)
+
+// LogConfig is how and what we log
+type LogConfig struct {
+	Level  string
+	Format string
+	// Verbose logs the messages of Logger.Verbose, -v or -D
+	Verbose bool
+	// Reports logs the content of reports at debug level, it is
+	// redacted by default
+	Reports bool
+}
+
+var fLog LogConfig
+
+func init() {
+	l := &fLog
+
+	flag.StringVar(&l.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&l.Format, "log-format", LogFmt, "Log format: logfmt or json")
+	flag.BoolVar(&l.Reports, "log-reports", false, "Log report contents at debug level")
+}
+
+// redacted replaces sensitive values
+const redacted = "[redacted]"
+
+// redactKeys are fields never logged as is
+var redactKeys = map[string]bool{
+	"authorization": true,
+	"api_key":       true,
+	"cookie":        true,
+	"password":      true,
+	"secret":        true,
+	"signature":     true,
+	"token":         true,
+	"x-api-key":     true,
+}
+
+// logOutput is shared by a logger and those derived from it
+type logOutput struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   Level
+	json    bool
+	verbose bool
+	reports bool
+	now     func() time.Time
+}
+
+// Logger writes structured messages with a set of fields
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// logger is the default one, see setupLogging
+var logger = NewLogger(os.Stderr, LevelInfo, LogFmt)
+
+// NewLogger writes messages at level or above to w
+func NewLogger(w io.Writer, level Level, format string) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, json: format == LogJSON, now: time.Now}}
+}
+
+// setupLogging replaces the default logger, -D means debug level and
+// verbose messages.
+func setupLogging(c LogConfig) error {
+	level, err := ParseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+	if fDebug {
+		level = LevelDebug
+		c.Verbose = true
+	}
+
+	switch c.Format {
+	case LogFmt, LogJSON:
+	default:
+		return errors.Errorf("unknown log format %q", c.Format)
+	}
+	logger = NewLogger(os.Stderr, level, c.Format)
+	logger.out.verbose, logger.out.reports = c.Verbose, c.Reports
+	return nil
+}
+
+// With returns a logger adding key/value pairs to every message
+func (l *Logger) With(kv ...interface{}) *Logger {
+	l = l.get()
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{out: l.out, fields: append(fields, kv...)}
+}
+
+// get makes a nil Logger the default one
+func (l *Logger) get() *Logger {
+	if l == nil {
+		return logger
+	}
+	return l
+}
+
+// Enabled is true if messages at lv are written
+func (l *Logger) Enabled(lv Level) bool {
+	return lv >= l.get().out.level
+}
+
+// Debug logs msg with key/value pairs at debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.get().log(LevelDebug, msg, kv)
+}
+
+// Info logs at info level
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.get().log(LevelInfo, msg, kv)
+}
+
+// IsVerbose is true if Verbose messages are written, see LogConfig
+func (l *Logger) IsVerbose() bool {
+	return l.get().out.verbose
+}
+
+// Verbose logs at info level only with -v
+func (l *Logger) Verbose(msg string, kv ...interface{}) {
+	if l.IsVerbose() {
+		l.get().log(LevelInfo, msg, kv)
+	}
+}
+
+// Warn logs at warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.get().log(LevelWarn, msg, kv)
+}
+
+// Error logs at error level
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.get().log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(lv Level, msg string, kv []interface{}) {
+	if !l.Enabled(lv) {
+		return
+	}
+
+	o := l.out
+	fields := []interface{}{"time", o.now().UTC().Format(time.RFC3339Nano), "level", lv.String(), "msg", msg}
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	if o.json {
+		writeJSONLine(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+
+	o.mu.Lock()
+	o.w.Write(buf.Bytes())
+	o.mu.Unlock()
+}
+
+// logValue is what gets logged for v under key
+func logValue(key string, v interface{}) interface{} {
+	if redactKeys[strings.ToLower(key)] {
+		return redacted
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string, bool, int, int64, uint64, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSONLine(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := fmt.Sprint(fields[i])
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(logValue(key, fields[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteString("}\n")
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key := fmt.Sprint(fields[i])
+		buf.WriteString(key)
+		buf.WriteByte('=')
+
+		s := fmt.Sprint(logValue(key, fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+}
+
+// reportContent is what l logs of a report, its size unless -log-reports
+// is set as reports hold addresses and host names.
+func (l *Logger) reportContent(v interface{}) interface{} {
+	if l.get().out.reports {
+		if b, ok := v.([]byte); ok {
+			return string(b)
+		}
+		return fmt.Sprintf("%+v", v)
+	}
+	if b, ok := v.([]byte); ok {
+		return fmt.Sprintf("%s %d bytes", redacted, len(b))
+	}
+	return redacted
+}
+
+// RequestIDHeader carries the ID of a request, generated if missing
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestID is the longest ID accepted from clients
+const maxRequestID = 128
+
+type loggerKey struct{}
+
+// withLogger returns ctx carrying l
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logFrom returns the logger of a request, the default one otherwise
+func logFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// requestIDFrom returns the ID set by requestID
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+type requestIDKey struct{}
+
+// validRequestID keeps client IDs short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID tags every request with an ID, echoed in the response and
+// added to its logs, and logs the request once answered.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		l := logger.With("request_id", id)
+		ctx := context.WithValue(withLogger(r.Context(), l), requestIDKey{}, id)
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		kv := []interface{}{"method", r.Method, "path", r.URL.Path, "status", sw.code,
+			"duration", time.Since(start), "client", r.RemoteAddr}
+		if probePaths[r.URL.Path] {
+			l.Debug("request", kv...)
+			return
+		}
+		l.Info("request", kv...)
+	})
+}
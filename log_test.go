@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLogger(level Level, format string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+
+	l := NewLogger(&buf, level, format)
+	l.out.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return l, &buf
+}
+
+func TestLogger_Logfmt(t *testing.T) {
+	l, buf := testLogger(LevelInfo, LogFmt)
+
+	l.Debug("hidden")
+	l.With("request_id", "abc").Info("stored report", "file", "a b.xml", "count", 3, "error", errors.New("boom"))
+	assert.Equal(t, `time=2020-01-02T03:04:05Z level=info msg="stored report" request_id=abc file="a b.xml" count=3 error=boom`+"\n", buf.String())
+}
+
+func TestLogger_JSON(t *testing.T) {
+	l, buf := testLogger(LevelDebug, LogJSON)
+
+	l.Warn("auth", "x-api-key", "s3cr3t", "ok", false, "odd")
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &m))
+	assert.Equal(t, "warn", m["level"])
+	assert.Equal(t, "auth", m["msg"])
+	assert.Equal(t, redacted, m["x-api-key"])
+	assert.Equal(t, false, m["ok"])
+	assert.Equal(t, "(MISSING)", m["odd"])
+}
+
+func TestParseLevel(t *testing.T) {
+	lv, err := ParseLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, LevelWarn, lv)
+
+	_, err = ParseLevel("loud")
+	assert.Error(t, err)
+	assert.Error(t, setupLogging(LogConfig{Level: "info", Format: "xml"}))
+}
+
+func TestLogger_Verbose(t *testing.T) {
+	l, buf := testLogger(LevelInfo, LogFmt)
+
+	l.Verbose("hidden")
+	assert.Empty(t, buf.String())
+
+	l.out.verbose = true
+	l.With("job", "a").Verbose("shown")
+	assert.Contains(t, buf.String(), `msg=shown job=a`)
+}
+
+func TestReportContent(t *testing.T) {
+	l, _ := testLogger(LevelDebug, LogFmt)
+
+	assert.Equal(t, "[redacted] 5 bytes", l.reportContent([]byte("<xml>")))
+	assert.Equal(t, redacted, l.reportContent(report.Feedback{}))
+
+	l.out.reports = true
+	assert.Equal(t, "<xml>", l.reportContent([]byte("<xml>")))
+}
+
+func TestSetupLogging(t *testing.T) {
+	saved := logger
+	defer func() { logger = saved }()
+
+	require.NoError(t, setupLogging(LogConfig{Level: "info", Format: LogFmt, Verbose: true, Reports: true}))
+	assert.True(t, logger.IsVerbose())
+	assert.Equal(t, "<xml>", logger.reportContent([]byte("<xml>")))
+
+	require.NoError(t, setupLogging(LogConfig{Level: "info", Format: LogFmt}))
+	assert.False(t, logger.IsVerbose())
+}
+
+func TestRequestID(t *testing.T) {
+	l, buf := testLogger(LevelInfo, LogFmt)
+	old := logger
+	logger = l
+	defer func() { logger = old }()
+
+	var seen string
+	h := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFrom(r.Context())
+		logFrom(r.Context()).Info("inside")
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v1/reports", nil)
+	req.Header.Set(RequestIDHeader, "client-42")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "client-42", seen)
+	assert.Equal(t, "client-42", w.Header().Get(RequestIDHeader))
+	assert.Contains(t, buf.String(), `msg=inside request_id=client-42`)
+	assert.Contains(t, buf.String(), `msg=request request_id=client-42 method=GET path=/api/v1/reports status=200`)
+
+	// Invalid IDs are replaced
+	req.Header.Set(RequestIDHeader, "bad id\n"+strings.Repeat("x", maxRequestID))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Len(t, seen, 24)
+	assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+}
+
+func TestContext_Logger(t *testing.T) {
+	l, buf := testLogger(LevelDebug, LogFmt)
+
+	ctx, err := NewContext(Options{Options: analyze.Options{NoResolve: true, Log: l.With("request_id", "abc")}})
+	require.NoError(t, err)
+
+	fh, err := os.Open("testdata/example.com!keltia.net!1538604008!1538690408.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	_, err = processReport(ctx, fh, "")
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `msg="decoded report" request_id=abc`)
+	assert.Contains(t, buf.String(), `msg=resolved request_id=abc`)
+}
+
+func TestWalkReports_Logger(t *testing.T) {
+	l, buf := testLogger(LevelDebug, LogFmt)
+
+	fh, err := os.Open("testdata/reports.tar.gz")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	err = WalkReports(l.With("request_id", "abc"), "reports.tar.gz", fh, DefaultLimits, func(name string, r io.Reader) error {
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), `msg=sniffed request_id=abc file=reports.tar.gz format=gzip`)
+}
+
+func TestRequestID_Job(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	body, ct := uploadForm(t, "bundleFile", "testdata/example.com!keltia.net!1538604008!1538690408.xml.gz")
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/upload_bundle", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set(RequestIDHeader, "upload-1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var job Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, "upload-1", job.RequestID)
+	assert.Equal(t, "upload-1", resp.Header.Get(RequestIDHeader))
+}
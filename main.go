@@ -4,11 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+
 	"github.com/keltia/archive"
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
 	"github.com/pkg/errors"
 )
 
@@ -17,34 +20,113 @@ var (
 	MyName = filepath.Base(os.Args[0])
 	// MyVersion is our version
 	MyVersion = "0.12.0,parallel"
+	// GitCommit and BuildDate are set by the Makefile
+	GitCommit string
+	BuildDate string
 	// Author should be obvious
 	Author = "Ken Moini & Ollivier Robert"
 
 	fDebug    bool
 	fJobs     int
 	fNoResolv bool
-	fServer	  bool
+	fOutput   string
+	fServer   bool
 	fSort     string
+	fSpool    string
+	fStore    string
 	fType     string
+	fValidate string
 	fVerbose  bool
 	fVersion  bool
+	fWorkers  int
 )
 
+// Options drive the analysis of reports.  Every Context has its own copy
+// so concurrent requests never share or change each other's settings.
+type Options struct {
+	analyze.Options
+
+	// Type is the file type of stdin, see SelectInput
+	Type string
+	// Limits protect against archive and compression bombs
+	Limits ExtractLimits
+	// Store keeps every report, attributed to the tenant of Tenants
+	// owning its domain, nil means reports are not stored
+	Store Store
+	// Tenants reports are attributed to, nil means a single tenant
+	Tenants *Tenants
+}
+
 // Context is passed around rather than being a global var/struct
 type Context struct {
-	r    Resolver
-	jobs int
+	a    *analyze.Analyzer
+	opts Options
+}
+
+// program is what the output says rendered the reports
+func program() analyze.Program {
+	return analyze.Program{Name: MyName, Version: MyVersion, Author: Author}
+}
+
+// NewContext checks o and returns a context analyzing reports with it,
+// zero fields get the defaults of the flags.
+func NewContext(o Options) (*Context, error) {
+	if o.Limits == (ExtractLimits{}) {
+		o.Limits = DefaultLimits
+	}
+	if o.Program == (analyze.Program{}) {
+		o.Program = program()
+	}
+	if o.Resolver == nil {
+		o.Resolver = MeteredResolver{resolve.RealResolver{}}
+	}
+	if o.Log == nil {
+		// A nil *Logger is the default one, even once reconfigured
+		o.Log = (*Logger)(nil)
+	}
+
+	a, err := analyze.New(o.Options)
+	if err != nil {
+		return nil, err
+	}
+	o.Options = a.Options()
+	return &Context{a: a, opts: o}, nil
+}
+
+// withFormat returns a copy of ctx rendering reports in format
+func (ctx *Context) withFormat(format string) (*Context, error) {
+	c := *ctx
+	c.opts.Format = format
+
+	a, err := analyze.New(c.opts.Options)
+	if err != nil {
+		return nil, err
+	}
+	c.a = a
+	return &c, nil
+}
+
+// logger is where parsing and resolution of this context log, see
+// analyze.Options.Log
+func (ctx *Context) logger() *Logger {
+	l, _ := ctx.opts.Log.(*Logger)
+	return l.get()
 }
 
 func init() {
 	flag.BoolVar(&fDebug, "D", false, "Debug mode")
 	flag.BoolVar(&fNoResolv, "N", false, "Do not resolve IPs")
 	flag.IntVar(&fJobs, "j", runtime.NumCPU(), "Parallel jobs")
+	flag.StringVar(&fOutput, "o", analyze.OutputText, "Output format: text, json, csv, tsv or html")
 	flag.BoolVar(&fServer, "rest-server", false, "Start REST API")
-	flag.StringVar(&fSort, "S", `"Count" "dsc"`, "Sort results")
+	flag.StringVar(&fSort, "S", analyze.DefaultSort, "Sort results by a column, like Count:dsc")
+	flag.StringVar(&fSpool, "spool", filepath.Join(os.TempDir(), "dmarc-spool"), "Directory for uploads waiting to be processed")
+	flag.StringVar(&fStore, "store", "", "File to keep reports in, one JSON line each (REST API)")
 	flag.StringVar(&fType, "t", "", "File type for stdin mode")
+	flag.StringVar(&fValidate, "validate", report.ValidateLenient, "Schema validation: none, lenient or strict")
 	flag.BoolVar(&fVerbose, "v", false, "Verbose mode")
 	flag.BoolVar(&fVersion, "version", false, "Display version")
+	flag.IntVar(&fWorkers, "workers", 2, "Upload processing workers (REST API)")
 }
 
 func Version() {
@@ -59,30 +141,35 @@ func Setup(a []string) (*Context, error) {
 		return nil, nil
 	}
 
-	if fDebug {
-		fVerbose = true
-		debug("debug mode")
-	}
-	
-	if ((len(a) < 1) && !fServer) {
+	if (len(a) < 1) && !fServer {
 		return nil, fmt.Errorf("You must specify at least one file or start as a REST API Server.")
 	}
 
-	ctx := &Context{RealResolver{}, fJobs}
+	return setupCommand()
+}
 
-	// Make it easier to sub it out
-	if fNoResolv {
-		ctx.r = NullResolver{}
+// flagOptions returns the options given by the flags, without the
+// filter and template which need compiling, see setupCommand.
+func flagOptions() Options {
+	return Options{
+		Options: analyze.Options{
+			NoResolve: fNoResolv,
+			Jobs:      fJobs,
+			Sort:      fSort,
+			Format:    fOutput,
+			Validate:  fValidate,
+		},
+		Type:   fType,
+		Limits: fExtract,
 	}
-
-	return ctx, nil
 }
 
-func SelectInput(file string) (io.ReadCloser, error) {
+// SelectInput opens file, - being stdin of the type given by ctx
+func SelectInput(ctx *Context, file string) (io.ReadCloser, error) {
 	debug("file=%s", file)
 
 	if file == "-" {
-		if fType == "" {
+		if ctx.opts.Type == "" {
 			return nil, errors.New("Wrong file type, use -t")
 		}
 		return os.Stdin, nil
@@ -105,54 +192,26 @@ func SelectInput(file string) (io.ReadCloser, error) {
 func realmain(args []string) error {
 	flag.Parse()
 
-	ctx, err := Setup(args)
-	if ctx == nil {
-		return errors.Wrap(err, "realmain")
+	if cmd, rest := findCommand(args); cmd != nil {
+		return cmd.Execute(rest)
 	}
 
-	if fServer {
-		fmt.Println("Starting DMARC REST API...")
-		setupRoutes()
+	// Without a command, -rest-server serves and files are analyzed
+	if err := configure(nil); err != nil {
+		return err
 	}
-
-	var txt string
-
-	// Look for input file or stdin/"-"
-	file := args[0]
-
-	verbose("Analyzing %s", file)
-
-	if filepath.Ext(file) == ".zip" ||
-		filepath.Ext(file) == ".ZIP" {
-
-		txt, err = HandleZipFile(ctx, file)
-		if err != nil {
-			return errors.Wrapf(err, "file %s:", file)
-		}
-	} else {
-		in, err := SelectInput(file)
-		if err != nil {
-			return errors.Wrap(err, "SelectInput")
-		}
-		defer in.Close()
-
-		typ := archive.Ext2Type(fType)
-
-		txt, err = HandleSingleFile(ctx, in, typ)
-		if err != nil {
-			return errors.Wrapf(err, "file %s:", file)
-		}
+	if fServer {
+		return runServe(nil)
 	}
-	fmt.Println(txt)
-	return nil
+	return runAnalyze(args)
 }
 
-
 func main() {
 	// Parse CLI
 	flag.Parse()
 
 	if err := realmain(flag.Args()); err != nil {
-		log.Fatalf("Error: %v\n", err)
+		logger.Error("exiting", "error", err)
+		os.Exit(1)
 	}
 }
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSetup(t *testing.T) {
@@ -37,25 +45,88 @@ func TestSetup4(t *testing.T) {
 	fVersion = false
 }
 
+func TestNewContext(t *testing.T) {
+	ctx, err := NewContext(Options{Options: analyze.Options{NoResolve: true}})
+	require.NoError(t, err)
+	assert.IsType(t, resolve.NullResolver{}, ctx.a.Resolver())
+	assert.True(t, ctx.opts.Jobs > 0)
+	assert.Equal(t, analyze.OutputText, ctx.opts.Format)
+	assert.Equal(t, analyze.DefaultSort, ctx.opts.Sort)
+	assert.Equal(t, report.ValidateLenient, ctx.opts.Validate)
+	assert.Equal(t, DefaultLimits, ctx.opts.Limits)
+	assert.Equal(t, MyName, ctx.opts.Program.Name)
+
+	ctx, err = NewContext(Options{Options: analyze.Options{Sort: "ip"}})
+	require.NoError(t, err)
+	assert.IsType(t, MeteredResolver{}, ctx.a.Resolver())
+	assert.Equal(t, `"IP" "asc"`, ctx.opts.Sort)
+
+	group, err := analyze.NewFilter(analyze.FilterConfig{GroupBy: analyze.GroupIP})
+	require.NoError(t, err)
+	for _, o := range []analyze.Options{
+		{Validate: "foo"},
+		{Format: "pdf"},
+		{Format: analyze.OutputTemplate},
+		{Sort: "Nope"},
+		{Format: analyze.OutputHTML, Filter: group},
+	} {
+		_, err := NewContext(Options{Options: o})
+		assert.Error(t, err, "%+v", o)
+	}
+}
+
+// Contexts with different options can be used at the same time
+func TestNewContext_Concurrent(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/reports.tar.gz")
+	require.NoError(t, err)
+
+	formats := []string{analyze.OutputText, analyze.OutputJSON, analyze.OutputCSV, analyze.OutputHTML}
+	out := make([][]string, len(formats))
+	errs := make([]error, len(formats))
+
+	var wg sync.WaitGroup
+	for i, format := range formats {
+		wg.Add(1)
+		go func(i int, format string) {
+			defer wg.Done()
+			ctx, err := NewContext(Options{Options: analyze.Options{NoResolve: true, Format: format, Jobs: 2}})
+			if err == nil {
+				out[i], err = HandleReports(ctx, "reports.tar.gz", bytes.NewReader(body))
+			}
+			errs[i] = err
+		}(i, format)
+	}
+	wg.Wait()
+
+	for i := range formats {
+		require.NoError(t, errs[i], formats[i])
+		require.Len(t, out[i], 2, formats[i])
+	}
+	assert.Contains(t, out[0][0], "Reporting by:")
+	assert.Contains(t, out[1][0], `"apiVersion": "v1"`)
+	assert.NotContains(t, out[2][0], "Reporting by:")
+	assert.Contains(t, out[3][0], "<section")
+}
+
 func TestVersion(t *testing.T) {
 	Version()
 }
 
 func TestSelectInput_Bad(t *testing.T) {
-	_, err := SelectInput("-")
+	_, err := SelectInput(newTestContext(resolve.NullResolver{}, 1), "-")
 	assert.Error(t, err)
 }
 
 func TestSelectInput_Good(t *testing.T) {
-	fType = ".xml"
-	r, err := SelectInput("-")
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+	ctx.opts.Type = ".xml"
+	r, err := SelectInput(ctx, "-")
 	assert.NoError(t, err)
 	assert.EqualValues(t, os.Stdin, r)
-	fType = ""
 }
 
 func TestSelectInput_Badfn(t *testing.T) {
-	_, err := SelectInput("/testdata/google.com!keltia.net!1538438400!1538524798.xml")
+	_, err := SelectInput(newTestContext(resolve.NullResolver{}, 1), "/testdata/google.com!keltia.net!1538438400!1538524798.xml")
 	assert.Error(t, err)
 }
 
@@ -105,4 +176,54 @@ func TestMain_EmptyArg(t *testing.T) {
 func TestMain_GoodFile(t *testing.T) {
 	os.Args = append(os.Args, "testdata/google.com!keltia.net!1538438400!1538524799.zip")
 	main()
-}
\ No newline at end of file
+}
+
+func TestSetup_BadValidate(t *testing.T) {
+	fValidate = "foo"
+	ctx, err := Setup([]string{"foo.zip"})
+	fValidate = report.ValidateLenient
+	assert.Nil(t, ctx)
+	assert.Error(t, err)
+}
+
+// newTestContext returns a context with the default options looking IPs
+// up with r
+func newTestContext(r resolve.Resolver, jobs int) *Context {
+	ctx, err := NewContext(Options{Options: analyze.Options{Resolver: r, Jobs: jobs}})
+	if err != nil {
+		panic(err)
+	}
+	return ctx
+}
+
+// withFormat returns a copy of ctx rendering in format
+func withFormat(t *testing.T, ctx *Context, format string) *Context {
+	c, err := ctx.withFormat(format)
+	require.NoError(t, err)
+	return c
+}
+
+// testFeedback parses a report of testdata
+func testFeedback(name string) report.Feedback {
+	fh, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		panic(err)
+	}
+	defer fh.Close()
+
+	r, err := report.Parse(fh)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// goodFeedback is a valid report with one record
+func goodFeedback() report.Feedback {
+	return testFeedback("good.xml")
+}
+
+// filterFeedback is goodFeedback with failing records added
+func filterFeedback() report.Feedback {
+	return testFeedback("filter.xml")
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+)
+
+// Metrics are served on /metrics in the Prometheus text format, there are
+// few enough of them not to need the full client library.
+
+// Registry is a set of metrics
+type Registry struct {
+	mu   sync.Mutex
+	list []collector
+}
+
+// collector writes one metric family
+type collector interface {
+	collect(w io.Writer)
+}
+
+// metrics is what /metrics serves
+var metrics = &Registry{}
+
+var (
+	httpRequests = metrics.counter("dmarc_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = metrics.histogram("dmarc_http_request_duration_seconds",
+		"HTTP request latency by route and method.", defBuckets, "route", "method")
+	uploads = metrics.counter("dmarc_uploads_total",
+		"Uploaded files by detected type.", "type")
+	failures = metrics.counter("dmarc_parse_failures_total",
+		"Reports that could not be processed by stage and error code.", "stage", "code")
+	dnsLookups = metrics.counter("dmarc_dns_lookups_total",
+		"Reverse DNS lookups by result.", "result")
+	dnsDuration = metrics.histogram("dmarc_dns_lookup_duration_seconds",
+		"Reverse DNS lookup latency.", defBuckets)
+	messages = metrics.counter("dmarc_messages_total",
+		"Messages in stored aggregate reports by tenant domain.", "domain")
+	dmarcResults = metrics.counter("dmarc_results_total",
+		"Messages in stored aggregate reports by tenant domain and DMARC result.", "domain", "result")
+)
+
+func init() {
+	metrics.register(&mapCollector{
+		name:  "dmarc_rejections_total",
+		help:  "Requests refused by the limits by reason.",
+		label: "reason",
+		m:     rejections,
+	})
+}
+
+// defBuckets are the Prometheus default latency buckets, in seconds
+var defBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func (reg *Registry) register(c collector) {
+	reg.mu.Lock()
+	reg.list = append(reg.list, c)
+	reg.mu.Unlock()
+}
+
+func (reg *Registry) counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+	reg.register(c)
+	return c
+}
+
+func (reg *Registry) histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histValue{}}
+	reg.register(h)
+	return h
+}
+
+// ServeHTTP writes every metric
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	list := append([]collector(nil), reg.list...)
+	reg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range list {
+		c.collect(w)
+	}
+}
+
+// CounterVec is a counter with labels
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	v      float64
+}
+
+// Add adds v to the counter with these label values
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labels: values}
+		c.values[key] = cv
+	}
+	cv.v += v
+	c.mu.Unlock()
+}
+
+// Inc adds one
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the current value for these label values
+func (c *CounterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cv, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return cv.v
+	}
+	return 0
+}
+
+func (c *CounterVec) collect(w io.Writer) {
+	header(w, c.name, c.help, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, cv.labels, "", ""), formatFloat(cv.v))
+	}
+}
+
+// HistogramVec is a histogram with labels
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histValue
+}
+
+type histValue struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe records v for these label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histValue{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+	h.mu.Unlock()
+}
+
+// Since records the time elapsed since start
+func (h *HistogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Count returns how many values were recorded for these label values
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hv, ok := h.values[strings.Join(values, "\xff")]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) collect(w io.Writer) {
+	header(w, h.name, h.help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, hv.labels, "le", formatFloat(b)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, hv.labels, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, hv.labels, "", ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, hv.labels, "", ""), hv.count)
+	}
+}
+
+// mapCollector publishes an expvar map as a counter
+type mapCollector struct {
+	name, help, label string
+	m                 *expvar.Map
+}
+
+func (c *mapCollector) collect(w io.Writer) {
+	header(w, c.name, c.help, "counter")
+
+	c.m.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString([]string{c.label}, []string{kv.Key}, "", ""), kv.Value.String())
+	})
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelString formats labels as {a="x",b="y"}, with an extra one if set
+func labelString(names, values []string, extra, extraValue string) string {
+	var pairs []string
+
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	switch m := m.(type) {
+	case map[string]*counterValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// instrument counts requests and their latency by route
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tpl, err := cur.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+
+		httpDuration.Since(start, route, r.Method)
+		httpRequests.Inc(route, r.Method, strconv.Itoa(sw.code))
+	})
+}
+
+// countFailure records a report that could not be processed
+func countFailure(f Failure) {
+	failures.Inc(f.Stage, f.Code)
+}
+
+// otherDomain labels the messages for domains no tenant owns
+const otherDomain = "other"
+
+// reportTally sums the messages of a report by DMARC result
+type reportTally struct {
+	pass, fail float64
+}
+
+// add counts the messages of rec
+func (t *reportTally) add(rec report.Record) {
+	if rec.Pass() {
+		t.pass += float64(rec.Row.Count)
+	} else {
+		t.fail += float64(rec.Row.Count)
+	}
+}
+
+// countReport records the messages of a stored aggregate report for
+// domain.  Reports are untrusted, so they are counted under the tenant
+// domain owning their policy domain and all others under otherDomain,
+// which keeps the number of series bounded by the configuration.
+func countReport(t *Tenants, domain string, tally reportTally) {
+	label := t.Domain(domain)
+	if label == "" {
+		label = otherDomain
+	}
+
+	messages.Add(tally.pass+tally.fail, label)
+	dmarcResults.Add(tally.pass, label, "pass")
+	dmarcResults.Add(tally.fail, label, "fail")
+}
+
+// MeteredResolver counts lookups done by another Resolver
+type MeteredResolver struct {
+	resolve.Resolver
+}
+
+// LookupAddr calls the real resolver and records the result and latency
+func (m MeteredResolver) LookupAddr(addr string) ([]string, error) {
+	start := time.Now()
+	names, err := m.Resolver.LookupAddr(addr)
+	dnsDuration.Since(start)
+
+	if err != nil {
+		dnsLookups.Inc("error")
+	} else {
+		dnsLookups.Inc("ok")
+	}
+	return names, err
+}
+
+// LookupASN passes through to the real resolver if it can find ASNs
+func (m MeteredResolver) LookupASN(addr string) (string, error) {
+	return resolve.ASN(m.Resolver, addr)
+}
+
+// LookupTXT passes through to the real resolver if it can fetch TXT records
+func (m MeteredResolver) LookupTXT(name string) ([]string, error) {
+	return resolve.TXT(m.Resolver, name)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := &Registry{}
+	c := reg.counter("test_total", "Test counter.", "kind")
+	h := reg.histogram("test_seconds", "Test histogram.", []float64{0.1, 1})
+
+	c.Inc(`a"b`)
+	c.Add(2, "c")
+	h.Observe(0.5)
+	h.Observe(2)
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a\"b"} 1
+test_total{kind="c"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 0
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 2.5
+test_seconds_count 2
+`, w.Body.String())
+}
+
+type ErrResolver struct{}
+
+func (ErrResolver) LookupAddr(ip string) ([]string, error) {
+	return []string{"BAD"}, fmt.Errorf("fake error")
+}
+
+func TestMeteredResolver(t *testing.T) {
+	ok, bad := dnsLookups.Value("ok"), dnsLookups.Value("error")
+	n := dnsDuration.Count()
+
+	_, err := MeteredResolver{resolve.NullResolver{}}.LookupAddr("192.0.2.1")
+	assert.NoError(t, err)
+	_, err = MeteredResolver{ErrResolver{}}.LookupAddr("192.0.2.1")
+	assert.Error(t, err)
+
+	assert.Equal(t, ok+1, dnsLookups.Value("ok"))
+	assert.Equal(t, bad+1, dnsLookups.Value("error"))
+	assert.Equal(t, n+2, dnsDuration.Count())
+}
+
+func TestCountReport(t *testing.T) {
+	tt, err := NewTenants([]TenantConfig{{ID: "a", Domains: []string{"keltia.net"}}})
+	require.NoError(t, err)
+
+	var tally reportTally
+	for _, rec := range testFeedback("good.xml").Records {
+		tally.add(rec)
+	}
+	require.True(t, tally.pass+tally.fail > 0)
+
+	owned := messages.Value("keltia.net")
+	other := messages.Value(otherDomain)
+
+	countReport(tt, "mail.keltia.net", tally)
+	assert.Equal(t, owned+tally.pass+tally.fail, messages.Value("keltia.net"))
+	assert.Equal(t, other, messages.Value(otherDomain))
+
+	countReport(tt, "spam.example.org", tally)
+	assert.Equal(t, other+tally.pass+tally.fail, messages.Value(otherDomain))
+	assert.Equal(t, 0.0, messages.Value("spam.example.org"))
+}
+
+func TestMetrics_Server(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	route := "/api/v1/upload_bundle"
+	reqs := httpRequests.Value(route, "POST", "200")
+	gz := uploads.Value("gzip")
+	msgs := messages.Value(otherDomain)
+	failed := failures.Value(StageDecompress, CodeUnsupportedFormat)
+
+	body, ct := uploadForm(t, "bundleFile", "testdata/example.com!keltia.net!1538604008!1538690408.xml.gz")
+	resp, err := http.Post(ts.URL+route+"?wait=true", ct, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Post(ts.URL+route+"?wait=true&name=x.txt", "text/xml", bytes.NewBufferString("not a report"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, reqs+1, httpRequests.Value(route, "POST", "200"))
+	assert.Equal(t, gz+1, uploads.Value("gzip"))
+	assert.True(t, messages.Value(otherDomain) > msgs)
+	assert.Equal(t, failed+1, failures.Value(StageDecompress, CodeUnsupportedFormat))
+
+	resp, err = http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, name := range []string{
+		`dmarc_http_requests_total{route="/api/v1/upload_bundle",method="POST",code="200"}`,
+		`dmarc_http_request_duration_seconds_bucket{route="/api/v1/upload_bundle",method="POST",le="+Inf"}`,
+		`dmarc_uploads_total{type="gzip"}`,
+		`dmarc_messages_total{domain="other"}`,
+		`dmarc_results_total{domain="other",result=`,
+		`# TYPE dmarc_rejections_total counter`,
+	} {
+		assert.Contains(t, string(res), name)
+	}
+}
@@ -0,0 +1,454 @@
+// Package analyze turns aggregate reports into rows of resolved sources
+// and renders them as text, JSON, CSV, TSV, HTML or user templates, one
+// report at a time or summed up by groups.
+package analyze
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/intel/tfortools"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/pkg/errors"
+)
+
+// ErrEmptyReport is returned for a report without any record
+var ErrEmptyReport = errors.New("empty report")
+
+// DefaultSort is the sort of text rows unless told otherwise
+const DefaultSort = `"Count" "dsc"`
+
+const (
+	reportTmpl = `{{.MyName}} {{.MyVersion}}/j{{.Jobs}} by {{.Author}}
+
+Reporting by: {{.Org}} — {{.Email}}
+From {{.DateBegin}} to {{.DateEnd}}
+
+Domain: {{.Domain}}
+Domain RUA Email: {{.DomainRUA}}
+Policy: p={{.Disposition}}; dkim={{.DKIM}}; spf={{.SPF}}
+{{- if .DMARCbis}}; np={{.NP}}; psd={{.PSD}}; t={{.Testing}}
+Discovery: {{.DiscoveryMethod}}
+Generator: {{.Generator}}{{end}}
+Schema: {{.Schema}}
+
+Reports({{.Count}}):
+`
+
+	rowTmpl = `{{ table (sort . %s)}}`
+
+	// Human results are only displayed when at least one is present
+	rowTmplShort = `{{ table (cols (sort . %s) "IP" "Count" "From" "RFrom" "RDKIM" "RSPF")}}`
+)
+
+// Program is what headers and footers say rendered the reports
+type Program struct {
+	Name    string
+	Version string
+	Author  string
+}
+
+// Logger receives what the analyzer does, like failed lookups, as
+// key/value pairs
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+}
+
+// nopLogger discards everything
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+
+// Options drive the analysis of reports
+type Options struct {
+	// NoResolve keeps IPs instead of looking their names up
+	NoResolve bool
+	// Resolver looks names and ASNs up, resolve.RealResolver if nil
+	Resolver resolve.Resolver
+	// Jobs is how many lookups run in parallel
+	Jobs int
+	// Sort orders text rows, see ParseSort
+	Sort string
+	// Format is one of the Output* formats
+	Format string
+	// Validate is one of the report.Validate* modes
+	Validate string
+	// Filter selects the records displayed, nil for all
+	Filter *Filter
+	// Template renders OutputTemplate
+	Template *template.Template
+	// Program is displayed in headers
+	Program Program
+	// Log gets the lookups and reports of the analyzer, nothing is logged
+	// if nil
+	Log Logger
+}
+
+// Analyzer analyzes and renders reports with fixed options, it can be
+// used concurrently.
+type Analyzer struct {
+	opts Options
+	r    resolve.Resolver
+	log  Logger
+}
+
+// New checks o and returns an analyzer using it, zero fields get the
+// defaults: one job per CPU, text output and lenient validation.
+func New(o Options) (*Analyzer, error) {
+	if o.Jobs < 1 {
+		o.Jobs = runtime.NumCPU()
+	}
+	if o.Format == "" {
+		o.Format = OutputText
+	}
+	if o.Validate == "" {
+		o.Validate = report.ValidateLenient
+	}
+	if o.Program.Name == "" {
+		o.Program.Name = "dmarc"
+	}
+
+	sort, err := ParseSort(o.Sort)
+	if err != nil {
+		return nil, err
+	}
+	o.Sort = sort
+
+	if err := report.CheckMode(o.Validate); err != nil {
+		return nil, err
+	}
+
+	if o.Format == OutputTemplate {
+		if o.Template == nil {
+			return nil, errors.New("no template to render")
+		}
+	} else if err := CheckOutput(o.Format); err != nil {
+		return nil, err
+	}
+	if o.Filter.Grouping() && (o.Format == OutputHTML || o.Format == OutputTemplate) {
+		return nil, errors.Errorf("group-by is not available with %s output", o.Format)
+	}
+
+	a := &Analyzer{opts: o, r: o.Resolver, log: o.Log}
+	if a.log == nil {
+		a.log = nopLogger{}
+	}
+	switch {
+	case o.NoResolve:
+		a.r = resolve.NullResolver{}
+	case a.r == nil:
+		a.r = resolve.RealResolver{}
+	}
+	return a, nil
+}
+
+// Options are the options of a with the defaults filled in
+func (a *Analyzer) Options() Options {
+	return a.opts
+}
+
+// Resolver is what a looks names up with
+func (a *Analyzer) Resolver() resolve.Resolver {
+	return a.r
+}
+
+// My template vars
+type headVars struct {
+	MyName      string
+	MyVersion   string
+	Jobs        string
+	Author      string
+	Org         string
+	Email       string
+	DateBegin   string
+	DateEnd     string
+	Domain      string
+	DomainRUA   string
+	Disposition string
+	DKIM        string
+	SPF         string
+	Pct         int
+	Count       int
+	// DMARCbis
+	Schema          string
+	DMARCbis        bool
+	NP              string
+	PSD             string
+	Testing         string
+	DiscoveryMethod string
+	Generator       string
+}
+
+// jsonMeta is what rendered a JSON output
+type jsonMeta struct {
+	ApplicationName  string `json:"applicationName"`
+	Jobs             string `json:"jobs"`
+	ProcessorVersion string `json:"processorVersion"`
+}
+
+// jsonReport is the JSON rendering of a report before its entries, see
+// writeJSONHead
+type jsonReport struct {
+	Org       string     `json:"reportingOrg"`
+	Email     string     `json:"reportingEmail"`
+	DateBegin string     `json:"reportStartDate"`
+	DateEnd   string     `json:"reportEndDate"`
+	Domain    string     `json:"reportedDomain"`
+	DomainRUA string     `json:"reportedDomainRUA"`
+	Schema    string     `json:"reportSchema"`
+	Generator string     `json:"reportGenerator"`
+	Policy    jsonPolicy `json:"reportedPolicy"`
+}
+
+type jsonPolicy struct {
+	Disposition     string `json:"disposition"`
+	DKIM            string `json:"dkim"`
+	SPF             string `json:"spf"`
+	NP              string `json:"np"`
+	PSD             string `json:"psd"`
+	Testing         string `json:"testing"`
+	DiscoveryMethod string `json:"discoveryMethod"`
+}
+
+// Entry representes a single entry
+type Entry struct {
+	IP    string
+	Count int
+	From  string
+	RFrom string
+	RDKIM string
+	RSPF  string
+	HDKIM string `json:",omitempty"`
+	HSPF  string `json:",omitempty"`
+}
+
+// domainRUA pulls the rua= address from the live DMARC record, nothing
+// without resolution
+func (a *Analyzer) domainRUA(domain string) string {
+	if a.opts.NoResolve {
+		return ""
+	}
+	a.log.Debug("pulling live DMARC record", "domain", domain)
+	txtrecords, err := resolve.TXT(a.r, "_dmarc."+domain)
+	if err != nil {
+		a.log.Debug("DMARC record lookup failed", "domain", domain, "error", err)
+	}
+
+	var record string
+
+	for _, txt := range txtrecords {
+		record = txt
+	}
+
+	s := strings.Split(record, "; ")
+
+	rua := strings.Replace(s[len(s)-1], "rua=mailto:", "", -1)
+	a.log.Debug("processed live DMARC RUA address", "domain", domain, "rua", rua)
+	return rua
+}
+
+// newHeadVars fills the header template variables from a report with
+// count records
+func (a *Analyzer) newHeadVars(r report.Feedback, count int) *headVars {
+	p := a.opts.Program
+	return &headVars{
+		MyName:          p.Name,
+		MyVersion:       p.Version,
+		Jobs:            fmt.Sprintf("%d", a.opts.Jobs),
+		Author:          p.Author,
+		Org:             r.Metadata.OrgName,
+		Email:           r.Metadata.Email,
+		DateBegin:       time.Unix(r.Metadata.Date.Begin, 0).String(),
+		DateEnd:         time.Unix(r.Metadata.Date.End, 0).String(),
+		Domain:          r.Policy.Domain,
+		DomainRUA:       a.domainRUA(r.Policy.Domain),
+		Disposition:     r.Policy.P,
+		DKIM:            r.Policy.ADKIM,
+		SPF:             r.Policy.ASPF,
+		Pct:             r.Policy.Pct,
+		Count:           count,
+		Schema:          r.SchemaVersion(),
+		DMARCbis:        r.SchemaVersion() == report.SchemaDMARCbis,
+		NP:              r.Policy.NP,
+		PSD:             r.Policy.PSD,
+		Testing:         r.Policy.Testing,
+		DiscoveryMethod: r.Policy.DiscoveryMethod,
+		Generator:       r.Metadata.Generator,
+	}
+}
+
+// hasHumanResults is true if any row carries a human_result
+func hasHumanResults(rows []Entry) bool {
+	for _, e := range rows {
+		if e.HDKIM != "" || e.HSPF != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEntry builds the row for one record, the IP is not resolved yet
+func NewEntry(rec report.Record) Entry {
+	current := Entry{
+		IP:    rec.Row.SourceIP.String(),
+		Count: rec.Row.Count,
+		From:  rec.Identifiers.HeaderFrom,
+		RSPF:  rec.AuthResults.SPF.Result,
+		RDKIM: rec.AuthResults.DKIM.Result,
+		HSPF:  rec.AuthResults.SPF.HumanResult,
+		HDKIM: rec.AuthResults.DKIM.HumanResult,
+	}
+	if rec.AuthResults.DKIM.Domain == "" {
+		current.RFrom = rec.AuthResults.SPF.Domain
+	} else {
+		current.RFrom = rec.AuthResults.DKIM.Domain
+	}
+	return current
+}
+
+// loggedResolver logs every reverse lookup of the analyzer
+type loggedResolver struct {
+	a *Analyzer
+}
+
+// LookupAddr asks the resolver of the analyzer
+func (l loggedResolver) LookupAddr(addr string) ([]string, error) {
+	names, err := l.a.r.LookupAddr(addr)
+	if err != nil {
+		l.a.log.Debug("reverse lookup failed", "ip", addr, "error", err)
+	} else {
+		l.a.log.Debug("resolved", "ip", addr, "names", names)
+	}
+	return names, err
+}
+
+// Resolve replaces the IP of every row by its name
+func (a *Analyzer) Resolve(rows []Entry) {
+	addrs := make([]string, len(rows))
+	for i, e := range rows {
+		addrs[i] = e.IP
+	}
+
+	a.log.Debug("resolving IPs", "ips", len(addrs))
+	names := resolve.Parallel(loggedResolver{a}, a.opts.Jobs, addrs)
+	for i := range rows {
+		rows[i].IP = names[i]
+	}
+	a.log.Debug("resolved IPs", "ips", len(addrs))
+}
+
+// Rows returns the resolved rows of r, in the order of the records
+func (a *Analyzer) Rows(r report.Feedback) []Entry {
+	var rows []Entry
+
+	for _, rec := range r.Records {
+		rows = append(rows, NewEntry(rec))
+	}
+	a.Resolve(rows)
+	return rows
+}
+
+// Analyze resolves the records of r kept by the filter and renders them,
+// reports without any record left by the filter are empty.
+func (a *Analyzer) Analyze(r report.Feedback) (string, error) {
+	r, _ = a.opts.Filter.Apply(r, nil)
+	if a.opts.Filter.Active() && len(r.Records) == 0 {
+		return "", nil
+	}
+	return a.Render(r, a.Rows(r))
+}
+
+// sortFields are the columns rows can be sorted by
+var sortFields = []string{"IP", "Count", "From", "RFrom", "RDKIM", "RSPF", "HDKIM", "HSPF"}
+
+// ParseSort checks a sort given either like `"Count" "dsc"` or like
+// Count:dsc, the direction being optional, and returns it in the first
+// form for templates.  Empty is DefaultSort.
+func ParseSort(s string) (string, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultSort, nil
+	}
+
+	f := strings.Fields(strings.Replace(s, ":", " ", 1))
+	if len(f) > 2 {
+		return "", errors.Errorf("bad sort %q", s)
+	}
+
+	field := ""
+	for _, c := range sortFields {
+		if strings.EqualFold(strings.Trim(f[0], `"`), c) {
+			field = c
+		}
+	}
+	if field == "" {
+		return "", errors.Errorf("bad sort %q, columns are %s", s, strings.Join(sortFields, ", "))
+	}
+
+	dir := "asc"
+	if len(f) == 2 {
+		dir = strings.ToLower(strings.Trim(f[1], `"`))
+	}
+	if dir != "asc" && dir != "dsc" {
+		return "", errors.Errorf("bad sort %q, order is asc or dsc", s)
+	}
+	return fmt.Sprintf("%q %q", field, dir), nil
+}
+
+// renderText displays the report header and rows as text
+func (a *Analyzer) renderText(r report.Feedback, rows []Entry) (string, error) {
+	var buf bytes.Buffer
+
+	if len(rows) == 0 {
+		return "", ErrEmptyReport
+	}
+
+	tmplvars := a.newHeadVars(r, len(rows))
+
+	// Header
+	t := template.Must(template.New("r").Parse(string(reportTmpl)))
+	err := t.ExecuteTemplate(&buf, "r", tmplvars)
+	if err != nil {
+		return "", errors.Wrapf(err, "error in template 'r'")
+	}
+
+	// Generate our template
+	tmpl := rowTmplShort
+	if hasHumanResults(rows) {
+		tmpl = rowTmpl
+	}
+	sortTmpl := fmt.Sprintf(tmpl, a.opts.Sort)
+	err = tfortools.OutputToTemplate(&buf, "reports", sortTmpl, rows, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "error in template 'reports'")
+	}
+
+	return buf.String(), nil
+}
+
+// renderJSON displays the report header and rows as JSON, rows are kept
+// in the order of the report
+func (a *Analyzer) renderJSON(r report.Feedback, rows []Entry) (string, error) {
+	var buf bytes.Buffer
+
+	if len(rows) == 0 {
+		return "", ErrEmptyReport
+	}
+
+	if err := a.writeJSONHead(&buf, r); err != nil {
+		return "", err
+	}
+	for i, row := range rows {
+		if err := writeJSONEntry(&buf, i, row); err != nil {
+			return "", err
+		}
+	}
+	if err := writeJSONTail(&buf, len(rows)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,249 @@
+package analyze
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAnalyzer renders in format with one job, looking names up with r
+func newTestAnalyzer(r resolve.Resolver, format string) *Analyzer {
+	a, err := New(Options{Resolver: r, Jobs: 1, Format: format})
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// parseFile decodes a report of testdata
+func parseFile(t *testing.T, name string) report.Feedback {
+	fh, err := os.Open("../../testdata/" + name)
+	require.NoError(t, err)
+	defer fh.Close()
+
+	r, err := report.Parse(fh)
+	require.NoError(t, err)
+	return r
+}
+
+// testFeedback parses a report of testdata, for fixtures
+func testFeedback(name string) report.Feedback {
+	fh, err := os.Open("../../testdata/" + name)
+	if err != nil {
+		panic(err)
+	}
+	defer fh.Close()
+
+	r, err := report.Parse(fh)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// goodFeedback is a valid report with one record
+func goodFeedback() report.Feedback {
+	return testFeedback("good.xml")
+}
+
+// filterFeedback has a passing, a quarantined and a rejected record
+func filterFeedback() report.Feedback {
+	return testFeedback("filter.xml")
+}
+
+func TestNew(t *testing.T) {
+	a, err := New(Options{NoResolve: true, Resolver: resolve.RealResolver{}})
+	require.NoError(t, err)
+	assert.IsType(t, resolve.NullResolver{}, a.Resolver())
+	o := a.Options()
+	assert.True(t, o.Jobs > 0)
+	assert.Equal(t, OutputText, o.Format)
+	assert.Equal(t, DefaultSort, o.Sort)
+	assert.Equal(t, report.ValidateLenient, o.Validate)
+
+	a, err = New(Options{Sort: "ip"})
+	require.NoError(t, err)
+	assert.IsType(t, resolve.RealResolver{}, a.Resolver())
+	assert.Equal(t, `"IP" "asc"`, a.Options().Sort)
+
+	group, err := NewFilter(FilterConfig{GroupBy: GroupIP})
+	require.NoError(t, err)
+	for _, o := range []Options{
+		{Validate: "foo"},
+		{Format: "pdf"},
+		{Format: OutputTemplate},
+		{Sort: "Nope"},
+		{Format: OutputHTML, Filter: group},
+	} {
+		_, err := New(o)
+		assert.Error(t, err, "%+v", o)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	a := newTestAnalyzer(resolve.NullResolver{}, OutputText)
+	s, err := a.Analyze(report.Feedback{})
+	assert.Equal(t, ErrEmptyReport, err)
+	assert.Empty(t, s)
+}
+
+func TestAnalyze_Filter(t *testing.T) {
+	f, err := NewFilter(FilterConfig{Dispositions: []string{"reject"}})
+	require.NoError(t, err)
+	a, err := New(Options{NoResolve: true, Filter: f})
+	require.NoError(t, err)
+
+	// Nothing rejected, no output but no error either
+	s, err := a.Analyze(goodFeedback())
+	assert.NoError(t, err)
+	assert.Empty(t, s)
+}
+
+func TestRows_Empty(t *testing.T) {
+	a := newTestAnalyzer(resolve.NullResolver{}, OutputText)
+	assert.Empty(t, a.Rows(report.Feedback{}))
+}
+
+func TestRows_Good(t *testing.T) {
+	a := newTestAnalyzer(resolve.NullResolver{}, OutputText)
+	r := parseFile(t, "example.com!keltia.net!1538604008!1538690408.xml")
+
+	rows := a.Rows(r)
+	require.Equal(t, 1, len(rows))
+	assert.Equal(t, r.Records[0].Row.SourceIP.String(), rows[0].IP)
+}
+
+func TestAnalyze_DMARCbis(t *testing.T) {
+	r := parseFile(t, "dmarcbis.xml")
+
+	txt, err := newTestAnalyzer(resolve.NullResolver{}, OutputText).Analyze(r)
+	require.NoError(t, err)
+	assert.Contains(t, txt, "np=reject; psd=n; t=n")
+	assert.Contains(t, txt, "Generator: Example DMARC Reporter 2.1")
+	assert.Contains(t, txt, "Schema: dmarcbis")
+	assert.Contains(t, txt, "sender authorized")
+
+	js, err := newTestAnalyzer(resolve.NullResolver{}, OutputJSON).Analyze(r)
+	require.NoError(t, err)
+	assert.Contains(t, js, `"np": "reject"`)
+	assert.Contains(t, js, `"HSPF": "sender authorized"`)
+}
+
+// txtResolver answers TXT lookups from a map
+type txtResolver struct {
+	resolve.NullResolver
+	txt map[string][]string
+}
+
+func (r txtResolver) LookupTXT(name string) ([]string, error) {
+	return r.txt[name], nil
+}
+
+func TestAnalyze_DomainRUA(t *testing.T) {
+	r := parseFile(t, "dmarcbis.xml")
+	res := txtResolver{txt: map[string][]string{
+		"_dmarc." + r.Policy.Domain: {"v=DMARC1; p=reject; rua=mailto:dmarc@example.net"},
+	}}
+
+	txt, err := newTestAnalyzer(res, OutputText).Analyze(r)
+	require.NoError(t, err)
+	assert.Contains(t, txt, "Domain RUA Email: dmarc@example.net")
+
+	a, err := New(Options{NoResolve: true, Resolver: res, Format: OutputText})
+	require.NoError(t, err)
+	txt, err = a.Analyze(r)
+	require.NoError(t, err)
+	assert.NotContains(t, txt, "dmarc@example.net")
+}
+
+// logRecorder keeps the messages logged
+type logRecorder struct {
+	msgs []string
+}
+
+func (l *logRecorder) Debug(msg string, kv ...interface{}) {
+	l.msgs = append(l.msgs, msg)
+}
+
+// failResolver never finds anything
+type failResolver struct{}
+
+func (failResolver) LookupAddr(addr string) ([]string, error) {
+	return nil, errors.New("no such host")
+}
+
+func TestAnalyze_Log(t *testing.T) {
+	l := &logRecorder{}
+	a, err := New(Options{Resolver: failResolver{}, Jobs: 1, Log: l})
+	require.NoError(t, err)
+
+	fh, err := os.Open("../../testdata/dmarcbis.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	_, _, _, err = a.Stream(fh, false)
+	require.NoError(t, err)
+	assert.Contains(t, l.msgs, "reverse lookup failed")
+	assert.Contains(t, l.msgs, "decoded report")
+}
+
+func TestRenderJSON_Escape(t *testing.T) {
+	r := goodFeedback()
+	r.Metadata.OrgName = `Evil "Org" \ Inc`
+	r.Metadata.Generator = "gen\"\n"
+
+	js, err := newTestAnalyzer(resolve.NullResolver{}, OutputJSON).Analyze(r)
+	require.NoError(t, err)
+
+	var out struct {
+		Reports []struct {
+			Org       string `json:"reportingOrg"`
+			Generator string `json:"reportGenerator"`
+			Entries   []Entry
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(js), &out))
+	require.Len(t, out.Reports, 1)
+	assert.Equal(t, r.Metadata.OrgName, out.Reports[0].Org)
+	assert.Equal(t, r.Metadata.Generator, out.Reports[0].Generator)
+	assert.Len(t, out.Reports[0].Entries, 1)
+}
+
+func TestParseSort(t *testing.T) {
+	for in, want := range map[string]string{
+		"":              DefaultSort,
+		`"Count" "dsc"`: `"Count" "dsc"`,
+		"count:dsc":     `"Count" "dsc"`,
+		"IP":            `"IP" "asc"`,
+		"rspf asc":      `"RSPF" "asc"`,
+	} {
+		got, err := ParseSort(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"Name", "Count:up", "Count dsc extra", `"Count") (printf "x"`} {
+		_, err := ParseSort(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestRenderText_Sort(t *testing.T) {
+	r := parseFile(t, "google.com!keltia.net!1538438400!1538524799.xml")
+
+	var out []string
+	for _, sort := range []string{"IP:asc", "IP:dsc"} {
+		a, err := New(Options{NoResolve: true, Sort: sort})
+		require.NoError(t, err)
+		txt, err := a.Render(r, a.Rows(r))
+		require.NoError(t, err)
+		out = append(out, txt)
+	}
+	assert.NotEqual(t, out[0], out[1])
+}
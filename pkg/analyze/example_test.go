@@ -0,0 +1,92 @@
+package analyze_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+)
+
+const sample = `<feedback>
+  <version>1.0</version>
+  <report_metadata>
+    <org_name>example.net</org_name>
+    <email>dmarc@example.net</email>
+    <report_id>1234</report_id>
+    <date_range><begin>1538438400</begin><end>1538524799</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf>
+    <p>none</p><sp>none</sp><pct>100</pct><fo>1</fo>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip>
+      <count>2</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><envelope_from>example.com</envelope_from><header_from>example.com</header_from></identifiers>
+    <auth_results><spf><domain>example.com</domain><result>softfail</result></spf></auth_results>
+  </record>
+  <record>
+    <row>
+      <source_ip>198.51.100.7</source_ip>
+      <count>3</count>
+      <policy_evaluated><disposition>reject</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><envelope_from>example.org</envelope_from><header_from>example.com</header_from></identifiers>
+    <auth_results><spf><domain>example.org</domain><result>fail</result></spf></auth_results>
+  </record>
+</feedback>
+`
+
+func ExampleAnalyzer_Stream() {
+	a, err := analyze.New(analyze.Options{NoResolve: true, Format: analyze.OutputCSV})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Records are needed for CSV, see NeedsRecords
+	r, rows, violations, err := a.Stream(strings.NewReader(sample), true)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(r.Metadata.ReportID, len(rows), len(violations))
+
+	txt, err := a.Render(r, rows)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	out, _ := a.Join("example", []string{txt})
+	fmt.Println(strings.Count(out, "\n"))
+	// Output:
+	// 1234 2 0
+	// 3
+}
+
+func ExampleAnalyzer_NewGrouper() {
+	r, _ := report.Parse(strings.NewReader(sample))
+
+	f, _ := analyze.NewFilter(analyze.FilterConfig{OnlyFail: true})
+	a, _ := analyze.New(analyze.Options{NoResolve: true, Filter: f})
+
+	g := a.NewGrouper(analyze.GroupIP)
+	r, _ = f.Apply(r, nil)
+	g.Add(r, nil)
+	for _, grp := range g.Groups() {
+		fmt.Println(grp.Key, grp.Count, grp.Fail)
+	}
+	// Output: 198.51.100.7 3 3
+}
+
+func ExampleNewStats() {
+	r, _ := report.Parse(strings.NewReader(sample))
+
+	s := analyze.NewStats(r)
+	fmt.Printf("%d messages, %d%% pass, %d rejected\n", s.Messages, s.PassPct, s.Reject)
+	// Output: 5 messages, 40% pass, 3 rejected
+}
@@ -0,0 +1,213 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// Output formats
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputCSV  = "csv"
+	OutputTSV  = "tsv"
+	// OutputHTML is a self-contained page, see Join
+	OutputHTML = "html"
+	// OutputTemplate renders Options.Template, it is not a valid -o
+	OutputTemplate = "template"
+)
+
+// CheckOutput makes sure format is one we can render, OutputTemplate
+// needs a template so it is not one.
+func CheckOutput(format string) error {
+	switch format {
+	case OutputText, OutputJSON, OutputCSV, OutputTSV, OutputHTML:
+		return nil
+	}
+	return errors.Errorf("unknown output format %q", format)
+}
+
+// Render displays a report and its resolved rows, in the same order as
+// the records, in the format of a.  Several reports are put together by
+// Join.
+func (a *Analyzer) Render(r report.Feedback, rows []Entry) (string, error) {
+	switch a.opts.Format {
+	case OutputJSON:
+		return a.renderJSON(r, rows)
+	case OutputCSV, OutputTSV:
+		return renderCSV(r, rows, csvComma(a.opts.Format))
+	case OutputHTML:
+		return RenderHTML(r, rows)
+	case OutputTemplate:
+		return a.renderTemplate(r, rows)
+	}
+	return a.renderText(r, rows)
+}
+
+// csvComma is the separator of a CSV or TSV format
+func csvComma(format string) rune {
+	if format == OutputTSV {
+		return '\t'
+	}
+	return ','
+}
+
+// IsTable is true for formats with one header for all reports
+func IsTable(format string) bool {
+	return format == OutputCSV || format == OutputTSV
+}
+
+// NeedsRecords is true for formats displaying every record, reports are
+// rendered from their records and not only from their rows.
+func NeedsRecords(format string) bool {
+	return IsTable(format) || format == OutputHTML || format == OutputTemplate
+}
+
+// CSVHeader is the column order of CSV and TSV exports, new columns go at
+// the end so spreadsheets built on it keep working.
+var CSVHeader = []string{
+	"org_name", "email", "extra_contact_info", "report_id", "date_begin", "date_end",
+	"domain", "adkim", "aspf", "p", "sp", "pct", "fo", "np", "psd", "discovery_method", "testing",
+	"source_ip", "source_name", "count", "disposition", "dkim_aligned", "spf_aligned", "reasons",
+	"header_from", "envelope_from", "envelope_to",
+	"dkim_domain", "dkim_selector", "dkim_result", "dkim_human_result",
+	"spf_domain", "spf_scope", "spf_result", "spf_human_result",
+}
+
+// CSVDate formats report dates in UTC
+func CSVDate(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
+// CSVRows returns one line per record of r, rows are the resolved names
+// in the same order if any.
+func CSVRows(r report.Feedback, rows []Entry) [][]string {
+	lines := make([][]string, 0, len(r.Records))
+	for i, rec := range r.Records {
+		var row *Entry
+		if i < len(rows) {
+			row = &rows[i]
+		}
+		lines = append(lines, csvLine(r, rec, row))
+	}
+	return lines
+}
+
+// csvLine is the line of rec in report r, row is its resolved name if any
+func csvLine(r report.Feedback, rec report.Record, row *Entry) []string {
+	m, p := r.Metadata, r.Policy
+	ip := rec.Row.SourceIP.String()
+
+	name := ""
+	if row != nil && row.IP != ip {
+		name = row.IP
+	}
+
+	var reasons []string
+	for _, rs := range rec.Row.Policy.Reasons {
+		if rs.Comment != "" {
+			reasons = append(reasons, rs.Type+": "+rs.Comment)
+		} else {
+			reasons = append(reasons, rs.Type)
+		}
+	}
+
+	id, dkim, spf := rec.Identifiers, rec.AuthResults.DKIM, rec.AuthResults.SPF
+	return []string{
+		m.OrgName, m.Email, m.ExtraContactInfo, m.ReportID, CSVDate(m.Date.Begin), CSVDate(m.Date.End),
+		p.Domain, p.ADKIM, p.ASPF, p.P, p.SP, strconv.Itoa(p.Pct), p.Fo, p.NP, p.PSD, p.DiscoveryMethod, p.Testing,
+		ip, name, strconv.Itoa(rec.Row.Count), rec.Row.Policy.Disposition, rec.Row.Policy.DKIM, rec.Row.Policy.SPF,
+		strings.Join(reasons, "; "),
+		id.HeaderFrom, id.EnvelopeFrom, id.EnvelopeTo,
+		dkim.Domain, dkim.Selector, dkim.Result, dkim.HumanResult,
+		spf.Domain, spf.Scope, spf.Result, spf.HumanResult,
+	}
+}
+
+// renderCSV returns the lines of one report without the header, see
+// csvHeaderLine.
+func renderCSV(r report.Feedback, rows []Entry, comma rune) (string, error) {
+	if len(r.Records) == 0 {
+		return "", ErrEmptyReport
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, comma, nil, CSVRows(r, rows)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// csvHeaderLine is the header of CSV and TSV exports
+func csvHeaderLine(comma rune) string {
+	var buf bytes.Buffer
+
+	WriteCSV(&buf, comma, CSVHeader, nil)
+	return buf.String()
+}
+
+// csvFormula are the first characters spreadsheets take as a formula
+const csvFormula = "=+-@\t\r"
+
+// csvCell keeps spreadsheets from running values sent by reporters as
+// formulas by quoting them with '
+func csvCell(s string) string {
+	if s != "" && strings.IndexByte(csvFormula, s[0]) >= 0 {
+		return "'" + s
+	}
+	return s
+}
+
+// WriteCSV writes header if set then lines, cells which would be taken as
+// formulas by spreadsheets are prefixed with '.
+func WriteCSV(w io.Writer, comma rune, header []string, lines [][]string) error {
+	cw := newCSVWriter(w, comma)
+
+	if header != nil {
+		if err := cw.Write(header); err != nil {
+			return errors.Wrap(err, "csv")
+		}
+	}
+	for _, line := range lines {
+		if err := writeCSVLine(cw, line); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "csv")
+}
+
+// newCSVWriter writes CSV or TSV to w depending on comma
+func newCSVWriter(w io.Writer, comma rune) *csv.Writer {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	return cw
+}
+
+// writeCSVLine writes one line of a report, see WriteCSV
+func writeCSVLine(cw *csv.Writer, line []string) error {
+	cells := make([]string, len(line))
+	for i, c := range line {
+		cells[i] = csvCell(c)
+	}
+	return errors.Wrap(cw.Write(cells), "csv")
+}
+
+// Join puts the output of several reports rendered by Render together, in
+// one page titled title for HTML.
+func (a *Analyzer) Join(title string, out []string) (string, error) {
+	switch a.opts.Format {
+	case OutputCSV, OutputTSV:
+		return csvHeaderLine(csvComma(a.opts.Format)) + strings.Join(out, ""), nil
+	case OutputHTML:
+		return a.htmlPage(title, out)
+	}
+	return strings.Join(out, "\n"), nil
+}
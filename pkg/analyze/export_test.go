@@ -0,0 +1,71 @@
+package analyze
+
+import (
+	"encoding/csv"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderCSV(t *testing.T) {
+	r := goodFeedback()
+	r.Metadata.OrgName = `Example, "Inc"`
+	r.Records[0].Row.Policy.Reasons = []report.PolicyOverrideReason{{Type: "forwarded", Comment: "list"}, {Type: "local_policy"}}
+	rows := []Entry{{IP: "mail.example.net"}}
+
+	txt, err := renderCSV(r, rows, ',')
+	require.NoError(t, err)
+
+	lines, err := csv.NewReader(strings.NewReader(csvHeaderLine(',') + txt)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, lines, 1+len(r.Records))
+
+	line := map[string]string{}
+	for i, col := range lines[0] {
+		line[col] = lines[1][i]
+	}
+	assert.Equal(t, CSVHeader, lines[0])
+	assert.Equal(t, `Example, "Inc"`, line["org_name"])
+	assert.Equal(t, "2018-10-02T00:00:00Z", line["date_begin"])
+	assert.Equal(t, "192.0.2.1", line["source_ip"])
+	assert.Equal(t, "mail.example.net", line["source_name"])
+	assert.Equal(t, "2", line["count"])
+	assert.Equal(t, "forwarded: list; local_policy", line["reasons"])
+	assert.Equal(t, "softfail", line["spf_result"])
+
+	_, err = renderCSV(report.Feedback{}, nil, ',')
+	assert.Equal(t, ErrEmptyReport, err)
+}
+
+func TestRenderCSV_Formula(t *testing.T) {
+	r := goodFeedback()
+	r.Metadata.OrgName = "=HYPERLINK(\"http://evil.example\")"
+	r.Metadata.ExtraContactInfo = "@SUM(1+1)"
+	r.Records[0].Identifiers.HeaderFrom = "+keltia.net"
+	r.Records[0].AuthResults.SPF.HumanResult = "-1"
+	r.Records[0].Row.Policy.Reasons = []report.PolicyOverrideReason{{Type: "\tcmd"}}
+
+	txt, err := renderCSV(r, nil, ',')
+	require.NoError(t, err)
+
+	lines, err := csv.NewReader(strings.NewReader(csvHeaderLine(',') + txt)).ReadAll()
+	require.NoError(t, err)
+	line := map[string]string{}
+	for i, col := range lines[0] {
+		line[col] = lines[1][i]
+	}
+	assert.Equal(t, "'=HYPERLINK(\"http://evil.example\")", line["org_name"])
+	assert.Equal(t, "'@SUM(1+1)", line["extra_contact_info"])
+	assert.Equal(t, "'+keltia.net", line["header_from"])
+	assert.Equal(t, "'-1", line["spf_human_result"])
+	assert.Equal(t, "'\tcmd", line["reasons"])
+	assert.Equal(t, "keltia.net", line["domain"])
+}
+
+func TestCheckOutput(t *testing.T) {
+	assert.NoError(t, CheckOutput(OutputCSV))
+	assert.Error(t, CheckOutput("xls"))
+}
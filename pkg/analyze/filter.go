@@ -0,0 +1,411 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/intel/tfortools"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/pkg/errors"
+)
+
+// Group-by keys
+const (
+	GroupIP         = "ip"
+	GroupPTR        = "ptr"
+	GroupASN        = "asn"
+	GroupHeaderFrom = "header_from"
+	GroupReporter   = "reporter"
+)
+
+// groupUnknown is the key of records without one, like an IP without ASN
+const groupUnknown = "unknown"
+
+// FilterConfig selects the records displayed and how to sum them up
+type FilterConfig struct {
+	// OnlyFail keeps records failing DMARC
+	OnlyFail bool
+	// Dispositions keeps records with one of these dispositions
+	Dispositions []string
+	// SourceIPs are networks or addresses records must come from
+	SourceIPs []string
+	// HeaderFrom are domains, subdomains included, of the From: header
+	HeaderFrom []string
+	// GroupBy sums records by one of the Group* keys
+	GroupBy string
+}
+
+// Filter is a compiled FilterConfig, a nil one keeps everything
+type Filter struct {
+	onlyFail     bool
+	dispositions map[string]bool
+	nets         []*net.IPNet
+	domains      []string
+	groupBy      string
+}
+
+// NewFilter checks c and compiles it
+func NewFilter(c FilterConfig) (*Filter, error) {
+	f := &Filter{onlyFail: c.OnlyFail, groupBy: c.GroupBy}
+
+	for _, d := range c.Dispositions {
+		d = strings.ToLower(d)
+		switch d {
+		case "none", "quarantine", "reject":
+		default:
+			return nil, errors.Errorf("unknown disposition %q", d)
+		}
+		if f.dispositions == nil {
+			f.dispositions = map[string]bool{}
+		}
+		f.dispositions[d] = true
+	}
+
+	for _, s := range c.SourceIPs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				s = fmt.Sprintf("%s/%d", s, bits)
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Errorf("bad source IP or network %q", s)
+		}
+		f.nets = append(f.nets, n)
+	}
+
+	for _, d := range c.HeaderFrom {
+		f.domains = append(f.domains, normDomain(d))
+	}
+
+	switch c.GroupBy {
+	case "", GroupIP, GroupPTR, GroupASN, GroupHeaderFrom, GroupReporter:
+	default:
+		return nil, errors.Errorf("unknown group-by key %q", c.GroupBy)
+	}
+	return f, nil
+}
+
+// Active is true if f drops any record
+func (f *Filter) Active() bool {
+	return f != nil && (f.onlyFail || f.dispositions != nil || f.nets != nil || f.domains != nil)
+}
+
+// Grouping is true if records are summed up
+func (f *Filter) Grouping() bool {
+	return f != nil && f.groupBy != ""
+}
+
+// GroupBy is the Group* key records are summed up by, empty if none
+func (f *Filter) GroupBy() string {
+	if f == nil {
+		return ""
+	}
+	return f.groupBy
+}
+
+// Match is true if rec is to be displayed
+func (f *Filter) Match(rec report.Record) bool {
+	if f == nil {
+		return true
+	}
+	if f.onlyFail && rec.Pass() {
+		return false
+	}
+	if f.dispositions != nil && !f.dispositions[strings.ToLower(rec.Row.Policy.Disposition)] {
+		return false
+	}
+
+	if f.nets != nil {
+		found := false
+		for _, n := range f.nets {
+			if n.Contains(rec.Row.SourceIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if f.domains != nil {
+		from := normDomain(rec.Identifiers.HeaderFrom)
+		found := false
+		for _, d := range f.domains {
+			if from == d || strings.HasSuffix(from, "."+d) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply drops the records of r not matching f along with their rows, rows
+// are in the same order as the records.
+func (f *Filter) Apply(r report.Feedback, rows []Entry) (report.Feedback, []Entry) {
+	if !f.Active() {
+		return r, rows
+	}
+
+	var (
+		recs []report.Record
+		kept []Entry
+	)
+	for i, rec := range r.Records {
+		if !f.Match(rec) {
+			continue
+		}
+		recs = append(recs, rec)
+		if i < len(rows) {
+			kept = append(kept, rows[i])
+		}
+	}
+	r.Records = recs
+	return r, kept
+}
+
+// Group is the sum of the records sharing a key
+type Group struct {
+	Key     string `json:"key"`
+	Count   int    `json:"count"`
+	Pass    int    `json:"pass"`
+	Fail    int    `json:"fail"`
+	Records int    `json:"records"`
+	Reports int    `json:"reports"`
+}
+
+// Grouper sums records of one or several reports by key
+type Grouper struct {
+	a      *Analyzer
+	by     string
+	groups map[string]*Group
+	seen   map[string]map[string]bool
+	asns   map[string]string
+	// reports are the reports with records seen so far
+	reports map[string]bool
+}
+
+// NewGrouper sums records by one of the Group* keys, the resolver of a
+// looks ASNs up and groups are rendered by RenderGroups.
+func (a *Analyzer) NewGrouper(by string) *Grouper {
+	return &Grouper{
+		a:       a,
+		by:      by,
+		groups:  map[string]*Group{},
+		seen:    map[string]map[string]bool{},
+		asns:    map[string]string{},
+		reports: map[string]bool{},
+	}
+}
+
+// key returns the group of rec, row is its resolved entry if any
+func (g *Grouper) key(r report.Feedback, rec report.Record, row *Entry) string {
+	ip := rec.Row.SourceIP.String()
+
+	var k string
+	switch g.by {
+	case GroupIP:
+		k = ip
+	case GroupPTR:
+		k = ip
+		if row != nil {
+			k = row.IP
+		}
+	case GroupASN:
+		asn, ok := g.asns[ip]
+		if !ok {
+			// Unknown ASNs are grouped together
+			var err error
+			if asn, err = resolve.ASN(g.a.r, ip); err != nil {
+				g.a.log.Debug("ASN lookup failed", "ip", ip, "error", err)
+			}
+			g.asns[ip] = asn
+		}
+		k = asn
+	case GroupHeaderFrom:
+		k = normDomain(rec.Identifiers.HeaderFrom)
+	case GroupReporter:
+		k = r.Metadata.OrgName
+	}
+
+	if k == "" {
+		return groupUnknown
+	}
+	return k
+}
+
+// Add sums the records of r, rows are in the same order as the records
+func (g *Grouper) Add(r report.Feedback, rows []Entry) {
+	for i, rec := range r.Records {
+		var row Entry
+		if i < len(rows) {
+			row = rows[i]
+		}
+		g.AddRecord(&r, rec, row)
+	}
+}
+
+// AddRecord sums one record of report hdr, row is its resolved entry if
+// any.  It is a RecordFunc so streamed reports can be summed up without
+// keeping their records.
+func (g *Grouper) AddRecord(hdr *report.Feedback, rec report.Record, row Entry) error {
+	var entry *Entry
+	if row.IP != "" {
+		entry = &row
+	}
+	k := g.key(*hdr, rec, entry)
+	id := hdr.Metadata.OrgName + "\xff" + hdr.Metadata.ReportID
+	g.reports[id] = true
+
+	grp, ok := g.groups[k]
+	if !ok {
+		grp = &Group{Key: k}
+		g.groups[k] = grp
+		g.seen[k] = map[string]bool{}
+	}
+	grp.Count += rec.Row.Count
+	grp.Records++
+	if rec.Pass() {
+		grp.Pass += rec.Row.Count
+	} else {
+		grp.Fail += rec.Row.Count
+	}
+	if !g.seen[k][id] {
+		g.seen[k][id] = true
+		grp.Reports++
+	}
+	return nil
+}
+
+// Groups returns the groups, biggest first
+func (g *Grouper) Groups() []Group {
+	list := make([]Group, 0, len(g.groups))
+	for _, grp := range g.groups {
+		list = append(list, *grp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// groupTmpl is the header of grouped text output
+const groupTmpl = `{{.MyName}} {{.MyVersion}}/j{{.Jobs}} by {{.Author}}
+
+Grouped by: {{.By}}
+Reports: {{.Reports}}
+Messages: {{.Messages}}
+
+Groups({{.Count}}):
+`
+
+// groupHeader is the header of grouped CSV and TSV output
+var groupHeader = []string{"group_by", "key", "count", "pass", "fail", "records", "reports"}
+
+// RenderGroups displays the groups of g in the format of a, whole
+// documents including the header for CSV and TSV.
+func (a *Analyzer) RenderGroups(g *Grouper) (string, error) {
+	format := a.opts.Format
+	groups := g.Groups()
+	if len(groups) == 0 {
+		return "", ErrEmptyReport
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case OutputJSON:
+		return a.groupsJSON(g, groups)
+	case OutputCSV, OutputTSV:
+		comma := ','
+		if format == OutputTSV {
+			comma = '\t'
+		}
+		lines := make([][]string, len(groups))
+		for i, grp := range groups {
+			lines[i] = []string{g.by, grp.Key, strconv.Itoa(grp.Count), strconv.Itoa(grp.Pass),
+				strconv.Itoa(grp.Fail), strconv.Itoa(grp.Records), strconv.Itoa(grp.Reports)}
+		}
+		if err := WriteCSV(&buf, comma, groupHeader, lines); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case OutputText:
+		return a.groupsText(&buf, g, groups)
+	}
+	return "", errors.Errorf("group-by is not available with %s output", format)
+}
+
+func (a *Analyzer) groupsText(buf *bytes.Buffer, g *Grouper, groups []Group) (string, error) {
+	messages := 0
+	for _, grp := range groups {
+		messages += grp.Count
+	}
+
+	err := tfortools.OutputToTemplate(buf, "groups", groupTmpl, struct {
+		MyName, MyVersion, Jobs, Author, By string
+		Reports, Messages, Count            int
+	}{
+		MyName:    a.opts.Program.Name,
+		MyVersion: a.opts.Program.Version,
+		Jobs:      strconv.Itoa(a.opts.Jobs),
+		Author:    a.opts.Program.Author,
+		By:        g.by,
+		Reports:   len(g.reports),
+		Messages:  messages,
+		Count:     len(groups),
+	}, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error in template 'groups'")
+	}
+
+	err = tfortools.OutputToTemplate(buf, "rows", `{{ table . }}`, groups, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error in template 'rows'")
+	}
+	return buf.String(), nil
+}
+
+func (a *Analyzer) groupsJSON(g *Grouper, groups []Group) (string, error) {
+	out, err := json.MarshalIndent(struct {
+		APIVersion    string   `json:"apiVersion"`
+		Status        string   `json:"status"`
+		ProcessorMeta jsonMeta `json:"processorMeta"`
+		ReportCount   string   `json:"reportCount"`
+		GroupBy       string   `json:"groupBy"`
+		Groups        []Group  `json:"groups"`
+	}{
+		APIVersion:    "v1",
+		Status:        "success",
+		ProcessorMeta: jsonMeta{a.opts.Program.Name, strconv.Itoa(a.opts.Jobs), a.opts.Program.Version},
+		ReportCount:   strconv.Itoa(len(g.reports)),
+		GroupBy:       g.by,
+		Groups:        groups,
+	}, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "json")
+	}
+	return string(out), nil
+}
+
+// normDomain lowercases d and drops the root dot
+func normDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
@@ -0,0 +1,148 @@
+package analyze
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// asnResolver answers every ASN lookup from a map
+type asnResolver struct {
+	resolve.NullResolver
+	asns map[string]string
+}
+
+func (r asnResolver) LookupASN(addr string) (string, error) {
+	return r.asns[addr], nil
+}
+
+func TestNewFilter_Bad(t *testing.T) {
+	for _, c := range []FilterConfig{
+		{Dispositions: []string{"drop"}},
+		{SourceIPs: []string{"192.0.2.0/33"}},
+		{SourceIPs: []string{"host.example.net"}},
+		{GroupBy: "country"},
+	} {
+		_, err := NewFilter(c)
+		assert.Error(t, err, "%+v", c)
+	}
+}
+
+func TestFilter_Apply(t *testing.T) {
+	r := filterFeedback()
+	rows := []Entry{{IP: "a"}, {IP: "b"}, {IP: "c"}}
+
+	tests := []struct {
+		c    FilterConfig
+		rows []string
+	}{
+		{FilterConfig{}, []string{"a", "b", "c"}},
+		{FilterConfig{OnlyFail: true}, []string{"b", "c"}},
+		{FilterConfig{Dispositions: []string{"Reject"}}, []string{"c"}},
+		{FilterConfig{SourceIPs: []string{"198.51.100.0/24", "2001:db8::1"}}, []string{"b", "c"}},
+		{FilterConfig{SourceIPs: []string{"192.0.2.1"}}, []string{"a"}},
+		{FilterConfig{HeaderFrom: []string{"KELTIA.net."}}, []string{"a", "b"}},
+		{FilterConfig{OnlyFail: true, HeaderFrom: []string{"keltia.net"}}, []string{"b"}},
+		{FilterConfig{Dispositions: []string{"none"}, OnlyFail: true}, nil},
+	}
+	for _, tt := range tests {
+		f, err := NewFilter(tt.c)
+		require.NoError(t, err)
+
+		got, kept := f.Apply(r, rows)
+		var ips []string
+		for _, e := range kept {
+			ips = append(ips, e.IP)
+		}
+		assert.Equal(t, tt.rows, ips, "%+v", tt.c)
+		assert.Len(t, got.Records, len(tt.rows))
+	}
+
+	// No filter, nothing dropped
+	var f *Filter
+	got, _ := f.Apply(r, rows)
+	assert.Len(t, got.Records, 3)
+}
+
+func TestGrouper(t *testing.T) {
+	a := newTestAnalyzer(asnResolver{asns: map[string]string{"192.0.2.1": "AS64496", "198.51.100.7": "AS64496"}}, OutputText)
+	rows := []Entry{{IP: "mx.keltia.net"}, {IP: "mx.keltia.net"}, {IP: "2001:db8::1"}}
+
+	tests := []struct {
+		by   string
+		want []Group
+	}{
+		{GroupASN, []Group{
+			{Key: "AS64496", Count: 5, Pass: 2, Fail: 3, Records: 2, Reports: 1},
+			{Key: groupUnknown, Count: 5, Fail: 5, Records: 1, Reports: 1},
+		}},
+		{GroupPTR, []Group{
+			{Key: "2001:db8::1", Count: 5, Fail: 5, Records: 1, Reports: 1},
+			{Key: "mx.keltia.net", Count: 5, Pass: 2, Fail: 3, Records: 2, Reports: 1},
+		}},
+		{GroupHeaderFrom, []Group{
+			{Key: "example.org", Count: 5, Fail: 5, Records: 1, Reports: 1},
+			{Key: "mail.keltia.net", Count: 3, Fail: 3, Records: 1, Reports: 1},
+			{Key: "keltia.net", Count: 2, Pass: 2, Records: 1, Reports: 1},
+		}},
+	}
+	for _, tt := range tests {
+		g := a.NewGrouper(tt.by)
+		g.Add(filterFeedback(), rows)
+		assert.Equal(t, tt.want, g.Groups(), tt.by)
+	}
+
+	// Summed over reports
+	g := a.NewGrouper(GroupReporter)
+	g.Add(filterFeedback(), nil)
+	other := filterFeedback()
+	other.Metadata.ReportID = "9012"
+	g.Add(other, nil)
+	g.Add(report.Feedback{}, nil)
+	assert.Equal(t, []Group{{Key: "example.net", Count: 20, Pass: 4, Fail: 16, Records: 6, Reports: 2}}, g.Groups())
+}
+
+func TestRenderGroups(t *testing.T) {
+	render := func(g *Grouper, format string) (string, error) {
+		return newTestAnalyzer(nil, format).RenderGroups(g)
+	}
+
+	g := newTestAnalyzer(resolve.NullResolver{}, OutputText).NewGrouper(GroupIP)
+	_, err := render(g, OutputText)
+	assert.Equal(t, ErrEmptyReport, err)
+
+	g.Add(filterFeedback(), nil)
+
+	txt, err := render(g, OutputText)
+	require.NoError(t, err)
+	assert.Contains(t, txt, "Grouped by: ip")
+	assert.Contains(t, txt, "Messages: 10")
+	assert.Contains(t, txt, "2001:db8::1")
+
+	txt, err = render(g, OutputJSON)
+	require.NoError(t, err)
+	var doc struct {
+		GroupBy string
+		Groups  []Group
+	}
+	require.NoError(t, json.Unmarshal([]byte(txt), &doc))
+	assert.Equal(t, GroupIP, doc.GroupBy)
+	require.Len(t, doc.Groups, 3)
+	assert.Equal(t, "2001:db8::1", doc.Groups[0].Key)
+
+	txt, err = render(g, OutputCSV)
+	require.NoError(t, err)
+	lines, err := csv.NewReader(strings.NewReader(txt)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, groupHeader, lines[0])
+	assert.Equal(t, []string{"ip", "2001:db8::1", "5", "0", "5", "1", "1"}, lines[1])
+
+	_, err = render(g, OutputHTML)
+	assert.Error(t, err)
+}
@@ -0,0 +1,282 @@
+package analyze
+
+import (
+	"bytes"
+	"html/template"
+	"sort"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+const (
+	// htmlTopSources is how many sources the bar chart shows
+	htmlTopSources = 10
+
+	// htmlReportTmpl is one report, pages hold one or several of them
+	htmlReportTmpl = `<section class="report">
+<h2>{{.Domain}} <small>by {{.Org}}</small></h2>
+<p class="meta">{{.Email}} &mdash; report {{.ReportID}} &mdash; {{.Begin}} to {{.End}} &mdash; schema {{.Schema}}</p>
+<div class="policy">
+<h3>Published policy</h3>
+<dl>
+<dt>p</dt><dd>{{.Policy.P}}</dd><dt>sp</dt><dd>{{.Policy.SP}}</dd><dt>pct</dt><dd>{{.Policy.Pct}}</dd>
+<dt>adkim</dt><dd>{{.Policy.ADKIM}}</dd><dt>aspf</dt><dd>{{.Policy.ASPF}}</dd><dt>fo</dt><dd>{{.Policy.Fo}}</dd>
+{{- if .Policy.NP}}<dt>np</dt><dd>{{.Policy.NP}}</dd>{{end}}
+{{- if .Policy.PSD}}<dt>psd</dt><dd>{{.Policy.PSD}}</dd>{{end}}
+{{- if .Policy.Testing}}<dt>t</dt><dd>{{.Policy.Testing}}</dd>{{end}}
+</dl>
+</div>
+<div class="cards">
+<div class="card"><span>{{.Messages}}</span>messages</div>
+<div class="card pass"><span>{{.Pass}}</span>pass</div>
+<div class="card fail"><span>{{.Fail}}</span>fail</div>
+<div class="card"><span>{{.Quarantine}}</span>quarantined</div>
+<div class="card"><span>{{.Reject}}</span>rejected</div>
+</div>
+<div class="charts">
+<svg class="donut" viewBox="0 0 42 42" width="160" height="160" role="img" aria-label="{{.PassPct}}% pass">
+<circle cx="21" cy="21" r="15.915" fill="none" stroke="#d9534f" stroke-width="6"></circle>
+<circle cx="21" cy="21" r="15.915" fill="none" stroke="#5cb85c" stroke-width="6" stroke-dasharray="{{.PassPct}} {{.FailPct}}" stroke-dashoffset="25"></circle>
+<text x="21" y="23" text-anchor="middle" font-size="7">{{.PassPct}}%</text>
+</svg>
+<svg class="bars" viewBox="0 0 400 {{.ChartHeight}}" width="400" height="{{.ChartHeight}}" role="img" aria-label="top sources">
+{{- range .Bars}}
+<text x="0" y="{{.TextY}}" font-size="11">{{.Label}}</text>
+<rect x="160" y="{{.Y}}" width="{{.Width}}" height="14" fill="{{if .Pass}}#5cb85c{{else}}#d9534f{{end}}"></rect>
+<text x="{{.CountX}}" y="{{.TextY}}" font-size="11">{{.Count}}</text>
+{{- end}}
+</svg>
+</div>
+<table class="sortable">
+<thead><tr><th>IP</th><th>Name</th><th data-num>Count</th><th>From</th><th>Disposition</th><th>DKIM aligned</th><th>SPF aligned</th><th>DKIM</th><th>SPF</th></tr></thead>
+<tbody>
+{{- range .Sources}}
+<tr class="{{if .Pass}}pass{{else}}fail{{end}}"><td>{{.IP}}</td><td>{{.Name}}</td><td>{{.Count}}</td><td>{{.From}}</td><td>{{.Disposition}}</td><td>{{.DKIMAligned}}</td><td>{{.SPFAligned}}</td><td>{{.DKIM}}</td><td>{{.SPF}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</section>
+`
+
+	// htmlPageTmpl embeds everything, the page is meant to be mailed
+	htmlPageTmpl = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>DMARC report{{if .Title}} - {{.Title}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #333; }
+small, .meta, footer { color: #777; }
+.policy dl { display: grid; grid-template-columns: repeat(6, auto 1fr); gap: .2em .5em; }
+.policy dt { font-weight: bold; }
+.cards { display: flex; gap: 1em; margin: 1em 0; }
+.card { border: 1px solid #ccc; border-radius: 4px; padding: .5em 1em; text-align: center; }
+.card span { display: block; font-size: 1.8em; }
+.card.pass span { color: #3c763d; }
+.card.fail span { color: #a94442; }
+.charts { display: flex; gap: 2em; align-items: center; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ddd; padding: .3em .6em; text-align: left; }
+th { background: #f5f5f5; cursor: pointer; }
+tr.fail td { background: #fbeaea; }
+section { margin-bottom: 3em; }
+</style>
+</head>
+<body>
+<h1>DMARC report{{if .Title}} - {{.Title}}{{end}}</h1>
+{{.Reports}}
+<footer>Generated by {{.MyName}} {{.MyVersion}} on {{.Generated}}</footer>
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th, col) {
+	th.addEventListener("click", function () {
+		var body = th.closest("table").tBodies[0];
+		var num = th.hasAttribute("data-num");
+		var asc = th.dataset.asc !== "true";
+		th.dataset.asc = asc;
+		Array.from(body.rows).sort(function (a, b) {
+			var x = a.cells[col].textContent, y = b.cells[col].textContent;
+			var d = num ? x - y : x.localeCompare(y);
+			return asc ? d : -d;
+		}).forEach(function (tr) { body.appendChild(tr); });
+	});
+});
+</script>
+</body>
+</html>
+`
+)
+
+var (
+	htmlReportT = template.Must(template.New("report").Parse(htmlReportTmpl))
+	htmlPageT   = template.Must(template.New("page").Parse(htmlPageTmpl))
+)
+
+// htmlSource is one line of the sources table
+type htmlSource struct {
+	IP          string
+	Name        string
+	Count       int
+	From        string
+	Disposition string
+	DKIMAligned string
+	SPFAligned  string
+	DKIM        string
+	SPF         string
+	Pass        bool
+}
+
+// htmlBar is one source in the bar chart
+type htmlBar struct {
+	Label  string
+	Count  int
+	Pass   bool
+	Y      int
+	TextY  int
+	Width  int
+	CountX int
+}
+
+// htmlReport is what htmlReportTmpl displays
+type htmlReport struct {
+	Org      string
+	Email    string
+	ReportID string
+	Domain   string
+	Begin    string
+	End      string
+	Schema   string
+	Policy   report.PolicyPublished
+	Stats
+
+	Sources     []htmlSource
+	Bars        []htmlBar
+	ChartHeight int
+}
+
+func htmlDate(t int64) string {
+	return time.Unix(t, 0).UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// newHTMLReport computes the summary of r, rows are the resolved names in
+// the same order as the records if any.
+func newHTMLReport(r report.Feedback, rows []Entry) htmlReport {
+	h := htmlReport{
+		Org:      r.Metadata.OrgName,
+		Email:    r.Metadata.Email,
+		ReportID: r.Metadata.ReportID,
+		Domain:   r.Policy.Domain,
+		Begin:    htmlDate(r.Metadata.Date.Begin),
+		End:      htmlDate(r.Metadata.Date.End),
+		Schema:   r.SchemaVersion(),
+		Policy:   r.Policy,
+		Stats:    NewStats(r),
+	}
+
+	for i, rec := range r.Records {
+		pe := rec.Row.Policy
+		s := htmlSource{
+			IP:          rec.Row.SourceIP.String(),
+			Count:       rec.Row.Count,
+			From:        rec.Identifiers.HeaderFrom,
+			Disposition: pe.Disposition,
+			DKIMAligned: pe.DKIM,
+			SPFAligned:  pe.SPF,
+			DKIM:        rec.AuthResults.DKIM.Result,
+			SPF:         rec.AuthResults.SPF.Result,
+			Pass:        rec.Pass(),
+		}
+		if i < len(rows) && rows[i].IP != s.IP {
+			s.Name = rows[i].IP
+		}
+		h.Sources = append(h.Sources, s)
+	}
+
+	sort.SliceStable(h.Sources, func(i, j int) bool {
+		return h.Sources[i].Count > h.Sources[j].Count
+	})
+	h.Bars, h.ChartHeight = htmlBars(h.Sources)
+	return h
+}
+
+// htmlBars draws the biggest sources, sources are sorted by count
+func htmlBars(sources []htmlSource) ([]htmlBar, int) {
+	const (
+		barHeight = 20
+		maxWidth  = 200
+	)
+
+	if len(sources) > htmlTopSources {
+		sources = sources[:htmlTopSources]
+	}
+
+	var bars []htmlBar
+	for i, s := range sources {
+		label := s.Name
+		if label == "" {
+			label = s.IP
+		}
+		if r := []rune(label); len(r) > 24 {
+			label = string(r[:23]) + "…"
+		}
+
+		width := 1
+		if sources[0].Count > 0 {
+			width = s.Count*maxWidth/sources[0].Count + 1
+		}
+		bars = append(bars, htmlBar{
+			Label:  label,
+			Count:  s.Count,
+			Pass:   s.Pass,
+			Y:      i * barHeight,
+			TextY:  i*barHeight + 11,
+			Width:  width,
+			CountX: 165 + width,
+		})
+	}
+	return bars, len(bars)*barHeight + 2
+}
+
+// RenderHTML returns the section of one report, rows are the resolved
+// names in the same order as the records if any.  See Join for pages.
+func RenderHTML(r report.Feedback, rows []Entry) (string, error) {
+	if len(r.Records) == 0 {
+		return "", ErrEmptyReport
+	}
+
+	var buf bytes.Buffer
+	if err := htmlReportT.Execute(&buf, newHTMLReport(r, rows)); err != nil {
+		return "", errors.Wrap(err, "html report")
+	}
+	return buf.String(), nil
+}
+
+// htmlPage puts report sections rendered by RenderHTML in one page
+func (a *Analyzer) htmlPage(title string, sections []string) (string, error) {
+	var buf bytes.Buffer
+
+	var reports bytes.Buffer
+	for _, s := range sections {
+		reports.WriteString(s)
+	}
+
+	err := htmlPageT.Execute(&buf, struct {
+		Title     string
+		MyName    string
+		MyVersion string
+		Generated string
+		// Sections were escaped by htmlReportT
+		Reports template.HTML
+	}{
+		Title:     title,
+		MyName:    a.opts.Program.Name,
+		MyVersion: a.opts.Program.Version,
+		Generated: time.Now().UTC().Format("2006-01-02 15:04 UTC"),
+		Reports:   template.HTML(reports.String()),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "html page")
+	}
+	return buf.String(), nil
+}
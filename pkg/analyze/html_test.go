@@ -0,0 +1,60 @@
+package analyze
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTMLReport(t *testing.T) {
+	r := goodFeedback()
+	r.Records = append(r.Records, report.Record{
+		Row: report.Row{
+			SourceIP: net.ParseIP("192.0.2.2"),
+			Count:    6,
+			Policy:   report.PolicyEvaluated{Disposition: "quarantine", DKIM: "fail", SPF: "fail"},
+		},
+	})
+
+	h := newHTMLReport(r, []Entry{{IP: "mail.example.net"}})
+	assert.Equal(t, 8, h.Messages)
+	assert.Equal(t, 2, h.Pass)
+	assert.Equal(t, 6, h.Fail)
+	assert.Equal(t, 6, h.Quarantine)
+	assert.Equal(t, 25, h.PassPct)
+	assert.Equal(t, 75, h.FailPct)
+
+	// Biggest source first
+	require.Len(t, h.Sources, 2)
+	assert.Equal(t, "192.0.2.2", h.Sources[0].IP)
+	assert.Equal(t, "mail.example.net", h.Sources[1].Name)
+	require.Len(t, h.Bars, 2)
+	assert.Equal(t, 201, h.Bars[0].Width)
+	assert.Equal(t, "mail.example.net", h.Bars[1].Label)
+}
+
+func TestRenderHTML_Escape(t *testing.T) {
+	r := goodFeedback()
+	r.Metadata.OrgName = `<script>alert("x")</script>`
+
+	section, err := RenderHTML(r, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, section, "<script>")
+	assert.Contains(t, section, "&lt;script&gt;")
+
+	page, err := newTestAnalyzer(nil, OutputHTML).Join("keltia.net", []string{section})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(page, "<!DOCTYPE html>"))
+	assert.Contains(t, page, "<title>DMARC report - keltia.net</title>")
+	assert.Contains(t, page, `<section class="report">`)
+	// Self-contained
+	assert.NotContains(t, page, "http://")
+	assert.NotContains(t, page, "https://")
+
+	_, err = RenderHTML(report.Feedback{}, nil)
+	assert.Equal(t, ErrEmptyReport, err)
+}
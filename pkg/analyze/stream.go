@@ -0,0 +1,101 @@
+package analyze
+
+import (
+	"io"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamBatch is how many rows are resolved at once when streaming
+	streamBatch = 512
+)
+
+// RecordFunc gets every record of a streamed report with its resolved row,
+// hdr is the report header decoded so far.
+type RecordFunc func(hdr *report.Feedback, rec report.Record, row Entry) error
+
+// StreamRecords decodes a report from in and hands every record with its
+// row to fn.  IPs are resolved in batches while decoding so only one batch
+// of records is in memory at once, the XML tree is never built.  Records
+// are validated one by one; violations are returned for the caller to
+// report, in strict mode they are also an error, found once every record
+// was given to fn.
+func (a *Analyzer) StreamRecords(in io.Reader, fn RecordFunc) (report.Feedback, []report.Violation, error) {
+	var (
+		hdr   *report.Feedback
+		batch []Entry
+		recs  []report.Record
+		n     int
+	)
+
+	v, err := report.NewValidator(a.opts.Validate)
+	if err != nil {
+		return report.Feedback{}, nil, err
+	}
+
+	flush := func() error {
+		a.Resolve(batch)
+		for i := range batch {
+			if err := fn(hdr, recs[i], batch[i]); err != nil {
+				return err
+			}
+		}
+		batch, recs = batch[:0], recs[:0]
+		return nil
+	}
+
+	r, err := report.Stream(in, func(h *report.Feedback, rec report.Record) error {
+		v.Record(h, rec)
+		hdr = h
+		n++
+
+		batch = append(batch, NewEntry(rec))
+		recs = append(recs, rec)
+		if len(batch) == streamBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return r, nil, errors.Wrap(err, "stream")
+	}
+	hdr = &r
+	if err := flush(); err != nil {
+		return r, nil, err
+	}
+
+	a.log.Debug("decoded report", "report_id", r.Metadata.ReportID, "records", n)
+
+	list, err := v.Finish(r)
+	if err != nil {
+		return r, list, errors.Wrap(err, "validate")
+	}
+	return r, list, nil
+}
+
+// Stream decodes a report from in like StreamRecords and returns its
+// header and rows, records are only kept in the returned report if keep
+// is set.  Memory grows with the number of records, by one row each and
+// the record itself with keep.
+func (a *Analyzer) Stream(in io.Reader, keep bool) (report.Feedback, []Entry, []report.Violation, error) {
+	var (
+		rows []Entry
+		kept []report.Record
+	)
+
+	r, list, err := a.StreamRecords(in, func(_ *report.Feedback, rec report.Record, row Entry) error {
+		rows = append(rows, row)
+		if keep {
+			kept = append(kept, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return r, nil, list, err
+	}
+
+	r.Records = kept
+	return r, rows, list, nil
+}
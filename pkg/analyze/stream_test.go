@@ -0,0 +1,165 @@
+package analyze
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	a, err := New(Options{NoResolve: true, Jobs: 2})
+	require.NoError(t, err)
+
+	body := bigReport(streamBatch*2 + 3)
+	r, rows, list, err := a.Stream(bytes.NewReader(body), false)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	assert.Empty(t, r.Records)
+	require.Len(t, rows, streamBatch*2+3)
+	assert.Equal(t, "10.0.0.1", rows[0].IP)
+	assert.Equal(t, "10.0.4.3", rows[len(rows)-1].IP)
+
+	r, _, _, err = a.Stream(bytes.NewReader(body), true)
+	require.NoError(t, err)
+	assert.Len(t, r.Records, streamBatch*2+3)
+}
+
+func TestStream_Validate(t *testing.T) {
+	file := "../../testdata/google.com!keltia.net!1538438400!1538524799.xml"
+
+	for mode, fails := range map[string]bool{
+		report.ValidateNone:    false,
+		report.ValidateLenient: false,
+		report.ValidateStrict:  true,
+	} {
+		a, err := New(Options{NoResolve: true, Validate: mode})
+		require.NoError(t, err)
+
+		fh, err := os.Open(file)
+		require.NoError(t, err)
+		_, _, list, err := a.Stream(fh, false)
+		fh.Close()
+
+		assert.Equal(t, fails, err != nil, mode)
+		assert.Equal(t, mode != report.ValidateNone, len(list) > 0, mode)
+	}
+}
+
+func TestStreamRecords(t *testing.T) {
+	a, err := New(Options{NoResolve: true, Jobs: 2})
+	require.NoError(t, err)
+
+	n := 0
+	body := bigReport(streamBatch + 1)
+	r, list, err := a.StreamRecords(bytes.NewReader(body), func(hdr *report.Feedback, rec report.Record, row Entry) error {
+		n++
+		assert.Equal(t, "big", hdr.Metadata.ReportID)
+		assert.Equal(t, n, rec.Row.Count)
+		assert.Equal(t, rec.Row.SourceIP.String(), row.IP)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	assert.Empty(t, r.Records)
+	assert.Equal(t, streamBatch+1, n)
+
+	// Errors of fn stop the stream
+	stop := errors.New("stop")
+	n = 0
+	_, _, err = a.StreamRecords(bytes.NewReader(body), func(*report.Feedback, report.Record, Entry) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, errors.Cause(err))
+	assert.Equal(t, 1, n)
+}
+
+// bigReport generates a valid report with n records
+func bigReport(n int) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <version>1.0</version>
+  <report_metadata>
+    <org_name>example.net</org_name>
+    <email>dmarc@example.net</email>
+    <report_id>big</report_id>
+    <date_range><begin>1538438400</begin><end>1538524799</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>keltia.net</domain><adkim>r</adkim><aspf>r</aspf>
+    <p>none</p><sp>none</sp><pct>100</pct><fo>1</fo>
+  </policy_published>
+`)
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&buf, `  <record>
+    <row>
+      <source_ip>10.0.%d.%d</source_ip>
+      <count>%d</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>pass</spf></policy_evaluated>
+    </row>
+    <identifiers><envelope_from>keltia.net</envelope_from><header_from>keltia.net</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>keltia.net</domain><selector>s1</selector><result>pass</result></dkim>
+      <spf><domain>keltia.net</domain><scope>mfrom</scope><result>pass</result></spf>
+    </auth_results>
+  </record>
+`, i/256, i%256, i)
+	}
+	buf.WriteString("</feedback>\n")
+	return buf.Bytes()
+}
+
+func BenchmarkParse(b *testing.B) {
+	a, _ := New(Options{NoResolve: true, Jobs: 4})
+	body := bigReport(10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := report.Parse(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		a.Rows(r)
+	}
+}
+
+func BenchmarkStream(b *testing.B) {
+	a, _ := New(Options{NoResolve: true, Jobs: 4})
+	body := bigReport(10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := a.Stream(bytes.NewReader(body), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamRecords(b *testing.B) {
+	a, _ := New(Options{NoResolve: true, Jobs: 4, Format: OutputJSON})
+	body := bigReport(10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := a.NewReportWriter(ioutil.Discard)
+		r, _, err := a.StreamRecords(bytes.NewReader(body), rw.Write)
+		if err == nil {
+			err = rw.Close(r)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
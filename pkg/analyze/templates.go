@@ -0,0 +1,132 @@
+package analyze
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// Stats sums the messages of a report
+type Stats struct {
+	Messages   int
+	Pass       int
+	Fail       int
+	None       int
+	Quarantine int
+	Reject     int
+	PassPct    int
+	FailPct    int
+	Sources    int
+}
+
+// NewStats counts the messages of r by result and disposition
+func NewStats(r report.Feedback) Stats {
+	s := Stats{Sources: len(r.Records)}
+
+	for _, rec := range r.Records {
+		n := rec.Row.Count
+		s.Messages += n
+		if rec.Pass() {
+			s.Pass += n
+		} else {
+			s.Fail += n
+		}
+
+		switch rec.Row.Policy.Disposition {
+		case "quarantine":
+			s.Quarantine += n
+		case "reject":
+			s.Reject += n
+		default:
+			s.None += n
+		}
+	}
+
+	if s.Messages > 0 {
+		s.PassPct = s.Pass * 100 / s.Messages
+	}
+	s.FailPct = 100 - s.PassPct
+	return s
+}
+
+// Blocks a user template may define instead of a single body: the header
+// is run once per report with TemplateData and the row once per resolved
+// row with RowData.
+const (
+	TemplateHeader = "header"
+	TemplateRow    = "row"
+)
+
+// TemplateData is what user templates get for every report
+type TemplateData struct {
+	MyName    string
+	MyVersion string
+	// Report is the whole report, records included
+	Report report.Feedback
+	// Rows are the records as displayed by the text output, resolved
+	Rows   []Entry
+	Stats  Stats
+	Schema string
+	Begin  time.Time
+	End    time.Time
+}
+
+// RowData is what the row block of a user template gets for every row
+type RowData struct {
+	Entry
+	// Index counts rows from 0
+	Index  int
+	Report *report.Feedback
+}
+
+// newTemplateData gathers everything about one report
+func (a *Analyzer) newTemplateData(r report.Feedback, rows []Entry) TemplateData {
+	return TemplateData{
+		MyName:    a.opts.Program.Name,
+		MyVersion: a.opts.Program.Version,
+		Report:    r,
+		Rows:      rows,
+		Stats:     NewStats(r),
+		Schema:    r.SchemaVersion(),
+		Begin:     time.Unix(r.Metadata.Date.Begin, 0).UTC(),
+		End:       time.Unix(r.Metadata.Date.End, 0).UTC(),
+	}
+}
+
+// renderTemplate runs the template of a on one report and its resolved
+// rows, or its header and row blocks if it defines any
+func (a *Analyzer) renderTemplate(r report.Feedback, rows []Entry) (string, error) {
+	var buf bytes.Buffer
+
+	t := a.opts.Template
+	if len(r.Records) == 0 {
+		return "", ErrEmptyReport
+	}
+	if t == nil {
+		return "", errors.New("no template loaded")
+	}
+
+	hdr, row := t.Lookup(TemplateHeader), t.Lookup(TemplateRow)
+	if hdr == nil && row == nil {
+		if err := t.Execute(&buf, a.newTemplateData(r, rows)); err != nil {
+			return "", errors.Wrapf(err, "template %s", t.Name())
+		}
+		return buf.String(), nil
+	}
+
+	if hdr != nil {
+		if err := hdr.Execute(&buf, a.newTemplateData(r, rows)); err != nil {
+			return "", errors.Wrapf(err, "template %s", t.Name())
+		}
+	}
+	if row != nil {
+		for i, e := range rows {
+			if err := row.Execute(&buf, RowData{Entry: e, Index: i, Report: &r}); err != nil {
+				return "", errors.Wrapf(err, "template %s", t.Name())
+			}
+		}
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,63 @@
+package analyze
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStats(t *testing.T) {
+	s := NewStats(goodFeedback())
+	assert.Equal(t, 1, s.Sources)
+	assert.Equal(t, 2, s.Messages)
+	assert.Equal(t, 2, s.Pass)
+	assert.Equal(t, 100, s.PassPct)
+	assert.Equal(t, 0, s.FailPct)
+
+	s = NewStats(report.Feedback{})
+	assert.Equal(t, 0, s.Messages)
+	assert.Equal(t, 0, s.PassPct)
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("t").Parse("*{{.Report.Policy.Domain}}* {{.Stats.Messages}} msgs {{.Stats.PassPct}}% pass\n" +
+		"{{range .Rows}}- {{.IP}} {{.Count}}\n{{end}}"))
+
+	a, err := New(Options{NoResolve: true, Format: OutputTemplate, Template: tmpl})
+	require.NoError(t, err)
+
+	r := goodFeedback()
+	txt, err := a.Analyze(r)
+	require.NoError(t, err)
+	assert.Equal(t, "*keltia.net* 2 msgs 100% pass\n- 192.0.2.1 2\n", txt)
+
+	_, err = a.Analyze(report.Feedback{})
+	assert.Equal(t, ErrEmptyReport, err)
+}
+
+func TestRenderTemplate_Blocks(t *testing.T) {
+	tmpl := template.Must(template.New("t").Parse(`{{define "header"}}| {{.Report.Policy.Domain}} | {{.Stats.Messages}} |
+{{end}}{{define "row"}}| {{.Index}} | {{.IP}} | {{.Count}} | {{.Report.Metadata.OrgName}} |
+{{end}}`))
+
+	a, err := New(Options{NoResolve: true, Format: OutputTemplate, Template: tmpl})
+	require.NoError(t, err)
+
+	txt, err := a.Analyze(filterFeedback())
+	require.NoError(t, err)
+	assert.Equal(t, "| keltia.net | 10 |\n"+
+		"| 0 | 192.0.2.1 | 2 | example.net |\n"+
+		"| 1 | 198.51.100.7 | 3 | example.net |\n"+
+		"| 2 | 2001:db8::1 | 5 | example.net |\n", txt)
+
+	// Rows only
+	tmpl = template.Must(template.New("t").Parse(`{{define "row"}}{{.IP}} {{end}}`))
+	a, err = New(Options{NoResolve: true, Format: OutputTemplate, Template: tmpl})
+	require.NoError(t, err)
+	txt, err = a.Analyze(goodFeedback())
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1 ", txt)
+}
@@ -0,0 +1,165 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// ReportWriter renders one report given record by record, see
+// NewReportWriter.
+type ReportWriter struct {
+	a  *Analyzer
+	w  io.Writer
+	n  int
+	cw *csv.Writer
+	// rows and recs are kept for the formats rendered by Close
+	rows []Entry
+	recs []report.Record
+}
+
+// NewReportWriter renders a report to w in the format of a, its records
+// being given by Write in the order of the report.  JSON, CSV and TSV are
+// written as records come, without the CSV header, see Join; text needs
+// every row to sort them, HTML and templates every record, so they are
+// rendered by Close.
+func (a *Analyzer) NewReportWriter(w io.Writer) *ReportWriter {
+	return &ReportWriter{a: a, w: w}
+}
+
+// Write adds one record and its resolved row, hdr is the report header
+func (rw *ReportWriter) Write(hdr *report.Feedback, rec report.Record, row Entry) error {
+	rw.n++
+
+	switch format := rw.a.opts.Format; format {
+	case OutputJSON:
+		if rw.n == 1 {
+			if err := rw.a.writeJSONHead(rw.w, *hdr); err != nil {
+				return err
+			}
+		}
+		return writeJSONEntry(rw.w, rw.n-1, row)
+	case OutputCSV, OutputTSV:
+		if rw.cw == nil {
+			rw.cw = newCSVWriter(rw.w, csvComma(format))
+		}
+		return writeCSVLine(rw.cw, csvLine(*hdr, rec, &row))
+	default:
+		rw.rows = append(rw.rows, row)
+		if NeedsRecords(format) {
+			rw.recs = append(rw.recs, rec)
+		}
+	}
+	return nil
+}
+
+// Close finishes the report, r is its whole header.  Reports without any
+// record are ErrEmptyReport and nothing is written.
+func (rw *ReportWriter) Close(r report.Feedback) error {
+	if rw.n == 0 {
+		return ErrEmptyReport
+	}
+
+	switch rw.a.opts.Format {
+	case OutputJSON:
+		return writeJSONTail(rw.w, rw.n)
+	case OutputCSV, OutputTSV:
+		rw.cw.Flush()
+		return errors.Wrap(rw.cw.Error(), "csv")
+	}
+
+	r.Records = rw.recs
+	txt, err := rw.a.Render(r, rw.rows)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(rw.w, txt)
+	return errors.Wrap(err, "write")
+}
+
+// jsonHead starts the JSON rendering of a report
+type jsonHead struct {
+	APIVersion    string   `json:"apiVersion"`
+	Status        string   `json:"status"`
+	ProcessorMeta jsonMeta `json:"processorMeta"`
+}
+
+// openJSON indents v like json.MarshalIndent with prefix, leaving the
+// object open for more members
+func openJSON(v interface{}, prefix string) ([]byte, error) {
+	buf, err := json.MarshalIndent(v, prefix, "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "json")
+	}
+	return bytes.TrimSuffix(buf, []byte("\n"+prefix+"}")), nil
+}
+
+// writeJSONHead writes the JSON rendering of r up to its entries
+func (a *Analyzer) writeJSONHead(w io.Writer, r report.Feedback) error {
+	v := a.newHeadVars(r, 0)
+
+	head, err := openJSON(jsonHead{
+		APIVersion:    "v1",
+		Status:        "success",
+		ProcessorMeta: jsonMeta{v.MyName, v.Jobs, v.MyVersion},
+	}, "")
+	if err != nil {
+		return err
+	}
+	rep, err := openJSON(jsonReport{
+		Org:       v.Org,
+		Email:     v.Email,
+		DateBegin: v.DateBegin,
+		DateEnd:   v.DateEnd,
+		Domain:    v.Domain,
+		DomainRUA: v.DomainRUA,
+		Schema:    v.Schema,
+		Generator: v.Generator,
+		Policy: jsonPolicy{
+			Disposition:     v.Disposition,
+			DKIM:            v.DKIM,
+			SPF:             v.SPF,
+			NP:              v.NP,
+			PSD:             v.PSD,
+			Testing:         v.Testing,
+			DiscoveryMethod: v.DiscoveryMethod,
+		},
+	}, "\t\t")
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(head)
+	buf.WriteString(",\n\t\"reports\": [\n\t\t")
+	buf.Write(rep)
+	buf.WriteString(",\n\t\t\t\"entries\": [")
+	_, err = w.Write(buf.Bytes())
+	return errors.Wrap(err, "write")
+}
+
+// writeJSONEntry writes entry number i of the report
+func writeJSONEntry(w io.Writer, i int, row Entry) error {
+	buf, err := json.MarshalIndent(row, "\t\t\t\t", "\t")
+	if err != nil {
+		return errors.Wrap(err, "json")
+	}
+
+	sep := ",\n\t\t\t\t"
+	if i == 0 {
+		sep = "\n\t\t\t\t"
+	}
+	_, err = w.Write(append([]byte(sep), buf...))
+	return errors.Wrap(err, "write")
+}
+
+// writeJSONTail closes the JSON rendering of a report of count entries
+func writeJSONTail(w io.Writer, count int) error {
+	_, err := io.WriteString(w, "\n\t\t\t]\n\t\t}\n\t],\n\t\"reportCount\": "+strconv.Quote(strconv.Itoa(count))+"\n}")
+	return errors.Wrap(err, "write")
+}
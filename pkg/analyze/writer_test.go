@@ -0,0 +1,67 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportWriter(t *testing.T) {
+	r := goodFeedback()
+
+	for _, format := range []string{OutputText, OutputJSON, OutputCSV, OutputTSV, OutputHTML} {
+		a := newTestAnalyzer(resolve.NullResolver{}, format)
+		rows := a.Rows(r)
+
+		var buf bytes.Buffer
+		rw := a.NewReportWriter(&buf)
+		for i, rec := range r.Records {
+			require.NoError(t, rw.Write(&r, rec, rows[i]), format)
+		}
+		require.NoError(t, rw.Close(r), format)
+
+		txt, err := a.Render(r, rows)
+		require.NoError(t, err, format)
+		assert.Equal(t, txt, buf.String(), format)
+	}
+}
+
+func TestReportWriter_JSON(t *testing.T) {
+	r := goodFeedback()
+	a := newTestAnalyzer(resolve.NullResolver{}, OutputJSON)
+	rows := a.Rows(r)
+
+	var buf bytes.Buffer
+	rw := a.NewReportWriter(&buf)
+	for i, rec := range r.Records {
+		require.NoError(t, rw.Write(&r, rec, rows[i]))
+	}
+	require.NoError(t, rw.Close(r))
+
+	var out struct {
+		ReportCount string `json:"reportCount"`
+		Reports     []struct {
+			Domain  string  `json:"reportedDomain"`
+			Entries []Entry `json:"entries"`
+		} `json:"reports"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Len(t, out.Reports, 1)
+	assert.Equal(t, "keltia.net", out.Reports[0].Domain)
+	assert.Equal(t, rows, out.Reports[0].Entries)
+	assert.Equal(t, "1", out.ReportCount)
+}
+
+func TestReportWriter_Empty(t *testing.T) {
+	for _, format := range []string{OutputText, OutputJSON, OutputCSV} {
+		var buf bytes.Buffer
+
+		rw := newTestAnalyzer(resolve.NullResolver{}, format).NewReportWriter(&buf)
+		assert.Equal(t, ErrEmptyReport, rw.Close(goodFeedback()), format)
+		assert.Empty(t, buf.String(), format)
+	}
+}
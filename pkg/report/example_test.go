@@ -0,0 +1,80 @@
+package report_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+)
+
+const sample = `<?xml version="1.0" encoding="UTF-8" ?>
+<feedback>
+  <version>1.0</version>
+  <report_metadata>
+    <org_name>example.net</org_name>
+    <email>dmarc@example.net</email>
+    <report_id>1234</report_id>
+    <date_range><begin>1538438400</begin><end>1538524799</end></date_range>
+  </report_metadata>
+  <policy_published>
+    <domain>example.com</domain><adkim>r</adkim><aspf>r</aspf>
+    <p>none</p><sp>none</sp><pct>100</pct>
+  </policy_published>
+  <record>
+    <row>
+      <source_ip>192.0.2.1</source_ip>
+      <count>2</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated>
+    </row>
+    <identifiers><envelope_from>example.com</envelope_from><header_from>example.com</header_from></identifiers>
+    <auth_results>
+      <dkim><domain>example.com</domain><result>pass</result></dkim>
+      <spf><domain>example.com</domain><result>softfail</result></spf>
+    </auth_results>
+  </record>
+</feedback>
+`
+
+func ExampleParse() {
+	r, err := report.Parse(strings.NewReader(sample))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fmt.Println(r.Metadata.OrgName, r.Policy.Domain, r.SchemaVersion())
+	for _, rec := range r.Records {
+		fmt.Println(rec.Row.SourceIP, rec.Row.Count, rec.Pass())
+	}
+	// Output:
+	// example.net example.com rfc7489
+	// 192.0.2.1 2 true
+}
+
+func ExampleStream() {
+	messages := 0
+
+	r, err := report.Stream(strings.NewReader(sample), func(hdr *report.Feedback, rec report.Record) error {
+		messages += rec.Row.Count
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(r.Metadata.ReportID, len(r.Records), messages)
+	// Output: 1234 0 2
+}
+
+func ExampleCheck() {
+	r, _ := report.Parse(strings.NewReader(sample))
+
+	list, err := report.Check(r, report.ValidateLenient)
+	fmt.Println(err)
+	for _, v := range list {
+		fmt.Println(v)
+	}
+	// Output:
+	// <nil>
+	// feedback/policy_published/fo: missing required element
+}
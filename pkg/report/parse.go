@@ -0,0 +1,84 @@
+package report
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Parse decodes a whole aggregate report from r, see Stream for large
+// ones.  Reports are not validated, see Check.
+func Parse(r io.Reader) (Feedback, error) {
+	var report Feedback
+
+	if err := xml.NewDecoder(r).Decode(&report); err != nil {
+		return report, errors.Wrap(err, "unmarshall")
+	}
+	return report, nil
+}
+
+// RecordFunc gets every record of a streamed report along with the report
+// header decoded so far.
+type RecordFunc func(hdr *Feedback, rec Record) error
+
+// Stream decodes an aggregate report token by token and hands every record
+// to fn as soon as it is decoded instead of keeping them all, so memory use
+// does not depend on the number of records.  The returned report has
+// everything but the records.
+func Stream(r io.Reader, fn RecordFunc) (Feedback, error) {
+	var report Feedback
+
+	dec := xml.NewDecoder(r)
+	depth := 0
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, errors.Wrap(err, "token")
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				report.XMLName = t.Name
+				depth++
+				continue
+			}
+
+			// Children of <feedback> are decoded whole, including their end
+			// element, so depth stays at 1.
+			switch t.Name.Local {
+			case "version":
+				err = dec.DecodeElement(&report.Version, &t)
+			case "report_metadata":
+				err = dec.DecodeElement(&report.Metadata, &t)
+			case "policy_published":
+				err = dec.DecodeElement(&report.Policy, &t)
+			case "record":
+				var rec Record
+
+				if err = dec.DecodeElement(&rec, &t); err == nil {
+					if err = fn(&report, rec); err != nil {
+						return report, err
+					}
+				}
+			default:
+				err = dec.Skip()
+			}
+			if err != nil {
+				return report, errors.Wrapf(err, "decode %s", t.Name.Local)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if report.XMLName.Local == "" {
+		return report, errors.Wrap(io.EOF, "no report")
+	}
+	return report, nil
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_DMARCbis(t *testing.T) {
+	fh, err := os.Open("../../testdata/dmarcbis.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	r, err := Parse(fh)
+	require.NoError(t, err)
+
+	assert.Equal(t, SchemaDMARCbis, r.SchemaVersion())
+	assert.Equal(t, "Example DMARC Reporter 2.1", r.Metadata.Generator)
+	assert.Equal(t, "reject", r.Policy.NP)
+	assert.Equal(t, "n", r.Policy.PSD)
+	assert.Equal(t, "treewalk", r.Policy.DiscoveryMethod)
+	assert.Equal(t, "n", r.Policy.Testing)
+	require.Len(t, r.Records, 1)
+	assert.Equal(t, "mfrom", r.Records[0].AuthResults.SPF.Scope)
+	assert.Equal(t, "sender authorized", r.Records[0].AuthResults.SPF.HumanResult)
+	assert.Empty(t, Validate(r))
+}
+
+func TestFeedback_JSON(t *testing.T) {
+	fh, err := os.Open("../../testdata/dmarcbis.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	r, err := Parse(fh)
+	require.NoError(t, err)
+
+	js, err := json.Marshal(r)
+	require.NoError(t, err)
+	assert.NotContains(t, string(js), "XMLName")
+}
+
+func TestParse_Legacy(t *testing.T) {
+	fh, err := os.Open("../../testdata/google.com!keltia.net!1538438400!1538524799.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	r, err := Parse(fh)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaRFC7489, r.SchemaVersion())
+}
+
+func TestParse_Bad(t *testing.T) {
+	_, err := Parse(strings.NewReader("<feedback><version>"))
+	assert.Error(t, err)
+}
+
+func TestStream(t *testing.T) {
+	fh, err := os.Open("../../testdata/dmarcbis.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	var recs []Record
+
+	r, err := Stream(fh, func(hdr *Feedback, rec Record) error {
+		assert.Equal(t, "keltia.net", hdr.Policy.Domain)
+		recs = append(recs, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, SchemaDMARCbis, r.SchemaVersion())
+	assert.Equal(t, "bis-2018-10-02-0001", r.Metadata.ReportID)
+	assert.Empty(t, r.Records)
+	require.Len(t, recs, 1)
+	assert.Equal(t, 3, recs[0].Row.Count)
+}
+
+func TestStream_Same(t *testing.T) {
+	body, err := ioutil.ReadFile("../../testdata/google.com!keltia.net!1538438400!1538524799.xml")
+	require.NoError(t, err)
+
+	want, err := Parse(bytes.NewReader(body))
+	require.NoError(t, err)
+
+	got, err := Stream(bytes.NewReader(body), func(hdr *Feedback, rec Record) error {
+		hdr.Records = append(hdr.Records, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, want, got)
+}
+
+func TestStream_Empty(t *testing.T) {
+	_, err := Stream(strings.NewReader(""), func(*Feedback, Record) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestStream_Truncated(t *testing.T) {
+	in := `<feedback><record><row><source_ip>192.0.2.1</source_ip>`
+	_, err := Stream(strings.NewReader(in), func(*Feedback, Record) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestStream_Abort(t *testing.T) {
+	fh, err := os.Open("../../testdata/dmarcbis.xml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	_, err = Stream(fh, func(*Feedback, Record) error { return fmt.Errorf("stop") })
+	assert.EqualError(t, err, "stop")
+}
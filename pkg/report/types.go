@@ -1,9 +1,22 @@
-package main
+// Package report holds the types of DMARC aggregate reports, RFC 7489 and
+// DMARCbis, and decodes and validates them.
+package report
 
 import (
+	"encoding/xml"
 	"net"
 )
 
+const (
+	// SchemaRFC7489 is the original aggregate report format
+	SchemaRFC7489 = "rfc7489"
+	// SchemaDMARCbis is the DMARCbis aggregate report format
+	SchemaDMARCbis = "dmarcbis"
+
+	// DMARCbisNamespace is the XML namespace of DMARCbis reports
+	DMARCbisNamespace = "urn:ietf:params:xml:ns:dmarc-2.0"
+)
+
 // DateRange time period
 type DateRange struct {
 	Begin int64 `xml:"begin"`
@@ -18,6 +31,7 @@ type ReportMetadata struct {
 	ReportID         string    `xml:"report_id"`
 	Date             DateRange `xml:"date_range"`
 	Errors           []string  `xml:"error"`
+	Generator        string    `xml:"generator"`
 }
 
 // PolicyPublished found in DNS
@@ -29,6 +43,11 @@ type PolicyPublished struct {
 	SP     string `xml:"sp"`
 	Pct    int    `xml:"pct"`
 	Fo     string `xml:"fo"`
+	// DMARCbis only
+	NP              string `xml:"np"`
+	PSD             string `xml:"psd"`
+	DiscoveryMethod string `xml:"discovery_method"`
+	Testing         string `xml:"testing"`
 }
 
 // PolicyEvaluated what was evaluated
@@ -64,6 +83,7 @@ type Identifiers struct {
 type Result struct {
 	Domain      string `xml:"domain"`
 	Selector    string `xml:"selector"`
+	Scope       string `xml:"scope"`
 	Result      string `xml:"result"`
 	HumanResult string `xml:"human_result"`
 }
@@ -81,10 +101,31 @@ type Record struct {
 	AuthResults AuthResults `xml:"auth_results"`
 }
 
+// Pass is true if aligned DKIM or SPF passed, which is what DMARC checks
+func (rec Record) Pass() bool {
+	return rec.Row.Policy.DKIM == "pass" || rec.Row.Policy.SPF == "pass"
+}
+
 // Feedback the report itself
 type Feedback struct {
+	XMLName  xml.Name        `json:"-"`
 	Version  float32         `xml:"version"`
 	Metadata ReportMetadata  `xml:"report_metadata"`
 	Policy   PolicyPublished `xml:"policy_published"`
 	Records  []Record        `xml:"record"`
 }
+
+// SchemaVersion tells whether this is a legacy or a DMARCbis report, either
+// from the namespace or from the presence of DMARCbis-only elements.
+func (r Feedback) SchemaVersion() string {
+	if r.XMLName.Space == DMARCbisNamespace {
+		return SchemaDMARCbis
+	}
+
+	p := r.Policy
+	if p.NP != "" || p.PSD != "" || p.DiscoveryMethod != "" || p.Testing != "" ||
+		r.Metadata.Generator != "" {
+		return SchemaDMARCbis
+	}
+	return SchemaRFC7489
+}
@@ -0,0 +1,279 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ValidateNone skips validation entirely
+	ValidateNone = "none"
+	// ValidateLenient reports violations but keeps the report
+	ValidateLenient = "lenient"
+	// ValidateStrict rejects reports with any violation
+	ValidateStrict = "strict"
+)
+
+// Enumerations from dmarc.xsd
+var (
+	alignmentValues   = []string{"r", "s"}
+	dispositionValues = []string{"none", "quarantine", "reject"}
+	dmarcResultValues = []string{"pass", "fail"}
+	overrideValues    = []string{"forwarded", "sampled_out", "trusted_forwarder", "mailing_list", "local_policy", "other"}
+	dkimResultValues  = []string{"none", "pass", "fail", "policy", "neutral", "temperror", "permerror"}
+	spfResultValues   = []string{"none", "neutral", "pass", "fail", "softfail", "temperror", "permerror"}
+	spfScopeValues    = []string{"helo", "mfrom"}
+
+	// DMARCbis additions
+	bisOverrideValues = []string{"local_policy", "mailing_list", "other", "policy_test_mode", "trusted_forwarder"}
+	bisSPFScopeValues = []string{"mfrom"}
+	psdValues         = []string{"y", "n", "u"}
+	discoveryValues   = []string{"psl", "treewalk"}
+	testingValues     = []string{"n", "y"}
+)
+
+// Violation is one schema rule broken by a report
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+// ValidationError is returned in strict mode
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	list := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		list[i] = v.String()
+	}
+	return fmt.Sprintf("invalid report (%d violations): %s", len(list), strings.Join(list, "; "))
+}
+
+// validator accumulates violations
+type validator struct {
+	bis  bool
+	list []Violation
+}
+
+func (v *validator) add(path, format string, a ...interface{}) {
+	v.list = append(v.list, Violation{Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// required checks a mandatory string element
+func (v *validator) required(path, val string) bool {
+	if strings.TrimSpace(val) == "" {
+		v.add(path, "missing required element")
+		return false
+	}
+	return true
+}
+
+// enum checks val is one of the allowed values, empty is skipped
+func (v *validator) enum(path, val string, allowed []string) {
+	if val == "" {
+		return
+	}
+	for _, a := range allowed {
+		if val == a {
+			return
+		}
+	}
+	v.add(path, "invalid value %q, expected one of %s", val, strings.Join(allowed, "|"))
+}
+
+// Validate checks a report against the rules of dmarc.xsd and returns
+// every violation found.
+func Validate(r Feedback) []Violation {
+	v := &validator{bis: r.SchemaVersion() == SchemaDMARCbis}
+
+	validateHeader(v, r)
+
+	// record
+	if len(r.Records) == 0 {
+		v.add("feedback/record", "at least one record is required")
+	}
+	for i, rec := range r.Records {
+		validateRecord(v, fmt.Sprintf("feedback/record[%d]", i+1), rec)
+	}
+
+	return v.list
+}
+
+// validateHeader checks everything but the records
+func validateHeader(v *validator, r Feedback) {
+	if r.Version <= 0 {
+		v.add("feedback/version", "missing required element")
+	}
+
+	// report_metadata
+	md := "feedback/report_metadata"
+	v.required(md+"/org_name", r.Metadata.OrgName)
+	v.required(md+"/email", r.Metadata.Email)
+	v.required(md+"/report_id", r.Metadata.ReportID)
+	if r.Metadata.Date.Begin <= 0 {
+		v.add(md+"/date_range/begin", "missing or negative timestamp")
+	}
+	if r.Metadata.Date.End <= 0 {
+		v.add(md+"/date_range/end", "missing or negative timestamp")
+	}
+	if r.Metadata.Date.Begin > r.Metadata.Date.End {
+		v.add(md+"/date_range", "begin %d is after end %d", r.Metadata.Date.Begin, r.Metadata.Date.End)
+	}
+
+	// policy_published
+	pp := "feedback/policy_published"
+	v.required(pp+"/domain", r.Policy.Domain)
+	v.enum(pp+"/adkim", r.Policy.ADKIM, alignmentValues)
+	v.enum(pp+"/aspf", r.Policy.ASPF, alignmentValues)
+	if v.required(pp+"/p", r.Policy.P) {
+		v.enum(pp+"/p", r.Policy.P, dispositionValues)
+	}
+	if r.Policy.Pct < 0 || r.Policy.Pct > 100 {
+		v.add(pp+"/pct", "%d is not between 0 and 100", r.Policy.Pct)
+	}
+	if v.bis {
+		// sp and fo became optional, pct is replaced by testing
+		v.enum(pp+"/sp", r.Policy.SP, dispositionValues)
+		v.enum(pp+"/np", r.Policy.NP, dispositionValues)
+		v.enum(pp+"/psd", r.Policy.PSD, psdValues)
+		v.enum(pp+"/discovery_method", r.Policy.DiscoveryMethod, discoveryValues)
+		v.enum(pp+"/testing", r.Policy.Testing, testingValues)
+	} else {
+		if v.required(pp+"/sp", r.Policy.SP) {
+			v.enum(pp+"/sp", r.Policy.SP, dispositionValues)
+		}
+		v.required(pp+"/fo", r.Policy.Fo)
+	}
+}
+
+// validateRecord checks one record
+func validateRecord(v *validator, path string, rec Record) {
+	row := path + "/row"
+	if rec.Row.SourceIP == nil {
+		v.add(row+"/source_ip", "missing required element")
+	}
+	if rec.Row.Count < 0 {
+		v.add(row+"/count", "%d is negative", rec.Row.Count)
+	}
+
+	pe := row + "/policy_evaluated"
+	if v.required(pe+"/disposition", rec.Row.Policy.Disposition) {
+		v.enum(pe+"/disposition", rec.Row.Policy.Disposition, dispositionValues)
+	}
+	if v.required(pe+"/dkim", rec.Row.Policy.DKIM) {
+		v.enum(pe+"/dkim", rec.Row.Policy.DKIM, dmarcResultValues)
+	}
+	if v.required(pe+"/spf", rec.Row.Policy.SPF) {
+		v.enum(pe+"/spf", rec.Row.Policy.SPF, dmarcResultValues)
+	}
+	reasons, scopes := overrideValues, spfScopeValues
+	if v.bis {
+		reasons, scopes = bisOverrideValues, bisSPFScopeValues
+	}
+	for j, reason := range rec.Row.Policy.Reasons {
+		rp := fmt.Sprintf("%s/reason[%d]/type", pe, j+1)
+		if v.required(rp, reason.Type) {
+			v.enum(rp, reason.Type, reasons)
+		}
+	}
+
+	id := path + "/identifiers"
+	v.required(id+"/envelope_from", rec.Identifiers.EnvelopeFrom)
+	v.required(id+"/header_from", rec.Identifiers.HeaderFrom)
+
+	ar := path + "/auth_results"
+	// DKIM is optional but must be complete when present
+	dkim := rec.AuthResults.DKIM
+	if dkim != (Result{}) {
+		v.required(ar+"/dkim/domain", dkim.Domain)
+		if v.required(ar+"/dkim/result", dkim.Result) {
+			v.enum(ar+"/dkim/result", dkim.Result, dkimResultValues)
+		}
+	}
+	// There will always be at least one SPF result
+	spf := rec.AuthResults.SPF
+	v.required(ar+"/spf/domain", spf.Domain)
+	v.enum(ar+"/spf/scope", spf.Scope, scopes)
+	if v.required(ar+"/spf/result", spf.Result) {
+		v.enum(ar+"/spf/result", spf.Result, spfResultValues)
+	}
+}
+
+// CheckMode makes sure mode is one of the Validate* modes
+func CheckMode(mode string) error {
+	switch mode {
+	case ValidateNone, ValidateLenient, ValidateStrict:
+		return nil
+	}
+	return errors.Errorf("unknown validation mode %s", mode)
+}
+
+// Check validates r in mode and returns the violations found, nothing is
+// checked with ValidateNone.  Violations are only an error, a
+// *ValidationError, with ValidateStrict.
+func Check(r Feedback, mode string) ([]Violation, error) {
+	if mode == ValidateNone {
+		return nil, nil
+	}
+
+	list := Validate(r)
+	return list, enforce(mode, list)
+}
+
+// enforce turns violations into an error in strict mode
+func enforce(mode string, list []Violation) error {
+	if len(list) > 0 && mode == ValidateStrict {
+		return &ValidationError{Violations: list}
+	}
+	return nil
+}
+
+// Validator checks a streamed report, see Stream, one record at a time
+// then its header once fully decoded.
+type Validator struct {
+	mode string
+	n    int
+	v    validator
+}
+
+// NewValidator returns a validator in one of the Validate* modes
+func NewValidator(mode string) (*Validator, error) {
+	if err := CheckMode(mode); err != nil {
+		return nil, err
+	}
+	return &Validator{mode: mode}, nil
+}
+
+// Record checks the next record of the report whose header is hdr
+func (sv *Validator) Record(hdr *Feedback, rec Record) {
+	sv.n++
+	if sv.mode == ValidateNone {
+		return
+	}
+	sv.v.bis = hdr.SchemaVersion() == SchemaDMARCbis
+	validateRecord(&sv.v, fmt.Sprintf("feedback/record[%d]", sv.n), rec)
+}
+
+// Finish checks the header of r and returns the violations found, like
+// Check does.
+func (sv *Validator) Finish(r Feedback) ([]Violation, error) {
+	if sv.mode == ValidateNone {
+		return nil, nil
+	}
+
+	v := &sv.v
+	v.bis = r.SchemaVersion() == SchemaDMARCbis
+	validateHeader(v, r)
+	if sv.n == 0 {
+		v.add("feedback/record", "at least one record is required")
+	}
+	return v.list, enforce(sv.mode, v.list)
+}
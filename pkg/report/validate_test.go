@@ -0,0 +1,124 @@
+package report
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// goodFeedback is a valid report with one record
+func goodFeedback() Feedback {
+	fh, err := os.Open("../../testdata/good.xml")
+	if err != nil {
+		panic(err)
+	}
+	defer fh.Close()
+
+	r, err := Parse(fh)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestValidate_Good(t *testing.T) {
+	assert.Empty(t, Validate(goodFeedback()))
+}
+
+func TestValidate_Empty(t *testing.T) {
+	list := Validate(Feedback{})
+	assert.NotEmpty(t, list)
+}
+
+func TestValidate_Bad(t *testing.T) {
+	r := goodFeedback()
+	r.Metadata.ReportID = ""
+	r.Policy.P = "discard"
+	r.Policy.Pct = 120
+	r.Records[0].Row.Policy.Disposition = "drop"
+	r.Records[0].AuthResults.SPF.Result = "maybe"
+
+	list := Validate(r)
+	require.Len(t, list, 5)
+	assert.Equal(t, "feedback/report_metadata/report_id", list[0].Path)
+	assert.Equal(t, "feedback/policy_published/p", list[1].Path)
+	assert.Equal(t, "feedback/policy_published/pct", list[2].Path)
+	assert.Equal(t, "feedback/record[1]/row/policy_evaluated/disposition", list[3].Path)
+	assert.Equal(t, "feedback/record[1]/auth_results/spf/result", list[4].Path)
+}
+
+func TestValidate_File(t *testing.T) {
+	body, err := ioutil.ReadFile("../../testdata/google.com!keltia.net!1538438400!1538524799.xml")
+	require.NoError(t, err)
+
+	r, err := Parse(bytes.NewReader(body))
+	require.NoError(t, err)
+
+	// No version, no fo and no envelope_from
+	list := Validate(r)
+	assert.Len(t, list, 4)
+}
+
+func TestCheck(t *testing.T) {
+	r := goodFeedback()
+	r.Policy.P = ""
+
+	list, err := Check(r, ValidateNone)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	list, err = Check(r, ValidateLenient)
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	_, err = Check(r, ValidateStrict)
+	require.Error(t, err)
+	assert.IsType(t, (*ValidationError)(nil), err)
+	assert.Contains(t, err.Error(), "policy_published/p")
+
+	_, err = Check(goodFeedback(), ValidateStrict)
+	assert.NoError(t, err)
+}
+
+func TestValidator(t *testing.T) {
+	r := goodFeedback()
+	r.Records[0].Row.Policy.Disposition = "drop"
+
+	_, err := NewValidator("paranoid")
+	assert.Error(t, err)
+
+	v, err := NewValidator(ValidateStrict)
+	require.NoError(t, err)
+	for _, rec := range r.Records {
+		v.Record(&r, rec)
+	}
+	list, err := v.Finish(r)
+	assert.Error(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "feedback/record[1]/row/policy_evaluated/disposition", list[0].Path)
+
+	v, err = NewValidator(ValidateLenient)
+	require.NoError(t, err)
+	list, err = v.Finish(r)
+	assert.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "feedback/record", list[0].Path)
+}
+
+func TestValidate_DMARCbis(t *testing.T) {
+	r := goodFeedback()
+	r.XMLName.Space = DMARCbisNamespace
+	r.Policy.SP = ""
+	r.Policy.Fo = ""
+	assert.Empty(t, Validate(r))
+
+	r.Policy.NP = "discard"
+	r.Policy.Testing = "maybe"
+	r.Records[0].AuthResults.SPF.Scope = "helo"
+	list := Validate(r)
+	assert.Len(t, list, 3)
+}
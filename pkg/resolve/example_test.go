@@ -0,0 +1,25 @@
+package resolve_test
+
+import (
+	"fmt"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+)
+
+// static is a Resolver answering from a map
+type static map[string]string
+
+func (s static) LookupAddr(addr string) ([]string, error) {
+	if name, ok := s[addr]; ok {
+		return []string{name}, nil
+	}
+	return nil, fmt.Errorf("no name for %s", addr)
+}
+
+func ExampleParallel() {
+	r := static{"192.0.2.1": "mail.example.com."}
+
+	names := resolve.Parallel(r, 4, []string{"192.0.2.1", "192.0.2.2"})
+	fmt.Println(names)
+	// Output: [mail.example.com. 192.0.2.2]
+}
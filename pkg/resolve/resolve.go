@@ -0,0 +1,153 @@
+// Package resolve looks up the names and autonomous systems of the IPs
+// found in reports.
+package resolve
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Resolver is the main interface we use
+type Resolver interface {
+	LookupAddr(addr string) ([]string, error)
+}
+
+// NullResolver is empty
+type NullResolver struct{}
+
+// LookupAddr always return a good and fixed answer
+func (NullResolver) LookupAddr(addr string) ([]string, error) {
+	return []string{addr}, nil
+}
+
+// RealResolver will call the real one
+type RealResolver struct{}
+
+// LookupAddr use the real "net" function
+func (r RealResolver) LookupAddr(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
+
+// ASNResolver is a Resolver also able to find the autonomous system of
+// an IP
+type ASNResolver interface {
+	LookupASN(addr string) (string, error)
+}
+
+// ErrNoASN is returned by ASN for resolvers unable to find ASNs
+var ErrNoASN = errors.New("no ASN resolver")
+
+// ASN returns the AS of addr like "AS64496" if r is also an ASNResolver
+func ASN(r Resolver, addr string) (string, error) {
+	ar, ok := r.(ASNResolver)
+	if !ok {
+		return "", ErrNoASN
+	}
+	return ar.LookupASN(addr)
+}
+
+// TXTResolver is a Resolver also able to fetch TXT records, like the DMARC
+// record of a domain
+type TXTResolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// ErrNoTXT is returned by TXT for resolvers unable to fetch TXT records
+var ErrNoTXT = errors.New("no TXT resolver")
+
+// TXT returns the TXT records of name if r is also a TXTResolver
+func TXT(r Resolver, name string) ([]string, error) {
+	tr, ok := r.(TXTResolver)
+	if !ok {
+		return nil, ErrNoTXT
+	}
+	return tr.LookupTXT(name)
+}
+
+// LookupTXT use the real "net" function
+func (r RealResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+// Parallel looks the names of addrs up with jobs lookups at a time and
+// returns them in the same order, addresses without a name are kept.
+func Parallel(r Resolver, jobs int, addrs []string) []string {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	names := make([]string, len(addrs))
+
+	wg := &sync.WaitGroup{}
+	queue := make(chan int, jobs)
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// Every worker writes its own indices
+			for ind := range queue {
+				names[ind] = addrs[ind]
+				if list, err := r.LookupAddr(addrs[ind]); err == nil && len(list) > 0 {
+					names[ind] = list[0]
+				}
+			}
+		}()
+	}
+
+	for i := range addrs {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return names
+}
+
+// cymruName is the Team Cymru IP to ASN DNS name for ip
+func cymruName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.origin.asn.cymru.com", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hex = "0123456789abcdef"
+
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("origin6.asn.cymru.com")
+	return b.String()
+}
+
+// LookupASN asks Team Cymru, answers look like
+// "64496 | 192.0.2.0/24 | ZZ | arin | 2006-01-02"
+func (r RealResolver) LookupASN(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", errors.Errorf("bad IP %q", addr)
+	}
+
+	txt, err := net.LookupTXT(cymruName(ip))
+	if err != nil {
+		return "", err
+	}
+	for _, t := range txt {
+		// Several origins are space-separated, keep the first
+		fields := strings.Fields(strings.SplitN(t, "|", 2)[0])
+		if len(fields) > 0 {
+			return "AS" + fields[0], nil
+		}
+	}
+	return "", errors.Errorf("no ASN for %s", addr)
+}
@@ -0,0 +1,72 @@
+package resolve
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNullResolver_LookupAddr(t *testing.T) {
+	var r NullResolver
+
+	resp, err := r.LookupAddr("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, resp)
+}
+
+func TestRealResolver_LookupAddr(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs the network")
+	}
+
+	var r RealResolver
+
+	resp, err := r.LookupAddr("8.8.8.8")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dns.google."}, resp)
+}
+
+func TestCymruName(t *testing.T) {
+	assert.Equal(t, "1.2.0.192.origin.asn.cymru.com", cymruName(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com",
+		cymruName(net.ParseIP("2001:db8::1")))
+}
+
+func TestASN_Null(t *testing.T) {
+	asn, err := ASN(NullResolver{}, "192.0.2.1")
+	assert.Equal(t, ErrNoASN, err)
+	assert.Empty(t, asn)
+}
+
+func TestTXT_Null(t *testing.T) {
+	txt, err := TXT(NullResolver{}, "_dmarc.example.com")
+	assert.Equal(t, ErrNoTXT, err)
+	assert.Empty(t, txt)
+}
+
+type errResolver struct{}
+
+func (errResolver) LookupAddr(ip string) ([]string, error) {
+	return []string{"BAD"}, fmt.Errorf("fake error")
+}
+
+type fakeResolver map[string]string
+
+func (f fakeResolver) LookupAddr(ip string) ([]string, error) {
+	return []string{f[ip]}, nil
+}
+
+func TestParallel_Error(t *testing.T) {
+	td := []string{"8.8.8.8", "8.8.4.4"}
+	assert.Equal(t, td, Parallel(errResolver{}, 1, td))
+}
+
+func TestParallel_Good(t *testing.T) {
+	r := fakeResolver{"8.8.8.8": "dns.google.", "8.8.4.4": "dns.google.", "192.0.2.1": "a.example."}
+
+	td := []string{"8.8.8.8", "192.0.2.1", "8.8.4.4"}
+	assert.Equal(t, []string{"dns.google.", "a.example.", "dns.google."}, Parallel(r, 2, td))
+	assert.Empty(t, Parallel(r, 0, nil))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/intel/tfortools"
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
+)
+
+// StoreQuery selects stored aggregate reports
+type StoreQuery struct {
+	// Domain is the policy domain, subdomains included
+	Domain string
+	Tenant string
+	// Org is the reporting organization
+	Org string
+}
+
+var (
+	fQuery StoreQuery
+	// fExportOut is where export writes, stdout if empty
+	fExportOut string
+)
+
+func queryFlags(fs *flag.FlagSet) {
+	fs.StringVar(&fQuery.Domain, "domain", "", "Only reports about this domain or its subdomains")
+	fs.StringVar(&fQuery.Tenant, "tenant", "", "Only reports of this tenant")
+	fs.StringVar(&fQuery.Org, "org", "", "Only reports sent by this organization")
+}
+
+func exportFlags(fs *flag.FlagSet) {
+	queryFlags(fs)
+	fs.StringVar(&fExportOut, "out", "", "File to write to instead of the standard output")
+}
+
+// match is true if sf is selected by q
+func (q StoreQuery) match(sf StoredFeedback) bool {
+	if q.Tenant != "" && sf.Tenant != q.Tenant {
+		return false
+	}
+	if q.Org != "" && sf.Report.Metadata.OrgName != q.Org {
+		return false
+	}
+	if q.Domain != "" {
+		d, want := normDomain(sf.Report.Policy.Domain), normDomain(q.Domain)
+		if d != want && !strings.HasSuffix(d, "."+want) {
+			return false
+		}
+	}
+	return true
+}
+
+// openQueryStore opens -store, which must already exist
+func openQueryStore() (Store, error) {
+	if fStore == "" {
+		return nil, errors.New("-store is required")
+	}
+	if _, err := os.Stat(fStore); err != nil {
+		return nil, errors.Wrap(err, "store")
+	}
+	return NewFileStore(fStore)
+}
+
+// queryStore returns the reports of s selected by q with the records kept
+// by f, reports left without any record are dropped.
+func queryStore(s Store, q StoreQuery, f *analyze.Filter) ([]StoredFeedback, error) {
+	all, err := s.Feedbacks()
+	if err != nil {
+		return nil, errors.Wrap(err, "store")
+	}
+
+	var list []StoredFeedback
+	for _, sf := range all {
+		if !q.match(sf) {
+			continue
+		}
+		sf.Report, _ = f.Apply(sf.Report, nil)
+		if len(sf.Report.Records) == 0 {
+			continue
+		}
+		list = append(list, sf)
+	}
+	return list, nil
+}
+
+// querySummary is one line of store query
+type querySummary struct {
+	ID       string
+	Tenant   string
+	Org      string
+	ReportID string
+	Domain   string
+	Begin    string
+	End      string
+	Records  int
+	Messages int
+	Pass     int
+	Fail     int
+}
+
+// queryHeader is the header of store query as CSV or TSV
+var queryHeader = []string{"id", "tenant", "org_name", "report_id", "domain", "date_begin", "date_end",
+	"records", "messages", "pass", "fail"}
+
+func newQuerySummary(sf StoredFeedback) querySummary {
+	r := sf.Report
+	st := analyze.NewStats(r)
+	return querySummary{
+		ID:       sf.ID,
+		Tenant:   sf.Tenant,
+		Org:      r.Metadata.OrgName,
+		ReportID: r.Metadata.ReportID,
+		Domain:   r.Policy.Domain,
+		Begin:    analyze.CSVDate(r.Metadata.Date.Begin),
+		End:      analyze.CSVDate(r.Metadata.Date.End),
+		Records:  st.Sources,
+		Messages: st.Messages,
+		Pass:     st.Pass,
+		Fail:     st.Fail,
+	}
+}
+
+// renderQuery lists reports, in full for JSON and summed up otherwise
+func renderQuery(format string, list []StoredFeedback) (string, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case analyze.OutputJSON:
+		if list == nil {
+			list = []StoredFeedback{}
+		}
+		out, err := json.MarshalIndent(list, "", "\t")
+		if err != nil {
+			return "", errors.Wrap(err, "json")
+		}
+		return string(out) + "\n", nil
+	case analyze.OutputCSV, analyze.OutputTSV:
+		comma := ','
+		if format == analyze.OutputTSV {
+			comma = '\t'
+		}
+		lines := make([][]string, len(list))
+		for i, sf := range list {
+			s := newQuerySummary(sf)
+			lines[i] = []string{s.ID, s.Tenant, s.Org, s.ReportID, s.Domain, s.Begin, s.End,
+				strconv.Itoa(s.Records), strconv.Itoa(s.Messages), strconv.Itoa(s.Pass), strconv.Itoa(s.Fail)}
+		}
+		if err := analyze.WriteCSV(&buf, comma, queryHeader, lines); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case analyze.OutputText:
+		if len(list) == 0 {
+			return "No report\n", nil
+		}
+		lines := make([]querySummary, len(list))
+		for i, sf := range list {
+			lines[i] = newQuerySummary(sf)
+		}
+		if err := tfortools.OutputToTemplate(&buf, "query", `{{ table . }}`, lines, nil); err != nil {
+			return "", errors.Wrap(err, "error in template 'query'")
+		}
+		return buf.String(), nil
+	}
+	return "", errors.Errorf("store query does not support -o %s", format)
+}
+
+// runStoreQuery is store query
+func runStoreQuery(args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("store query takes no argument, got %q", args)
+	}
+
+	ctx, err := setupCommand()
+	if err != nil {
+		return err
+	}
+	s, err := openQueryStore()
+	if err != nil {
+		return err
+	}
+
+	list, err := queryStore(s, fQuery, ctx.opts.Filter)
+	if err != nil {
+		return err
+	}
+	txt, err := renderQuery(ctx.opts.Format, list)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(stdout, txt)
+	return nil
+}
+
+// Export renders the reports of list like analyze does
+func Export(ctx *Context, list []StoredFeedback) (string, error) {
+	a := ctx.a
+
+	if ctx.opts.Filter.Grouping() {
+		g := a.NewGrouper(ctx.opts.Filter.GroupBy())
+		for _, sf := range list {
+			g.Add(sf.Report, a.Rows(sf.Report))
+		}
+		txt, err := a.RenderGroups(g)
+		if err == analyze.ErrEmptyReport {
+			return "", nil
+		}
+		return txt, err
+	}
+
+	var out []string
+	for _, sf := range list {
+		txt, err := a.Render(sf.Report, a.Rows(sf.Report))
+		if err != nil {
+			return "", errors.Wrapf(err, "report %s", sf.ID)
+		}
+		out = append(out, txt)
+	}
+	return a.Join("stored reports", out)
+}
+
+// runExport is export
+func runExport(args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("export takes no argument, got %q", args)
+	}
+
+	ctx, err := setupCommand()
+	if err != nil {
+		return err
+	}
+	s, err := openQueryStore()
+	if err != nil {
+		return err
+	}
+
+	list, err := queryStore(s, fQuery, ctx.opts.Filter)
+	if err != nil {
+		return err
+	}
+	txt, err := Export(ctx, list)
+	if err != nil {
+		return err
+	}
+	if format := ctx.opts.Format; !analyze.IsTable(format) && format != analyze.OutputHTML && txt != "" {
+		txt += "\n"
+	}
+
+	if fExportOut != "" {
+		return errors.Wrap(ioutil.WriteFile(fExportOut, []byte(txt), 0644), "export")
+	}
+	fmt.Fprint(stdout, txt)
+	return nil
+}
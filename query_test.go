@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/resolve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreQuery_Match(t *testing.T) {
+	sf := StoredFeedback{Tenant: "acme", Report: goodFeedback()}
+
+	assert.True(t, StoreQuery{}.match(sf))
+	assert.True(t, StoreQuery{Domain: "KELTIA.net", Tenant: "acme", Org: "example.net"}.match(sf))
+	assert.False(t, StoreQuery{Domain: "eltia.net"}.match(sf))
+	assert.False(t, StoreQuery{Tenant: "other"}.match(sf))
+
+	sf.Report.Policy.Domain = "mail.keltia.net"
+	assert.True(t, StoreQuery{Domain: "keltia.net"}.match(sf))
+}
+
+func TestQueryStore(t *testing.T) {
+	s := NewMemStore()
+	s.AddFeedback("", goodFeedback())
+	s.AddFeedback("", filterFeedback())
+
+	list, err := queryStore(s, StoreQuery{}, nil)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	// Only filterFeedback has failures
+	f, err := analyze.NewFilter(analyze.FilterConfig{OnlyFail: true})
+	require.NoError(t, err)
+	list, err = queryStore(s, StoreQuery{}, f)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Len(t, list[0].Report.Records, 2)
+
+	txt, err := renderQuery(analyze.OutputCSV, list)
+	require.NoError(t, err)
+	lines, err := csv.NewReader(strings.NewReader(txt)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, queryHeader, lines[0])
+	assert.Equal(t, []string{"2", "8", "0", "8"}, lines[1][7:])
+
+	txt, err = renderQuery(analyze.OutputText, list)
+	require.NoError(t, err)
+	assert.Contains(t, txt, "keltia.net")
+
+	txt, err = renderQuery(analyze.OutputJSON, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", txt)
+
+	_, err = renderQuery(analyze.OutputHTML, list)
+	assert.Error(t, err)
+}
+
+func TestExport(t *testing.T) {
+	list := []StoredFeedback{{ID: "1", Report: goodFeedback()}, {ID: "2", Report: filterFeedback()}}
+	ctx := newTestContext(resolve.NullResolver{}, 1)
+
+	txt, err := Export(withFormat(t, ctx, analyze.OutputCSV), list)
+	require.NoError(t, err)
+	lines, err := csv.NewReader(strings.NewReader(txt)).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, lines, 5)
+
+	f, err := analyze.NewFilter(analyze.FilterConfig{GroupBy: analyze.GroupReporter})
+	require.NoError(t, err)
+	ctx.opts.Filter = f
+	txt, err = Export(withFormat(t, ctx, analyze.OutputCSV), list)
+	require.NoError(t, err)
+	assert.Equal(t, "group_by,key,count,pass,fail,records,reports\nreporter,example.net,12,4,8,4,2\n", txt)
+
+	txt, err = Export(withFormat(t, ctx, analyze.OutputCSV), nil)
+	require.NoError(t, err)
+	assert.Empty(t, txt)
+}
+
+func TestRunExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(filepath.Join(dir, "store.json"))
+	require.NoError(t, err)
+	_, err = s.AddFeedback("acme", goodFeedback())
+	require.NoError(t, err)
+
+	out := filepath.Join(dir, "out.tsv")
+	defer func() {
+		fStore, fExportOut, fOutput, fNoResolv = "", "", analyze.OutputText, false
+		fQuery = StoreQuery{}
+	}()
+	require.NoError(t, realmain([]string{"export", "-store", filepath.Join(dir, "store.json"),
+		"-N", "-o", "tsv", "-tenant", "acme", "-out", out}))
+
+	buf, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(buf), "\n"))
+
+	assert.Error(t, realmain([]string{"store", "query", "-store", filepath.Join(dir, "none.json")}))
+}
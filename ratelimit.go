@@ -0,0 +1,273 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LimitConfig protects the API against abusive clients
+type LimitConfig struct {
+	// MaxBody is the maximum size of an upload request
+	MaxBody int64
+	// ClientRate is how many requests per second a client IP can make
+	ClientRate  float64
+	ClientBurst int
+	// KeyRate is the same for every API key or token
+	KeyRate  float64
+	KeyBurst int
+	// MaxInflight is how many uploads can be handled at the same time
+	MaxInflight int
+	// TrustProxy uses X-Forwarded-For to find the client IP
+	TrustProxy bool
+}
+
+var fLimits LimitConfig
+
+func init() {
+	l := &fLimits
+
+	flag.Int64Var(&l.MaxBody, "max-body", 32<<20, "Maximum size of an upload request")
+	flag.Float64Var(&l.ClientRate, "rate-client", 20, "Requests per second per client IP, 0 to disable")
+	flag.IntVar(&l.ClientBurst, "burst-client", 40, "Burst of requests per client IP")
+	flag.Float64Var(&l.KeyRate, "rate-key", 0, "Requests per second per API key, 0 to disable")
+	flag.IntVar(&l.KeyBurst, "burst-key", 40, "Burst of requests per API key")
+	flag.IntVar(&l.MaxInflight, "max-inflight", 16, "Uploads handled at the same time, 0 for no limit")
+	flag.BoolVar(&l.TrustProxy, "trust-proxy", false, "Use X-Forwarded-For to find the client IP")
+}
+
+// Reasons for rejecting a request, as published in /metrics
+const (
+	RejectBodyTooLarge = "body_too_large"
+	RejectClientRate   = "client_rate"
+	RejectKeyRate      = "key_rate"
+	RejectInflight     = "inflight"
+)
+
+// errTooLarge is what http.MaxBytesReader returns
+var errTooLarge = errors.New("http: request body too large")
+
+// rejections counts the requests refused by the limits
+var rejections = expvar.NewMap("rejections")
+
+// idleBuckets is how often full buckets are forgotten
+const idleBuckets = time.Minute
+
+// bucket is a token bucket, tokens are added at rate per second
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter has one token bucket per key
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	cleaned time.Time
+
+	now func() time.Time
+}
+
+// NewRateLimiter allows rate requests per second with bursts of burst for
+// every key
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		cleaned: time.Now(),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token for key, or returns how long to wait for one
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.clean(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// clean forgets the buckets which are full again
+func (l *RateLimiter) clean(now time.Time) {
+	if now.Sub(l.cleaned) < idleBuckets {
+		return
+	}
+	l.cleaned = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// limiter applies a LimitConfig to the API handlers
+type limiter struct {
+	cnf     LimitConfig
+	clients *RateLimiter
+	keys    *RateLimiter
+	slots   chan struct{}
+}
+
+func newLimiter(cnf LimitConfig) *limiter {
+	l := &limiter{cnf: cnf}
+
+	if cnf.ClientRate > 0 {
+		l.clients = NewRateLimiter(cnf.ClientRate, cnf.ClientBurst)
+	}
+	if cnf.KeyRate > 0 {
+		l.keys = NewRateLimiter(cnf.KeyRate, cnf.KeyBurst)
+	}
+	if cnf.MaxInflight > 0 {
+		l.slots = make(chan struct{}, cnf.MaxInflight)
+	}
+	return l
+}
+
+// reject answers with 429 and when to retry
+func reject(w http.ResponseWriter, reason, code string, wait time.Duration) {
+	rejections.Add(reason, 1)
+
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeFailure(w, Failure{Stage: StageRequest, Code: code, Message: "too many requests, retry in " + strconv.Itoa(secs) + "s"})
+}
+
+// clientIP is the address of the client, or of the first proxy unless we
+// trust it.  The trusted proxy appends the address it saw to
+// X-Forwarded-For, everything before comes from the client.
+func (l *limiter) clientIP(r *http.Request) string {
+	if xff := r.Header["X-Forwarded-For"]; l.cnf.TrustProxy && len(xff) > 0 {
+		hops := strings.Split(xff[len(xff)-1], ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// perClient rate-limits every request but probes by client IP
+func (l *limiter) perClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.clients != nil && !probePaths[r.URL.Path] {
+			if ok, wait := l.clients.Allow(l.clientIP(r)); !ok {
+				reject(w, RejectClientRate, CodeRateLimited, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// perKey rate-limits authenticated requests by API key or token subject
+func (l *limiter) perKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := PrincipalFrom(r.Context()); p != nil && l.keys != nil {
+			if ok, wait := l.keys.Allow(p.Method + ":" + p.ID); !ok {
+				reject(w, RejectKeyRate, CodeRateLimited, wait)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// body caps the size of the request body, before anything reads it
+func (l *limiter) body(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.cnf.MaxBody > 0 {
+			if r.ContentLength > l.cnf.MaxBody {
+				rejections.Add(RejectBodyTooLarge, 1)
+				writeError(w, r, uploadError(errors.Wrapf(errTooLarge, "%d bytes", r.ContentLength)))
+				return
+			}
+			r.Body = &countingBody{ReadCloser: http.MaxBytesReader(w, r.Body, l.cnf.MaxBody)}
+		}
+		next(w, r)
+	}
+}
+
+// inflight limits the number of uploads handled at the same time
+func (l *limiter) inflight(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+				defer func() { <-l.slots }()
+			default:
+				reject(w, RejectInflight, CodeTooBusy, time.Second)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// countingBody records when http.MaxBytesReader rejects a body
+type countingBody struct {
+	io.ReadCloser
+	counted bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && !b.counted && isTooLarge(err) {
+		b.counted = true
+		rejections.Add(RejectBodyTooLarge, 1)
+	}
+	return n, err
+}
+
+// bodyTooLarge is true if reading the body of r went over -max-body, in
+// which case parsers may fail on the truncated content before seeing the
+// error from http.MaxBytesReader.
+func bodyTooLarge(r *http.Request) bool {
+	b, ok := r.Body.(*countingBody)
+	return ok && b.counted
+}
+
+// isTooLarge is true for errors from http.MaxBytesReader
+func isTooLarge(err error) bool {
+	// There is no exported error for http.MaxBytesReader
+	return err != nil && strings.Contains(errors.Cause(err).Error(), "request body too large")
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other keys have their own bucket
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.False(t, ok)
+
+	// Full buckets are forgotten
+	now = now.Add(2 * idleBuckets)
+	l.Allow("c")
+	assert.Len(t, l.buckets, 1)
+}
+
+func rejected(reason string) int64 {
+	if v := rejections.Get(reason); v != nil {
+		n, _ := v.(interface{ Value() int64 })
+		return n.Value()
+	}
+	return 0
+}
+
+func TestLimiter_PerClient(t *testing.T) {
+	l := newLimiter(LimitConfig{ClientRate: 1, ClientBurst: 1, TrustProxy: true})
+	h := l.perClient(http.HandlerFunc(healthz))
+
+	before := rejected(RejectClientRate)
+
+	req := func(ip, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		// The first hop is made up by the client
+		r.Header.Set("X-Forwarded-For", "203.0.113.9, "+ip)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, req("192.0.2.1", "/api/v1/reports").Code)
+	w := req("192.0.2.1", "/api/v1/reports")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.True(t, strings.Contains(w.Body.String(), CodeRateLimited))
+	assert.Equal(t, before+1, rejected(RejectClientRate))
+
+	assert.Equal(t, http.StatusOK, req("192.0.2.2", "/api/v1/reports").Code)
+	assert.Equal(t, http.StatusOK, req("192.0.2.1", "/healthz").Code)
+}
+
+func TestLimiter_ClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	assert.Equal(t, "192.0.2.1", newLimiter(LimitConfig{}).clientIP(r))
+	assert.Equal(t, "198.51.100.1", newLimiter(LimitConfig{TrustProxy: true}).clientIP(r))
+
+	// Only the hop added by the proxy can be trusted
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.1")
+	assert.Equal(t, "198.51.100.1", newLimiter(LimitConfig{TrustProxy: true}).clientIP(r))
+	r.Header.Add("X-Forwarded-For", "198.51.100.2")
+	assert.Equal(t, "198.51.100.2", newLimiter(LimitConfig{TrustProxy: true}).clientIP(r))
+}
+
+func TestLimiter_PerKey(t *testing.T) {
+	l := newLimiter(LimitConfig{KeyRate: 1, KeyBurst: 1})
+	h := l.perKey(healthz)
+
+	req := func(id string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{ID: id, Method: AuthAPIKey}))
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, req("a"))
+	assert.Equal(t, http.StatusTooManyRequests, req("a"))
+	assert.Equal(t, http.StatusOK, req("b"))
+}
+
+func TestLimiter_Body(t *testing.T) {
+	l := newLimiter(LimitConfig{MaxBody: 10})
+	h := l.body(uploadForensic)
+
+	before := rejected(RejectBodyTooLarge)
+
+	// Known length
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 100))))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), CodeTooLarge))
+
+	// Chunked
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(bytes.Repeat([]byte("x"), 100)))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	h(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, before+2, rejected(RejectBodyTooLarge))
+}
+
+func TestLimiter_Inflight(t *testing.T) {
+	l := newLimiter(LimitConfig{MaxInflight: 1})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	h := l.inflight(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	go h(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	<-started
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/", nil))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), CodeTooBusy))
+	close(release)
+}
@@ -1,345 +1,570 @@
 package main
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
-	"flag"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/keltia/archive"
+	"github.com/gorilla/mux"
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/pkg/errors"
 )
 
-func CreateDirIfNotExist(dir string) {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-			err = os.MkdirAll(dir, 0755)
-			if err != nil {
-					panic(err)
-			}
-	}
+// Content types accepted as a raw request body, the format is sniffed
+// from the content anyway
+var rawUploadTypes = map[string]bool{
+	"application/zip":          true,
+	"application/gzip":         true,
+	"application/x-gzip":       true,
+	"application/x-bzip2":      true,
+	"application/x-xz":         true,
+	"application/zstd":         true,
+	"application/x-tar":        true,
+	"application/octet-stream": true,
+	"application/xml":          true,
+	"text/xml":                 true,
 }
 
-func enableCors(w *http.ResponseWriter) {
-	//(*w).Header().Set("Access-Control-Allow-Origin", "*")
+// uploadPart is one file of an upload
+type uploadPart struct {
+	name string
+	body io.ReadCloser
 }
 
-// Unzip will decompress a zip archive, moving all files and folders
-// within the zip file (parameter 1) to an output directory (parameter 2).
-func Unzip(src string, dest string) ([]string, error) {
+// uploadResult is the outcome for one file of a batch upload
+type uploadResult struct {
+	FileName string   `json:"fileName"`
+	Status   string   `json:"status"`
+	Error    *Failure `json:"error,omitempty"`
+	Job      *Job     `json:"job,omitempty"`
+}
 
-    var filenames []string
+// batchResult is what we answer for several files
+type batchResult struct {
+	Status string         `json:"status"`
+	Files  []uploadResult `json:"files"`
+}
 
-    r, err := zip.OpenReader(src)
-    if err != nil {
-        return filenames, err
-    }
-    defer r.Close()
+// uploadParts returns every file sent, either as form fields (repeated
+// bundleFile parts or bundleFiles[]) or as the raw request body.
+func uploadParts(r *http.Request) ([]uploadPart, error) {
+	ct := r.Header.Get("Content-Type")
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
 
-    for _, f := range r.File {
+	if rawUploadTypes[ct] {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "upload"
+		}
+		return []uploadPart{{name: name, body: r.Body}}, nil
+	}
 
-        // Store filename/path for returning and using later on
-        fpath := filepath.Join(dest, f.Name)
+	if ct != "multipart/form-data" {
+		return nil, stageError(StageUpload, CodeUnsupportedType,
+			errors.Errorf("unsupported Content-Type %q", ct))
+	}
 
-        // Check for ZipSlip. More Info: http://bit.ly/2MsjAWE
-        if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-            return filenames, fmt.Errorf("%s: illegal file path", fpath)
-        }
+	// Parse our multipart form, 10 << 20 specifies a maximum
+	// upload of 10 MB files kept in memory, the rest goes to disk.
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		return nil, formError(r, err)
+	}
 
-        filenames = append(filenames, fpath)
+	var parts []uploadPart
+	for _, field := range []string{"bundleFile", "bundleFiles[]"} {
+		for _, fh := range r.MultipartForm.File[field] {
+			file, err := fh.Open()
+			if err != nil {
+				for _, p := range parts {
+					p.body.Close()
+				}
+				return nil, uploadError(err)
+			}
+			logFrom(r.Context()).Info("uploaded file", "file", fh.Filename, "size", fh.Size)
+			parts = append(parts, uploadPart{name: fh.Filename, body: file})
+		}
+	}
+	if len(parts) == 0 {
+		return nil, uploadError(http.ErrMissingFile)
+	}
+	return parts, nil
+}
 
-        if f.FileInfo().IsDir() {
-            // Make Folder
-            os.MkdirAll(fpath, os.ModePerm)
-            continue
-        }
+// formError classifies errors reading the multipart form of r: bodies over
+// -max-body, the disk holding big files, or a form the client got wrong
+func formError(r *http.Request, err error) error {
+	if bodyTooLarge(r) || isTooLarge(err) {
+		return uploadError(errors.Wrap(errTooLarge, "body"))
+	}
+	if _, ok := errors.Cause(err).(*os.PathError); ok {
+		return uploadError(err)
+	}
+	return stageError(StageUpload, CodeBadRequest, errors.Wrap(err, "form"))
+}
 
-        // Make File
-        if err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm); err != nil {
-            return filenames, err
-        }
+// jobOptions returns the analysis options of an upload given as query
+// parameters: noresolve, sort and format.
+func jobOptions(r *http.Request) (*JobOptions, error) {
+	q := r.URL.Query()
+	if q.Get("noresolve") == "" && q.Get("sort") == "" && q.Get("format") == "" {
+		return nil, nil
+	}
 
-        outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-        if err != nil {
-            return filenames, err
-        }
+	o := &JobOptions{Format: q.Get("format")}
+	if v := q.Get("noresolve"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Errorf("bad noresolve %q", v)
+		}
+		o.NoResolve = b
+	}
+	if v := q.Get("sort"); v != "" {
+		sort, err := analyze.ParseSort(v)
+		if err != nil {
+			return nil, err
+		}
+		o.Sort = sort
+	}
+	if o.Format != "" {
+		if err := analyze.CheckOutput(o.Format); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
 
-        rc, err := f.Open()
-        if err != nil {
-            return filenames, err
-        }
+func uploadFile(w http.ResponseWriter, r *http.Request) {
+	opts, err := jobOptions(r)
+	if err != nil {
+		writeError(w, r, stageError(StageRequest, CodeBadRequest, err))
+		return
+	}
 
-        _, err = io.Copy(outFile, rc)
+	parts, err := uploadParts(r)
+	if err != nil && bodyTooLarge(r) {
+		err = uploadError(errors.Wrap(errTooLarge, "body"))
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-        // Close the file without defer to close before next iteration of loop
-        outFile.Close()
-        rc.Close()
+	// ?wait=true keeps the old synchronous behaviour
+	wait, _ := strconv.ParseBool(r.URL.Query().Get("wait"))
 
-        if err != nil {
-            return filenames, err
-        }
-    }
-    return filenames, nil
-}
+	// Extraction and analysis happen in the background
+	results := make([]uploadResult, len(parts))
+	for i, p := range parts {
+		results[i] = submitPart(r, p, opts)
+		p.body.Close()
+	}
 
-// Untar takes a destination path and a reader; a tar reader loops over the tarfile
-// creating the file structure at 'dst' along the way, and writing any files
-func Untar(dst string, r io.Reader) ([]string, error) {
+	if len(results) > 1 {
+		uploadBatch(w, results, wait)
+		return
+	}
 
-    var filenames []string
+	res := results[0]
+	if res.Job == nil {
+		writeFailure(w, *res.Error)
+		return
+	}
+	job := *res.Job
 
-	gzr, err := gzip.NewReader(r)
-	if err != nil {
-		return filenames, err
+	if wait {
+		job, err = jobQueue.Wait(job.ID)
+		if err != nil {
+			writeError(w, r, stageError(StageAnalyze, CodeInternal, err))
+			return
+		}
+		if len(job.Results) == 0 {
+			writeFailure(w, jobFailure(job))
+			return
+		}
+		last := job.Results[len(job.Results)-1]
+		if ct, ok := tableTypes[resultFormat(job)]; ok {
+			// Tables hold the rows of every report, send them as such
+			w.Header().Set("Content-Type", ct)
+			fmt.Fprint(w, resultTexts([]json.RawMessage{last})[0])
+			return
+		}
+		// Answer with the last report found like before
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, string(last))
+		return
 	}
-	defer gzr.Close()
 
-	tr := tar.NewReader(gzr)
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
 
-	for {
-		header, err := tr.Next()
+// jobFailure is the first reason a job failed
+func jobFailure(job Job) Failure {
+	if len(job.Errors) == 0 {
+		return Failure{Stage: StageAnalyze, Code: CodeInternal, Message: "no result", File: job.FileName}
+	}
+	return job.Errors[0]
+}
 
-		switch {
+// submitPart queues one uploaded file for the tenant of r
+func submitPart(r *http.Request, p uploadPart, o *JobOptions) uploadResult {
+	res := uploadResult{FileName: p.name}
+	l := logFrom(r.Context())
 
-		// if no more files are found return
-		case err == io.EOF:
-			return filenames, nil
+	job, err := jobQueue.Submit(p.name, requestTenant(r), requestIDFrom(r.Context()), o, p.body)
+	if err != nil {
+		l.Warn("cannot queue upload", "file", p.name, "error", err)
+		f := failureOf(uploadError(err))
+		f.File = p.name
+		res.Status = JobFailed
+		res.Error = &f
+		return res
+	}
+	l.Info("queued job", "file", p.name, "job", job.ID)
 
-		// return any other error
-		case err != nil:
-			return filenames, err
+	res.Status = job.Status
+	res.Job = &job
+	return res
+}
 
-		// if the header is nil, just skip it (not sure how this happens)
-		case header == nil:
-			continue
+// uploadBatch answers with one result per file, waiting for all of them
+// if asked to.
+func uploadBatch(w http.ResponseWriter, results []uploadResult, wait bool) {
+	failed := 0
+	for i := range results {
+		res := &results[i]
+		if res.Job != nil && wait {
+			job, err := jobQueue.Wait(res.Job.ID)
+			if err != nil {
+				f := failureOf(stageError(StageAnalyze, CodeInternal, err))
+				res.Status = JobFailed
+				res.Error = &f
+			} else {
+				res.Job = &job
+				res.Status = job.Status
+				if job.Status == JobFailed {
+					f := jobFailure(job)
+					res.Error = &f
+				}
+			}
 		}
+		if res.Status == JobFailed {
+			failed++
+		}
+	}
 
-		// the target location where the dir/file should be created
-		target := filepath.Join(dst, header.Name)
+	batch := batchResult{Status: "success", Files: results}
+	switch failed {
+	case 0:
+	case len(results):
+		batch.Status = "failed"
+	default:
+		batch.Status = "partial"
+	}
 
-        filenames = append(filenames, target)
+	status := http.StatusAccepted
+	if wait {
+		status = http.StatusOK
+	}
+	if failed == len(results) {
+		// Nothing went through, use the status of the first failure
+		status = results[0].Error.HTTPStatus()
+	}
+	writeJSON(w, status, batch)
+}
 
-		// the following switch could also be done using fi.Mode(), not sure if there
-		// a benefit of using one vs. the other.
-		// fi := header.FileInfo()
+// getJob reports the progress and results of an upload
+func getJob(w http.ResponseWriter, r *http.Request) {
 
-		// check the file type
-		switch header.Typeflag {
+	job, err := jobQueue.Get(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, job.Tenant) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, stageError(StageRequest, CodeNotFound, errors.Wrap(err, "job")))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
 
-		// if its a dir and it doesn't exist create it
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return filenames, err
-				}
-			}
+func healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok")
+}
 
-		// if it's a file create it
-		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return filenames, err
-			}
+// writeJSON sends v as an indented JSON document
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
-			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
-				return filenames, err
-			}
-			
-			// manually close here after each file operation; defering would cause each file close
-			// to wait until all operations have completed.
-			f.Close()
-		}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		logger.Warn("cannot write response", "error", err)
 	}
+}
 
-	return filenames, nil
+// forensicResult is what we answer for a failure report
+type forensicResult struct {
+	Status       string          `json:"status"`
+	Report       *ForensicReport `json:"report"`
+	Correlations []Correlation   `json:"correlations"`
 }
 
-func fireDMARCProcessor(thefilepath string, args []string) string {
-	//Check to make sure this is an XML file...
+// uploadForensic accepts an ARF message either as the forensicFile form
+// field or as the raw request body.
+func uploadForensic(w http.ResponseWriter, r *http.Request) {
+	l := logFrom(r.Context())
 
-	if strings.Contains(thefilepath, ".xml") {
-		fmt.Println("Processing DMARC report: " + thefilepath)
+	var in io.Reader = r.Body
 
-		ctx, err := Setup(args)
-		if ctx == nil {
-			fmt.Println(err)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			writeError(w, r, formError(r, err))
+			return
 		}
+		file, _, err := r.FormFile("forensicFile")
+		if err != nil {
+			writeError(w, r, uploadError(err))
+			return
+		}
+		defer file.Close()
+		in = file
+	}
 
-		var txt string
+	fr, err := ParseForensic(logFrom(r.Context()), in)
+	if err != nil && bodyTooLarge(r) {
+		writeError(w, r, uploadError(errors.Wrap(errTooLarge, "body")))
+		return
+	}
+	if err != nil {
+		err = stageError(StageParse, CodeBadReport, err)
+		countFailure(failureOf(err))
+		writeError(w, r, err)
+		return
+	}
+	uploads.Inc("forensic")
 
-		file := thefilepath
+	fr.Tenant, err = authenticator.Tenants().attribute(fr.HeaderFromDomain(), requestTenant(r))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-		fmt.Println("Analyzing " + file)
+	if _, err := reportStore.AddForensic(fr); err != nil {
+		writeError(w, r, stageError(StageAnalyze, CodeStore, err))
+		return
+	}
 
-		if filepath.Ext(file) == ".zip" ||
-			filepath.Ext(file) == ".ZIP" {
+	corr, err := Correlate(reportStore, fr)
+	if err != nil {
+		l.Warn("cannot correlate forensic report", "id", fr.ID, "error", err)
+	}
+	l.Info("stored forensic report", "id", fr.ID, "tenant", fr.Tenant, "correlations", len(corr))
 
-			txt, err = HandleZipFile(ctx, file)
-			if err != nil {
-				fmt.Println("txt")
-				fmt.Println(err)
-			}
-		} else {
-			in, err := SelectInput(file)
-			if err != nil {
-				fmt.Println("in")
-				fmt.Println(err)
-			}
-			defer in.Close()
+	writeJSON(w, http.StatusOK, forensicResult{Status: "success", Report: fr, Correlations: corr})
+}
 
-			typ := archive.Ext2Type(fType)
+// listForensic returns all stored failure reports the caller can see
+func listForensic(w http.ResponseWriter, r *http.Request) {
 
-			txt, err = HandleSingleFileJSON(ctx, in, typ)
-			if err != nil {
-				fmt.Println("handle")
-				fmt.Println(err)
-			}
+	all, err := reportStore.ForensicReports()
+	if err != nil {
+		writeError(w, r, stageError(StageRequest, CodeStore, err))
+		return
+	}
+
+	list := []*ForensicReport{}
+	for _, fr := range all {
+		if canSee(r, fr.Tenant) {
+			list = append(list, fr)
 		}
-		fmt.Println(txt)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
 
-		return txt
+// getForensic returns one failure report and its matching aggregate rows
+func getForensic(w http.ResponseWriter, r *http.Request) {
 
-	} else {
-		fmt.Println("Failed opening " + thefilepath + ", NOT VALID FILE TYPE")
+	fr, err := reportStore.Forensic(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, fr.Tenant) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		writeError(w, r, stageError(StageRequest, CodeNotFound, errors.Wrap(err, "forensic")))
+		return
+	}
 
-		return `{"status":"failed", "stage": "fireDMARCProcessor - File type check"}`
+	corr, err := Correlate(reportStore, fr)
+	if err != nil {
+		logFrom(r.Context()).Warn("cannot correlate forensic report", "id", fr.ID, "error", err)
 	}
-	
+	writeJSON(w, http.StatusOK, forensicResult{Status: "success", Report: fr, Correlations: corr})
 }
 
-func uploadFile(w http.ResponseWriter, r *http.Request) {
-
-	enableCors(&w)
-
-    fmt.Println("File Upload Endpoint Hit")
-
-    // Parse our multipart form, 10 << 20 specifies a maximum
-    // upload of 10 MB files.
-    r.ParseMultipartForm(10 << 20)
-    // FormFile returns the first file for the given key `myFile`
-    // it also returns the FileHeader so we can get the Filename,
-    // the Header and the size of the file
-    file, handler, err := r.FormFile("bundleFile")
-    if err != nil {
-        fmt.Println("Error Retrieving the File")
-        fmt.Println(err)
-    }
-	defer file.Close()
-	
-	bundleFileExt := filepath.Ext(handler.Filename)
-	bundlefileName := handler.Filename;
-
-    fmt.Printf("Uploaded File: %+v\n", bundlefileName)
-    fmt.Printf("File Size: %+v\n", handler.Size)
-	fmt.Printf("MIME Header: %+v\n", handler.Header)
-	fmt.Printf("File Extension: %+v\n", bundleFileExt)
-
-    // Create a temporary file within our temp-images directory that follows
-	// a particular naming pattern
-
-	CreateDirIfNotExist(os.TempDir() + "/temp-bundles")
-	CreateDirIfNotExist(os.TempDir() + "/temp-bundles/extracts")
-
-    tempFile, err := ioutil.TempFile(os.TempDir() + "/temp-bundles", "upload-*" + bundleFileExt)
-    if err != nil {
-		fmt.Println(err)
-    }
-    defer tempFile.Close()
-
-    // read all of the contents of our uploaded file into a
-    // byte array
-    fileBytes, err := ioutil.ReadAll(file)
-    if err != nil {
-        fmt.Println(err)
-    }
-    // write this byte array to our temporary file
-    tempFile.Write(fileBytes)
-    // return that we have successfully uploaded our file!
-	fmt.Println("Successfully Uploaded File")
-
-	var processorResults string
-
-	// Determine file type
-	switch bundleFileExt {
-		case ".zip":
-			fmt.Println("File type is ZIP, extracting...")
-			files, err := Unzip(tempFile.Name(), os.TempDir() + "/temp-bundles/extracts")
-			if err != nil {
-				fmt.Println(err)
-			}
+// listReports returns all stored aggregate reports the caller can see
+func listReports(w http.ResponseWriter, r *http.Request) {
 
-			fmt.Println("Unzipped:\n" + strings.Join(files, "\n"))
+	all, err := reportStore.Feedbacks()
+	if err != nil {
+		writeError(w, r, stageError(StageRequest, CodeStore, err))
+		return
+	}
 
-			//For every XML file, run the processor...
-			for _, file := range files {
-				if strings.Contains(file, ".xml") {
-					processorResults = fireDMARCProcessor(file, flag.Args())
+	list := []StoredFeedback{}
+	for _, sf := range all {
+		if canSee(r, sf.Tenant) {
+			list = append(list, sf)
+		}
+	}
 
-					os.Remove(file)
-				}
-			}
+	if name := r.URL.Query().Get("template"); name != "" {
+		writeTemplate(w, r, name, list)
+		return
+	}
 
-		case ".gz":
-			fmt.Println("File type is Gunzip, extracting " + tempFile.Name() + "...")
-			fileReader, err := os.Open(tempFile.Name())
-			if err != nil {
-				fmt.Println(err)
-			}
-			defer fileReader.Close()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", analyze.OutputJSON:
+		writeJSON(w, http.StatusOK, list)
+	case analyze.OutputCSV, analyze.OutputTSV:
+		writeTable(w, r, format, list)
+	case analyze.OutputHTML:
+		writeHTML(w, r, list)
+	default:
+		writeError(w, r, stageError(StageRequest, CodeBadRequest, errors.Errorf("unknown format %q", format)))
+	}
+}
 
-			fz, err := gzip.NewReader(fileReader)
-			if err != nil {
-				fmt.Println(err)
-			}
-			defer fz.Close()
+// writeHTML displays the reports in one page
+func writeHTML(w http.ResponseWriter, r *http.Request, list []StoredFeedback) {
+	// Stored reports are not resolved
+	a, err := analyze.New(analyze.Options{NoResolve: true, Format: analyze.OutputHTML, Program: program()})
+	if err != nil {
+		writeError(w, r, stageError(StageAnalyze, CodeAnalyze, err))
+		return
+	}
 
-			s, err := ioutil.ReadAll(fz)
-			if err != nil {
-				fmt.Println(err)
-			}
+	var sections []string
+	for _, sf := range list {
+		if s, err := analyze.RenderHTML(sf.Report, nil); err == nil {
+			sections = append(sections, s)
+		}
+	}
 
-			reformattedFilename := strings.Replace(bundlefileName, "." + bundleFileExt, "", -1)
-			reformattedFullPath := os.TempDir() + "/temp-bundles/" + reformattedFilename
+	page, err := a.Join("stored reports", sections)
+	if err != nil {
+		writeError(w, r, stageError(StageAnalyze, CodeAnalyze, err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, page)
+}
 
-			ferr := ioutil.WriteFile(reformattedFullPath, s, 0644)
-			if ferr != nil {
-				fmt.Println(ferr)
-			}
+// writeTemplate renders every report with NAME.tmpl from -template-dir
+func writeTemplate(w http.ResponseWriter, r *http.Request, name string, list []StoredFeedback) {
+	t, err := namedTemplate(fTemplateDir, name)
+	if errors.Cause(err) == ErrNoTemplate {
+		writeError(w, r, stageError(StageRequest, CodeNotFound, err))
+		return
+	}
+	if err != nil {
+		writeError(w, r, stageError(StageAnalyze, CodeAnalyze, err))
+		return
+	}
 
-			fmt.Println("File is gz XML, processing...")
-			fmt.Println("Sending file " + reformattedFullPath)
-			processorResults = fireDMARCProcessor(reformattedFullPath, flag.Args())
+	// Stored reports are not resolved
+	a, err := analyze.New(analyze.Options{
+		NoResolve: true,
+		Format:    analyze.OutputTemplate,
+		Template:  t,
+		Program:   program(),
+	})
+	if err != nil {
+		writeError(w, r, stageError(StageAnalyze, CodeAnalyze, err))
+		return
+	}
 
-			os.Remove(reformattedFullPath)
+	var buf bytes.Buffer
+	for _, sf := range list {
+		txt, err := a.Render(sf.Report, a.Rows(sf.Report))
+		if err == analyze.ErrEmptyReport {
+			continue
+		}
+		if err != nil {
+			writeError(w, r, stageError(StageAnalyze, CodeAnalyze, err))
+			return
+		}
+		buf.WriteString(txt)
+	}
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteTo(w)
+}
 
-		case ".xml":
-			fmt.Println("File is raw XML, proceeding...")
-			processorResults = fireDMARCProcessor(tempFile.Name(), flag.Args())
+// tableTypes are the Content-Type of table exports
+var tableTypes = map[string]string{
+	analyze.OutputCSV: "text/csv; charset=utf-8",
+	analyze.OutputTSV: "text/tab-separated-values; charset=utf-8",
+}
 
-		default:
-			fmt.Printf("Failed to open file type %s.\n", bundleFileExt)
+// writeTable exports every record of the reports as CSV or TSV
+func writeTable(w http.ResponseWriter, r *http.Request, format string, list []StoredFeedback) {
+	comma := ','
+	if format == analyze.OutputTSV {
+		comma = '\t'
 	}
 
-	os.Remove(tempFile.Name())
+	var lines [][]string
+	for _, sf := range list {
+		lines = append(lines, analyze.CSVRows(sf.Report, nil)...)
+	}
 
-	fmt.Fprintf(w, processorResults + "\n")
-	
+	w.Header().Set("Content-Type", tableTypes[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="reports.`+format+`"`)
+	if err := analyze.WriteCSV(w, comma, analyze.CSVHeader, lines); err != nil {
+		logFrom(r.Context()).Warn("cannot write response", "error", err)
+	}
 }
 
-func healthz(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Health endpoint hit")
-	fmt.Fprintf(w, "ok")
-}
+// newRouter returns all our API endpoints
+func newRouter() (*mux.Router, error) {
+	r := mux.NewRouter()
+	l := newLimiter(fLimits)
+	c, err := newCORS(fCORS)
+	if err != nil {
+		return nil, err
+	}
 
-func setupRoutes() {
-	http.HandleFunc("/api/v1/upload_bundle", uploadFile)
-	http.HandleFunc("/healthz", healthz)
-    http.ListenAndServe(":8080", nil)
-}
\ No newline at end of file
+	// Body size is checked before authentication reads it
+	upload := func(h http.HandlerFunc) http.HandlerFunc {
+		return l.body(requireScope(ScopeUpload, l.perKey(l.inflight(h))))
+	}
+	read := func(h http.HandlerFunc) http.HandlerFunc {
+		return requireScope(ScopeRead, l.perKey(h))
+	}
+
+	r.Use(requestID, instrument, c.handler, l.perClient)
+
+	// Preflight requests on every route, registered first to win
+	r.PathPrefix("/").Methods("OPTIONS").HandlerFunc(c.preflight)
+
+	r.HandleFunc("/api/v1/upload_bundle", upload(uploadFile))
+	r.HandleFunc("/api/v1/jobs/{id}", read(getJob)).Methods("GET")
+	r.HandleFunc("/api/v1/upload_forensic", upload(uploadForensic)).Methods("POST")
+	r.HandleFunc("/api/v1/forensic", read(listForensic)).Methods("GET")
+	r.HandleFunc("/api/v1/forensic/{id}", read(getForensic)).Methods("GET")
+	r.HandleFunc("/api/v1/reports", read(listReports)).Methods("GET")
+	r.HandleFunc("/healthz", healthz)
+	r.HandleFunc("/livez", healthz)
+	r.HandleFunc("/readyz", readyz)
+	r.HandleFunc("/version", versionHandler).Methods("GET")
+	r.HandleFunc("/metrics", read(metrics.ServeHTTP)).Methods("GET")
+	return r, nil
+}
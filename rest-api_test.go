@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupTestServer starts the API with a fresh store and job queue
+func setupTestServer(t *testing.T) (*httptest.Server, func()) {
+	fNoResolv = true
+	reportStore = NewMemStore()
+
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+
+	jobQueue, err = NewJobQueue(reportStore, dir, 1, Options{Options: analyze.Options{NoResolve: true}})
+	require.NoError(t, err)
+	require.NoError(t, jobQueue.Start())
+
+	router, err := newRouter()
+	require.NoError(t, err)
+	ts := httptest.NewServer(router)
+	return ts, func() {
+		ts.Close()
+		jobQueue.Stop()
+		os.RemoveAll(dir)
+		fNoResolv = false
+	}
+}
+
+// uploadForm builds a multipart body with every file in field
+func uploadForm(t *testing.T, field string, files ...string) (*bytes.Buffer, string) {
+	var buf bytes.Buffer
+
+	mw := multipart.NewWriter(&buf)
+	for _, file := range files {
+		fw, err := mw.CreateFormFile(field, file)
+		require.NoError(t, err)
+
+		fh, err := os.Open(file)
+		require.NoError(t, err)
+
+		_, err = io.Copy(fw, fh)
+		fh.Close()
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	return &buf, mw.FormDataContentType()
+}
+
+func TestUploadFile_Async(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	body, ct := uploadForm(t, "bundleFile", "testdata/google.com!keltia.net!1538438400!1538524799.zip")
+	resp, err := http.Post(ts.URL+"/api/v1/upload_bundle", ct, body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var job Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	require.NotEmpty(t, job.ID)
+	assert.Equal(t, "/api/v1/jobs/"+job.ID, resp.Header.Get("Location"))
+
+	_, err = jobQueue.Wait(job.ID)
+	require.NoError(t, err)
+
+	resp1, err := http.Get(ts.URL + "/api/v1/jobs/" + job.ID)
+	require.NoError(t, err)
+	defer resp1.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp1.StatusCode)
+	require.NoError(t, json.NewDecoder(resp1.Body).Decode(&job))
+	assert.Equal(t, JobDone, job.Status)
+	assert.Equal(t, 1, job.Parsed)
+}
+
+func TestUploadFile_Wait(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	body, ct := uploadForm(t, "bundleFile", "testdata/example.com!keltia.net!1538604008!1538690408.xml.gz")
+	resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?wait=true", ct, body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	res, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(res), `"status": "success"`)
+}
+
+func TestUploadFile_Options(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	body, ct := uploadForm(t, "bundleFile", "testdata/google.com!keltia.net!1538438400!1538524799.zip")
+	resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?wait=true&format=csv&sort=IP&noresolve=true", ct, body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	body1, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body1)), "\n")
+	require.True(t, len(lines) > 1, string(body1))
+	assert.True(t, strings.HasPrefix(lines[0], "org_name,"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "google.com,"), lines[1])
+
+	// Reports are stored whatever the format
+	list, err := reportStore.Feedbacks()
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	for _, q := range []string{"format=pdf", "sort=Nope", "sort=IP:up", "noresolve=maybe"} {
+		body, ct := uploadForm(t, "bundleFile", "testdata/google.com!keltia.net!1538438400!1538524799.zip")
+		resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?"+q, ct, body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, q)
+	}
+}
+
+func TestUploadFile_Batch(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	for _, field := range []string{"bundleFile", "bundleFiles[]"} {
+		body, ct := uploadForm(t, field,
+			"testdata/google.com!keltia.net!1538438400!1538524799.zip",
+			"testdata/example.com!keltia.net!1538604008!1538690408.xml.gz",
+			"testdata/notempty.txt")
+		resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?wait=true", ct, body)
+		require.NoError(t, err)
+
+		var res batchResult
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "partial", res.Status)
+		require.Len(t, res.Files, 3)
+		assert.Equal(t, JobDone, res.Files[0].Status)
+		assert.Equal(t, JobDone, res.Files[1].Status)
+		assert.Equal(t, JobFailed, res.Files[2].Status)
+		assert.NotEmpty(t, res.Files[2].Error)
+		assert.Equal(t, "notempty.txt", res.Files[2].FileName)
+	}
+}
+
+func TestUploadFile_Raw(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	fh, err := os.Open("testdata/google.com!keltia.net!1538438400!1538524799.zip")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?name=google.zip", "application/zip", fh)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var job Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, "google.zip", job.FileName)
+
+	job, err = jobQueue.Wait(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, job.Status)
+
+	// Other compressions are sniffed
+	for file, ct := range map[string]string{
+		"testdata/example.com!keltia.net!1538604008!1538690408.xml.bz2": "application/x-bzip2",
+		"testdata/example.com!keltia.net!1538604008!1538690408.xml.xz":  "application/x-xz",
+		"testdata/example.com!keltia.net!1538604008!1538690408.xml.zst": "application/zstd",
+		"testdata/reports.tar.gz": "application/octet-stream",
+	} {
+		fh, err := os.Open(file)
+		require.NoError(t, err)
+		resp, err := http.Post(ts.URL+"/api/v1/upload_bundle?wait=true", ct, fh)
+		fh.Close()
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, ct)
+	}
+}
+
+func TestUploadFile_Errors(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	td := []struct {
+		url    string
+		ct     string
+		body   string
+		status int
+		stage  string
+		code   string
+	}{
+		{"/api/v1/upload_bundle", "text/plain", "foo", http.StatusUnsupportedMediaType, StageUpload, CodeUnsupportedType},
+		{"/api/v1/upload_bundle", "multipart/form-data; boundary=foo", "--foo--\r\n", http.StatusBadRequest, StageUpload, CodeMissingFile},
+		{"/api/v1/upload_bundle?wait=true", "application/xml", "<feedback><version>", http.StatusUnprocessableEntity, StageParse, CodeBadXML},
+		{"/api/v1/upload_bundle?wait=true", "application/gzip", "not gzip at all", http.StatusUnsupportedMediaType, StageDecompress, CodeUnsupportedFormat},
+		{"/api/v1/upload_forensic", "message/rfc822", "foo", http.StatusUnprocessableEntity, StageParse, CodeBadReport},
+	}
+
+	for _, e := range td {
+		resp, err := http.Post(ts.URL+e.url, e.ct, strings.NewReader(e.body))
+		require.NoError(t, err)
+
+		var res errorBody
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, e.status, resp.StatusCode, e.body)
+		assert.Equal(t, "failed", res.Status)
+		assert.Equal(t, e.stage, res.Stage, e.body)
+		assert.Equal(t, e.code, res.Code, e.body)
+		assert.NotEmpty(t, res.Message)
+	}
+}
+
+func TestGetJob_NotFound(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	resp, err := http.Get(ts.URL + "/api/v1/jobs/nonexistent")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUploadForensic(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	fh, err := os.Open("testdata/forensic.eml")
+	require.NoError(t, err)
+	defer fh.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/upload_forensic", "message/rfc822", fh)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var res forensicResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.NotNil(t, res.Report)
+
+	resp1, err := http.Get(ts.URL + "/api/v1/forensic/" + res.Report.ID)
+	require.NoError(t, err)
+	resp1.Body.Close()
+	assert.Equal(t, http.StatusOK, resp1.StatusCode)
+}
+
+func TestUploadForensic_BadForm(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	body := "--b\r\nContent-Disposition: form-data; name=\"forensicFile\"; filename=\"a.eml\"\r\n\r\ntruncated"
+	resp, err := http.Post(ts.URL+"/api/v1/upload_forensic", "multipart/form-data; boundary=b", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var f Failure
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&f))
+	assert.Equal(t, StageUpload, f.Stage)
+	assert.Equal(t, CodeBadRequest, f.Code)
+}
+
+// apiCall sends a request authenticated with key
+func apiCall(t *testing.T, method, url, key, ct string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	req.Header.Set("X-API-Key", key)
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestMultiTenant(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	a, err := NewAuthenticator(AuthConfig{
+		Tenants: []TenantConfig{
+			{ID: "keltia", Domains: []string{"keltia.net"}},
+			{ID: "other", Domains: []string{"example.org"}},
+		},
+		Keys: []APIKeyConfig{
+			{ID: "a", Hash: HashAPIKey("ka"), Tenant: "keltia", Scopes: []string{ScopeUpload, ScopeRead}},
+			{ID: "b", Hash: HashAPIKey("kb"), Tenant: "other", Scopes: []string{ScopeUpload, ScopeRead}},
+			{ID: "admin", Hash: HashAPIKey("admin"), Scopes: []string{ScopeRead}},
+		},
+	})
+	require.NoError(t, err)
+	authenticator, jobQueue.opts.Tenants = a, a.Tenants()
+	defer func() { authenticator = nil }()
+
+	zip := "testdata/google.com!keltia.net!1538438400!1538524799.zip"
+	upload := ts.URL + "/api/v1/upload_bundle?wait=true"
+
+	// keltia.net does not belong to other
+	fh, err := os.Open(zip)
+	require.NoError(t, err)
+	resp := apiCall(t, "POST", upload, "kb", "application/zip", fh)
+	fh.Close()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	fh, err = os.Open(zip)
+	require.NoError(t, err)
+	resp = apiCall(t, "POST", upload, "ka", "application/zip", fh)
+	fh.Close()
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	td := map[string]int{"ka": 1, "kb": 0, "admin": 1}
+	for key, n := range td {
+		resp := apiCall(t, "GET", ts.URL+"/api/v1/reports", key, "", nil)
+
+		var list []StoredFeedback
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+		resp.Body.Close()
+		require.Len(t, list, n, key)
+		if n > 0 {
+			assert.Equal(t, "keltia", list[0].Tenant)
+		}
+	}
+
+	// Jobs of other tenants are invisible
+	jobs, err := reportStore.Jobs()
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	for _, j := range jobs {
+		resp := apiCall(t, "GET", ts.URL+"/api/v1/jobs/"+j.ID, "kb", "", nil)
+		resp.Body.Close()
+		if j.Tenant == "other" {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		} else {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+
+	// Same for forensic reports
+	fh, err = os.Open("testdata/forensic.eml")
+	require.NoError(t, err)
+	resp = apiCall(t, "POST", ts.URL+"/api/v1/upload_forensic", "kb", "message/rfc822", fh)
+	fh.Close()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	fh, err = os.Open("testdata/forensic.eml")
+	require.NoError(t, err)
+	resp = apiCall(t, "POST", ts.URL+"/api/v1/upload_forensic", "ka", "message/rfc822", fh)
+
+	var res forensicResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	resp.Body.Close()
+	assert.Equal(t, "keltia", res.Report.Tenant)
+
+	resp = apiCall(t, "GET", ts.URL+"/api/v1/forensic/"+res.Report.ID, "kb", "", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = apiCall(t, "GET", ts.URL+"/api/v1/forensic", "kb", "", nil)
+	var frs []*ForensicReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&frs))
+	resp.Body.Close()
+	assert.Empty(t, frs)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServerConfig has everything needed to run the REST API
+type ServerConfig struct {
+	Addr            string
+	CertFile        string
+	KeyFile         string
+	ClientCA        string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	MaxHeaderBytes  int
+}
+
+var fServerConfig ServerConfig
+
+func init() {
+	c := &fServerConfig
+
+	flag.StringVar(&c.Addr, "listen", ":8080", "Address to listen on (REST API)")
+	flag.StringVar(&c.CertFile, "tls-cert", "", "TLS certificate file, enables HTTPS")
+	flag.StringVar(&c.KeyFile, "tls-key", "", "TLS private key file")
+	flag.StringVar(&c.ClientCA, "tls-client-ca", "", "CA file to require and verify client certificates")
+	flag.DurationVar(&c.ReadTimeout, "read-timeout", 60*time.Second, "Maximum time to read a request")
+	flag.DurationVar(&c.WriteTimeout, "write-timeout", 120*time.Second, "Maximum time to write a response")
+	flag.DurationVar(&c.IdleTimeout, "idle-timeout", 120*time.Second, "Maximum time to keep idle connections")
+	flag.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to drain uploads on shutdown")
+	flag.IntVar(&c.MaxHeaderBytes, "max-header-bytes", 1<<20, "Maximum size of request headers")
+}
+
+// TLS is true if we serve HTTPS
+func (c ServerConfig) TLS() bool {
+	return c.CertFile != ""
+}
+
+// newServer checks the configuration and creates the server
+func newServer(c ServerConfig, h http.Handler) (*http.Server, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("both -tls-cert and -tls-key are needed")
+	}
+	if c.ClientCA != "" && !c.TLS() {
+		return nil, errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+
+	srv := &http.Server{
+		Addr:           c.Addr,
+		Handler:        h,
+		ReadTimeout:    c.ReadTimeout,
+		WriteTimeout:   c.WriteTimeout,
+		IdleTimeout:    c.IdleTimeout,
+		MaxHeaderBytes: c.MaxHeaderBytes,
+	}
+
+	if c.TLS() {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if c.ClientCA != "" {
+			pem, err := ioutil.ReadFile(c.ClientCA)
+			if err != nil {
+				return nil, errors.Wrap(err, "client CA")
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no certificate found in %s", c.ClientCA)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return srv, nil
+}
+
+// runServer serves the REST API until SIGTERM or SIGINT
+func runServer(c ServerConfig, h http.Handler) error {
+	srv, err := newServer(c, h)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+
+	return serve(srv, ln, c, sig)
+}
+
+// serve handles requests on ln until something comes on sig, then waits
+// for running requests and queued uploads to finish.
+func serve(srv *http.Server, ln net.Listener, c ServerConfig, sig <-chan os.Signal) error {
+	errc := make(chan error, 1)
+
+	go func() {
+		if c.TLS() {
+			verbose("listening on %s (https)", ln.Addr())
+			errc <- srv.ServeTLS(ln, c.CertFile, c.KeyFile)
+		} else {
+			verbose("listening on %s", ln.Addr())
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "serve")
+	case s := <-sig:
+		verbose("got %v, shutting down", s)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+
+	// No new requests, wait for uploads being received
+	if err := srv.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "shutdown")
+	}
+
+	// Then for the queued jobs, left in the spool if we run out of time
+	if jobQueue != nil {
+		if err := jobQueue.Shutdown(ctx); err != nil {
+			return errors.Wrap(err, "jobs")
+		}
+	}
+	verbose("shutdown complete")
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert creates a self-signed certificate and its key in dir
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	kder, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	cert := filepath.Join(dir, "cert.pem")
+	keyf := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyf, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600))
+	return cert, keyf
+}
+
+func TestNewServer(t *testing.T) {
+	c := ServerConfig{Addr: ":0", ReadTimeout: time.Second, MaxHeaderBytes: 4096}
+
+	srv, err := newServer(c, http.NotFoundHandler())
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, srv.ReadTimeout)
+	assert.Equal(t, 4096, srv.MaxHeaderBytes)
+	assert.Nil(t, srv.TLSConfig)
+}
+
+func TestNewServer_Bad(t *testing.T) {
+	td := []ServerConfig{
+		{CertFile: "cert.pem"},
+		{KeyFile: "key.pem"},
+		{ClientCA: "ca.pem"},
+		{CertFile: "cert.pem", KeyFile: "key.pem", ClientCA: "/nonexistent"},
+		{CertFile: "cert.pem", KeyFile: "key.pem", ClientCA: "testdata/notempty.txt"},
+	}
+
+	for _, c := range td {
+		_, err := newServer(c, http.NotFoundHandler())
+		assert.Error(t, err)
+	}
+}
+
+func TestNewServer_MTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := writeCert(t, dir)
+	srv, err := newServer(ServerConfig{CertFile: cert, KeyFile: key, ClientCA: cert}, http.NotFoundHandler())
+	require.NoError(t, err)
+	require.NotNil(t, srv.TLSConfig)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, srv.TLSConfig.ClientAuth)
+	assert.NotNil(t, srv.TLSConfig.ClientCAs)
+}
+
+func TestServe_Shutdown(t *testing.T) {
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	c := ServerConfig{ShutdownTimeout: 5 * time.Second}
+	srv, err := newServer(c, h)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	sig := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- serve(srv, ln, c, sig) }()
+
+	respc := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Error(err)
+		}
+		respc <- resp
+	}()
+
+	// The request being handled must complete
+	<-started
+	sig <- syscall.SIGTERM
+
+	resp := <-respc
+	require.NotNil(t, resp)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "done", string(body))
+	assert.NoError(t, <-errc)
+}
+
+func TestServe_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert, key := writeCert(t, dir)
+	c := ServerConfig{CertFile: cert, KeyFile: key, ClientCA: cert, ShutdownTimeout: time.Second}
+	srv, err := newServer(c, http.HandlerFunc(healthz))
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	sig := make(chan os.Signal, 1)
+	errc := make(chan error, 1)
+	go func() { errc <- serve(srv, ln, c, sig) }()
+
+	pool := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(cert)
+	require.NoError(t, err)
+	pool.AppendCertsFromPEM(pem)
+
+	url := "https://" + ln.Addr().String() + "/"
+
+	// No client certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = client.Get(url)
+	assert.Error(t, err)
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	require.NoError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{pair}}}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sig <- syscall.SIGTERM
+	assert.NoError(t, <-errc)
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/pkg/errors"
+)
+
+// Store keeps processed reports so they can be queried and correlated later
+type Store interface {
+	// AddFeedback returns the ID of the stored report and ErrDuplicate if
+	// the same report was already stored for tenant
+	AddFeedback(tenant string, r report.Feedback) (string, error)
+	// NewFeedback starts storing an aggregate report given record by
+	// record, see FeedbackWriter
+	NewFeedback() (FeedbackWriter, error)
+	Feedbacks() ([]StoredFeedback, error)
+	AddForensic(fr *ForensicReport) (string, error)
+	Forensic(id string) (*ForensicReport, error)
+	ForensicReports() ([]*ForensicReport, error)
+	SaveJob(j Job) error
+	Job(id string) (Job, error)
+	Jobs() ([]Job, error)
+	Ping() error
+}
+
+// FeedbackWriter stores an aggregate report as its records are decoded
+type FeedbackWriter interface {
+	// Add stores one more record
+	Add(rec report.Record) error
+	// Commit stores the report of tenant with header hdr and the records
+	// added, returning its ID and ErrDuplicate like Store.AddFeedback
+	Commit(tenant string, hdr report.Feedback) (string, error)
+	// Abort forgets the records added, it does nothing after Commit
+	Abort()
+}
+
+// StoredFeedback is an aggregate report with its storage metadata
+type StoredFeedback struct {
+	ID     string          `json:"id"`
+	Tenant string          `json:"tenant,omitempty"`
+	Added  time.Time       `json:"added"`
+	Report report.Feedback `json:"report"`
+}
+
+// reportStore is where the REST API keeps processed reports
+var reportStore Store
+
+var (
+	// ErrNotFound is returned when an ID is not in the store
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a report is stored again
+	ErrDuplicate = errors.New("already stored")
+)
+
+// jobRetention is how many finished jobs are kept, the oldest ones are
+// forgotten past that
+const jobRetention = 1000
+
+// memRetention is how many reports of each kind are kept without -store,
+// the oldest ones are forgotten past that
+const memRetention = 10000
+
+// feedbackKey identifies a report, reporters use the same report ID for a
+// report sent again.  Reports without ID are never duplicates.
+func feedbackKey(tenant string, r report.Feedback) string {
+	if r.Metadata.ReportID == "" {
+		return ""
+	}
+	return tenant + "\x00" + r.Metadata.OrgName + "\x00" + r.Metadata.ReportID
+}
+
+// newID returns a random identifier
+func newID() string {
+	var b [12]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		// Should never happen but fallback to something unique enough
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// MemStore is an in-memory Store
+type MemStore struct {
+	mu        sync.RWMutex
+	feedbacks []StoredFeedback
+	// stored are the IDs of feedbacks by feedbackKey
+	stored   map[string]string
+	forensic map[string]*ForensicReport
+	// order are the IDs of forensic by insertion
+	order []string
+	jobs  map[string]Job
+	// max is the number of reports of each kind kept, 0 for all
+	max int
+}
+
+// NewMemStore returns an empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{
+		stored:   map[string]string{},
+		forensic: map[string]*ForensicReport{},
+		jobs:     map[string]Job{},
+	}
+}
+
+// NewBoundedMemStore returns an empty in-memory store keeping only the
+// last max reports of each kind
+func NewBoundedMemStore(max int) *MemStore {
+	s := NewMemStore()
+	s.max = max
+	return s
+}
+
+// AddFeedback stores an aggregate report belonging to tenant, unless it
+// is already there
+func (s *MemStore) AddFeedback(tenant string, r report.Feedback) (string, error) {
+	sf, err := s.reserve(tenant, r)
+	if err != nil {
+		return sf.ID, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feedbacks = append(s.feedbacks, sf)
+	if s.max > 0 && len(s.feedbacks) > s.max {
+		old := s.feedbacks[0]
+		delete(s.stored, feedbackKey(old.Tenant, old.Report))
+		s.feedbacks[0] = StoredFeedback{}
+		s.feedbacks = s.feedbacks[1:]
+	}
+	return sf.ID, nil
+}
+
+// reserve gives r of tenant an ID and indexes it, unless it is already
+// there
+func (s *MemStore) reserve(tenant string, r report.Feedback) (StoredFeedback, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := feedbackKey(tenant, r)
+	if id, ok := s.stored[key]; ok && key != "" {
+		return StoredFeedback{ID: id}, ErrDuplicate
+	}
+
+	sf := StoredFeedback{ID: newID(), Tenant: tenant, Added: time.Now().UTC(), Report: r}
+	s.stored[key] = sf.ID
+	return sf, nil
+}
+
+// release forgets a report reserved but not stored
+func (s *MemStore) release(tenant string, r report.Feedback) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.stored, feedbackKey(tenant, r))
+}
+
+// memFeedback gathers the records of a report for a MemStore
+type memFeedback struct {
+	s    *MemStore
+	recs []report.Record
+}
+
+// NewFeedback gathers the records of a report until it is committed
+func (s *MemStore) NewFeedback() (FeedbackWriter, error) {
+	return &memFeedback{s: s}, nil
+}
+
+// Add keeps one more record
+func (f *memFeedback) Add(rec report.Record) error {
+	f.recs = append(f.recs, rec)
+	return nil
+}
+
+// Commit stores the report with the records added
+func (f *memFeedback) Commit(tenant string, hdr report.Feedback) (string, error) {
+	hdr.Records, f.recs = f.recs, nil
+	return f.s.AddFeedback(tenant, hdr)
+}
+
+// Abort drops the records added
+func (f *memFeedback) Abort() {
+	f.recs = nil
+}
+
+// Feedbacks returns all aggregate reports, oldest first
+func (s *MemStore) Feedbacks() ([]StoredFeedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]StoredFeedback, len(s.feedbacks))
+	copy(list, s.feedbacks)
+	return list, nil
+}
+
+// AddForensic stores a failure report, setting its ID if needed
+func (s *MemStore) AddForensic(fr *ForensicReport) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fr.ID == "" {
+		fr.ID = newID()
+	}
+	if _, ok := s.forensic[fr.ID]; !ok {
+		s.order = append(s.order, fr.ID)
+	}
+	s.forensic[fr.ID] = fr
+	if s.max > 0 && len(s.order) > s.max {
+		delete(s.forensic, s.order[0])
+		s.order = s.order[1:]
+	}
+	return fr.ID, nil
+}
+
+// Forensic returns one failure report
+func (s *MemStore) Forensic(id string) (*ForensicReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fr, ok := s.forensic[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return fr, nil
+}
+
+// ForensicReports returns all failure reports sorted by arrival date
+func (s *MemStore) ForensicReports() ([]*ForensicReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*ForensicReport, 0, len(s.forensic))
+	for _, fr := range s.forensic {
+		list = append(list, fr)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ArrivalDate.Before(list[j].ArrivalDate)
+	})
+	return list, nil
+}
+
+// SaveJob creates or updates a job, dropping the oldest finished jobs
+// past jobRetention
+func (s *MemStore) SaveJob(j Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[j.ID] = j
+	if j.Finished() {
+		s.expireJobs()
+	}
+	return nil
+}
+
+// expireJobs forgets the oldest finished jobs, s.mu must be held
+func (s *MemStore) expireJobs() {
+	var done []Job
+	for _, j := range s.jobs {
+		if j.Finished() {
+			done = append(done, j)
+		}
+	}
+	if len(done) <= jobRetention {
+		return
+	}
+
+	sort.Slice(done, func(i, j int) bool {
+		return done[i].Updated.Before(done[j].Updated)
+	})
+	for _, j := range done[:len(done)-jobRetention] {
+		delete(s.jobs, j.ID)
+	}
+}
+
+// Job returns one job
+func (s *MemStore) Job(id string) (Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return j, ErrNotFound
+	}
+	return j, nil
+}
+
+// Jobs returns all jobs sorted by creation date
+func (s *MemStore) Jobs() ([]Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		list = append(list, j)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Ping always works
+func (s *MemStore) Ping() error {
+	return nil
+}
+
+// FileStore keeps reports in a file where every new one is appended as
+// JSON lines, an aggregate report being a line for its header followed by
+// one line per record.  Aggregate reports are only indexed in memory, to
+// find duplicates, and read from the file when listed; forensic reports
+// are kept in memory too, one stored again replaces the previous one when
+// the file is loaded.  Jobs are saved apart, in the same file with a .jobs
+// suffix, and only when their status changes: progress is lost on restart
+// anyway as unfinished jobs are run again from the start.
+type FileStore struct {
+	*MemStore
+	path   string
+	saveMu sync.Mutex
+	jobsMu sync.Mutex
+}
+
+// storeLine is one line of a FileStore
+type storeLine struct {
+	Feedback *StoredFeedback `json:"feedback,omitempty"`
+	// Records is how many record lines follow Feedback, its records are
+	// in the line itself if none
+	Records  int             `json:"records,omitempty"`
+	Record   *report.Record  `json:"record,omitempty"`
+	Forensic *ForensicReport `json:"forensic_report,omitempty"`
+}
+
+// legacyStore is the whole store in one JSON object, as written by older
+// versions, which also kept the jobs in it
+type legacyStore struct {
+	Feedbacks []StoredFeedback  `json:"feedbacks"`
+	Forensic  []*ForensicReport `json:"forensic"`
+	Jobs      []Job             `json:"jobs,omitempty"`
+}
+
+// legacyPrefix starts the files written by older versions
+var legacyPrefix = []byte(`{"feedbacks":`)
+
+// NewFileStore loads or creates the store in file, converting stores
+// written by older versions
+func NewFileStore(file string) (*FileStore, error) {
+	s := &FileStore{MemStore: NewMemStore(), path: file}
+
+	legacy, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	if err := readStoreFile(s.jobsPath(), &jobs); err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		jobs = append(legacy.Jobs, jobs...)
+	}
+	for _, j := range jobs {
+		s.jobs[j.ID] = j
+	}
+	s.expireJobs()
+
+	if legacy != nil {
+		if err := s.convert(legacy); err != nil {
+			return nil, errors.Wrap(err, "convert")
+		}
+		if err := s.saveJobs(); err != nil {
+			return nil, errors.Wrap(err, "jobs")
+		}
+		logger.Info("converted store to JSON lines", "file", file)
+	}
+	verbose("loaded %d aggregate and %d forensic reports, %d jobs from %s",
+		len(s.stored), len(s.forensic), len(s.jobs), file)
+	return s, nil
+}
+
+// scanStore calls fn with every line of file and its offset, lines are
+// whole ones and parsed into a storeLine unless raw is set.  It returns
+// the offset after the last whole line and what follows it, like a line
+// cut short by a crash or a file written by an older version.
+func scanStore(file string, raw bool, fn func(off int64, line []byte, sl storeLine) error) (int64, []byte, error) {
+	fh, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return 0, nil, nil
+	}
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+
+	var (
+		off int64
+		n   int
+	)
+	br := bufio.NewReader(fh)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return off, line, nil
+		}
+		if err != nil {
+			return off, nil, errors.Wrap(err, "read")
+		}
+		n++
+
+		var sl storeLine
+		if !raw {
+			if err := json.Unmarshal(line, &sl); err != nil {
+				return off, nil, errors.Wrapf(err, "bad store %s:%d", file, n)
+			}
+		}
+		if err := fn(off, line, sl); err != nil {
+			return off, nil, errors.Wrapf(err, "bad store %s:%d", file, n)
+		}
+		off += int64(len(line))
+	}
+}
+
+// load indexes the reports of the store file, returning the whole store
+// if it was written by an older version.  What an interrupted append left
+// at the end is dropped.
+func (s *FileStore) load() (*legacyStore, error) {
+	var (
+		legacy *legacyStore
+		// cur is the aggregate report being read, left the number of its
+		// records still to come and start where it starts
+		cur   *StoredFeedback
+		left  int
+		start int64
+	)
+
+	end, tail, err := scanStore(s.path, true, func(off int64, line []byte, _ storeLine) error {
+		if off == 0 && bytes.HasPrefix(line, legacyPrefix) {
+			legacy = &legacyStore{}
+			return json.Unmarshal(line, legacy)
+		}
+
+		var sl storeLine
+		if err := json.Unmarshal(line, &sl); err != nil {
+			return err
+		}
+		switch {
+		case left > 0:
+			if sl.Record == nil {
+				return errors.New("record expected")
+			}
+			left--
+		case sl.Feedback != nil:
+			cur, left, start = sl.Feedback, sl.Records, off
+		case sl.Forensic != nil:
+			s.MemStore.AddForensic(sl.Forensic)
+		default:
+			return errors.New("unknown line")
+		}
+
+		if cur != nil && left == 0 {
+			s.stored[feedbackKey(cur.Tenant, cur.Report)] = cur.ID
+			cur = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case end == 0 && bytes.HasPrefix(tail, legacyPrefix):
+		legacy = &legacyStore{}
+		if err := json.Unmarshal(tail, legacy); err != nil {
+			return nil, errors.Wrapf(err, "bad store %s", s.path)
+		}
+	case cur != nil:
+		logger.Warn("dropping truncated report", "file", s.path, "id", cur.ID)
+		return nil, errors.Wrap(os.Truncate(s.path, start), "truncate")
+	case len(tail) > 0:
+		logger.Warn("dropping truncated store line", "file", s.path)
+		return nil, errors.Wrap(os.Truncate(s.path, end), "truncate")
+	}
+	return legacy, nil
+}
+
+// jobsPath is where the jobs are saved
+func (s *FileStore) jobsPath() string {
+	return s.path + ".jobs"
+}
+
+// readStoreFile decodes file into v, a missing file is left empty
+func readStoreFile(file string, v interface{}) error {
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "ReadFile")
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errors.Wrapf(err, "bad store %s", file)
+	}
+	return nil
+}
+
+// writeStoreFile replaces file with what write writes atomically
+func writeStoreFile(file string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".store-*")
+	if err != nil {
+		return errors.Wrap(err, "TempFile")
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close")
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// writeLine writes sl as one line of the store file
+func writeLine(w io.Writer, sl storeLine) error {
+	buf, err := json.Marshal(sl)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// appendLines calls write to add lines at the end of the store file, the
+// file is left as it was if write fails.
+func (s *FileStore) appendLines(write func(w io.Writer) error) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	fh, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer fh.Close()
+
+	end, err := fh.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrap(err, "seek")
+	}
+	bw := bufio.NewWriter(fh)
+	if err = write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		fh.Truncate(end)
+		return errors.Wrap(err, "write")
+	}
+	return errors.Wrap(fh.Close(), "close")
+}
+
+// convert rewrites a store written by an older version as JSON lines
+func (s *FileStore) convert(legacy *legacyStore) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	return writeStoreFile(s.path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for i := range legacy.Feedbacks {
+			sf := legacy.Feedbacks[i]
+			recs := sf.Report.Records
+			sf.Report.Records = nil
+
+			if err := writeLine(bw, storeLine{Feedback: &sf, Records: len(recs)}); err != nil {
+				return err
+			}
+			for j := range recs {
+				if err := writeLine(bw, storeLine{Record: &recs[j]}); err != nil {
+					return err
+				}
+			}
+			s.stored[feedbackKey(sf.Tenant, sf.Report)] = sf.ID
+		}
+		for _, fr := range legacy.Forensic {
+			if err := writeLine(bw, storeLine{Forensic: fr}); err != nil {
+				return err
+			}
+			s.MemStore.AddForensic(fr)
+		}
+		return bw.Flush()
+	})
+}
+
+// saveJobs writes all jobs atomically
+func (s *FileStore) saveJobs() error {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	jobs, _ := s.MemStore.Jobs()
+	buf, err := json.Marshal(jobs)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+	return writeStoreFile(s.jobsPath(), func(w io.Writer) error {
+		_, err := w.Write(buf)
+		return err
+	})
+}
+
+// fileFeedback spools the records of a report to a temporary file next to
+// the store until it is committed
+type fileFeedback struct {
+	s   *FileStore
+	tmp *os.File
+	bw  *bufio.Writer
+	n   int
+}
+
+// NewFeedback starts spooling the records of a report
+func (s *FileStore) NewFeedback() (FeedbackWriter, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".feedback-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "TempFile")
+	}
+	return &fileFeedback{s: s, tmp: tmp, bw: bufio.NewWriter(tmp)}, nil
+}
+
+// Add spools one more record
+func (f *fileFeedback) Add(rec report.Record) error {
+	if err := writeLine(f.bw, storeLine{Record: &rec}); err != nil {
+		return errors.Wrap(err, "spool")
+	}
+	f.n++
+	return nil
+}
+
+// Commit appends the report and its spooled records to the store file
+func (f *fileFeedback) Commit(tenant string, hdr report.Feedback) (string, error) {
+	defer f.Abort()
+
+	if err := f.bw.Flush(); err != nil {
+		return "", errors.Wrap(err, "spool")
+	}
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return "", errors.Wrap(err, "spool")
+	}
+
+	// Records are counted but not kept by the index
+	hdr.Records = nil
+	sf, err := f.s.MemStore.reserve(tenant, hdr)
+	if err != nil {
+		return sf.ID, err
+	}
+
+	err = f.s.appendLines(func(w io.Writer) error {
+		if err := writeLine(w, storeLine{Feedback: &sf, Records: f.n}); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, f.tmp)
+		return err
+	})
+	if err != nil {
+		f.s.MemStore.release(tenant, hdr)
+		return "", err
+	}
+	return sf.ID, nil
+}
+
+// Abort removes the spooled records
+func (f *fileFeedback) Abort() {
+	if f.tmp == nil {
+		return
+	}
+	f.tmp.Close()
+	os.Remove(f.tmp.Name())
+	f.tmp = nil
+}
+
+// AddFeedback stores an aggregate report and appends it to the file
+func (s *FileStore) AddFeedback(tenant string, r report.Feedback) (string, error) {
+	f, err := s.NewFeedback()
+	if err != nil {
+		return "", err
+	}
+	defer f.Abort()
+
+	for _, rec := range r.Records {
+		if err := f.Add(rec); err != nil {
+			return "", err
+		}
+	}
+	return f.Commit(tenant, r)
+}
+
+// Feedbacks reads all aggregate reports from the file, oldest first
+func (s *FileStore) Feedbacks() ([]StoredFeedback, error) {
+	var (
+		list []StoredFeedback
+		left int
+	)
+
+	_, _, err := scanStore(s.path, false, func(_ int64, _ []byte, sl storeLine) error {
+		switch {
+		case left > 0 && sl.Record != nil:
+			cur := &list[len(list)-1]
+			cur.Report.Records = append(cur.Report.Records, *sl.Record)
+			left--
+		case sl.Feedback != nil:
+			list = append(list, *sl.Feedback)
+			left = sl.Records
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if left > 0 {
+		// Still being appended
+		list = list[:len(list)-1]
+	}
+	return list, nil
+}
+
+// AddForensic stores a failure report and appends it to the file
+func (s *FileStore) AddForensic(fr *ForensicReport) (string, error) {
+	id, _ := s.MemStore.AddForensic(fr)
+
+	return id, s.appendLines(func(w io.Writer) error {
+		return writeLine(w, storeLine{Forensic: fr})
+	})
+}
+
+// SaveJob creates or updates a job, saving the jobs when it is new or its
+// status changed
+func (s *FileStore) SaveJob(j Job) error {
+	old, err := s.MemStore.Job(j.ID)
+	s.MemStore.SaveJob(j)
+	if err == nil && old.Status == j.Status {
+		return nil
+	}
+	return s.saveJobs()
+}
+
+// Ping checks the store can still be saved where it is
+func (s *FileStore) Ping() error {
+	fi, err := os.Stat(filepath.Dir(s.path))
+	if err != nil {
+		return errors.Wrap(err, "store directory")
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("%s is not a directory", filepath.Dir(s.path))
+	}
+	return nil
+}
+
+// OpenStore returns a FileStore if file is set, a MemStore keeping the
+// last memRetention reports of each kind otherwise
+func OpenStore(file string) (Store, error) {
+	if file == "" {
+		return NewBoundedMemStore(memRetention), nil
+	}
+	return NewFileStore(file)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+
+	id, err := s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "foo"}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	list, err := s.Feedbacks()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "foo", list[0].Report.Metadata.ReportID)
+
+	// Same report again, for another tenant
+	dup, err := s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "foo"}})
+	assert.Equal(t, ErrDuplicate, err)
+	assert.Equal(t, id, dup)
+	_, err = s.AddFeedback("acme", report.Feedback{Metadata: report.ReportMetadata{ReportID: "foo"}})
+	assert.NoError(t, err)
+
+	fid, err := s.AddForensic(&ForensicReport{FeedbackType: "auth-failure"})
+	require.NoError(t, err)
+
+	fr, err := s.Forensic(fid)
+	require.NoError(t, err)
+	assert.Equal(t, fid, fr.ID)
+
+	_, err = s.Forensic("nonexistent")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+
+	s, err := OpenStore(file)
+	require.NoError(t, err)
+
+	_, err = s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "foo"}})
+	require.NoError(t, err)
+	fid, err := s.AddForensic(&ForensicReport{FeedbackType: "auth-failure"})
+	require.NoError(t, err)
+
+	s1, err := OpenStore(file)
+	require.NoError(t, err)
+
+	list, err := s1.Feedbacks()
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	_, err = s1.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "foo"}})
+	assert.Equal(t, ErrDuplicate, err)
+
+	_, err = s1.Forensic(fid)
+	assert.NoError(t, err)
+}
+
+func TestMemStore_Jobs(t *testing.T) {
+	s := NewMemStore()
+
+	_, err := s.Job("foo")
+	assert.Equal(t, ErrNotFound, err)
+
+	now := time.Now()
+	require.NoError(t, s.SaveJob(Job{ID: "b", Status: JobQueued, Created: now.Add(time.Second)}))
+	require.NoError(t, s.SaveJob(Job{ID: "a", Status: JobQueued, Created: now}))
+	require.NoError(t, s.SaveJob(Job{ID: "a", Status: JobDone, Created: now}))
+
+	j, err := s.Job("a")
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, j.Status)
+
+	list, err := s.Jobs()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "a", list[0].ID)
+}
+
+func TestMemStore_JobRetention(t *testing.T) {
+	s := NewMemStore()
+
+	now := time.Now()
+	require.NoError(t, s.SaveJob(Job{ID: "running", Status: JobRunning, Created: now}))
+	for i := 0; i <= jobRetention; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		require.NoError(t, s.SaveJob(Job{ID: fmt.Sprint(i), Status: JobDone, Created: at, Updated: at}))
+	}
+
+	list, err := s.Jobs()
+	require.NoError(t, err)
+	assert.Len(t, list, jobRetention+1)
+	_, err = s.Job("0")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Job("running")
+	assert.NoError(t, err)
+}
+
+func TestFileStore_Jobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+
+	s, err := NewFileStore(file)
+	require.NoError(t, err)
+
+	j := Job{ID: "a", Status: JobRunning, Created: time.Now()}
+	require.NoError(t, s.SaveJob(j))
+
+	// Progress is only kept in memory
+	j.Found = 3
+	require.NoError(t, s.SaveJob(j))
+	got, err := s.Job("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, got.Found)
+
+	s1, err := NewFileStore(file)
+	require.NoError(t, err)
+	got, err = s1.Job("a")
+	require.NoError(t, err)
+	assert.Equal(t, 0, got.Found)
+
+	j.Status = JobDone
+	require.NoError(t, s.SaveJob(j))
+	s1, err = NewFileStore(file)
+	require.NoError(t, err)
+	got, err = s1.Job("a")
+	require.NoError(t, err)
+	assert.Equal(t, JobDone, got.Status)
+	assert.Equal(t, 3, got.Found)
+
+	// Jobs are not in the report store
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStore_Bad(t *testing.T) {
+	_, err := OpenStore("testdata/good.xml")
+	assert.Error(t, err)
+}
+
+func TestMemStore_Bounded(t *testing.T) {
+	s := NewBoundedMemStore(2)
+
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: id}})
+		require.NoError(t, err)
+		_, err = s.AddForensic(&ForensicReport{ID: id})
+		require.NoError(t, err)
+	}
+	_, err := s.AddForensic(&ForensicReport{ID: "c", FeedbackType: "abuse"})
+	require.NoError(t, err)
+
+	list, err := s.Feedbacks()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "b", list[0].Report.Metadata.ReportID)
+
+	// Forgotten reports are not duplicates anymore
+	_, err = s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "a"}})
+	assert.NoError(t, err)
+
+	_, err = s.Forensic("a")
+	assert.Equal(t, ErrNotFound, err)
+	fr, err := s.Forensic("c")
+	require.NoError(t, err)
+	assert.Equal(t, "abuse", fr.FeedbackType)
+	frs, err := s.ForensicReports()
+	require.NoError(t, err)
+	assert.Len(t, frs, 2)
+}
+
+func TestFileStore_Lines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+
+	s, err := NewFileStore(file)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b"} {
+		_, err = s.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: id}})
+		require.NoError(t, err)
+	}
+	_, err = s.AddForensic(&ForensicReport{ID: "f", FeedbackType: "auth-failure"})
+	require.NoError(t, err)
+	_, err = s.AddForensic(&ForensicReport{ID: "f", FeedbackType: "abuse"})
+	require.NoError(t, err)
+
+	// One line per report, appended
+	buf, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, 4, bytes.Count(buf, []byte("\n")))
+
+	// A line cut short by a crash is dropped
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = fh.WriteString(`{"feedback":{"id":"c"`)
+	require.NoError(t, err)
+	require.NoError(t, fh.Close())
+
+	s1, err := NewFileStore(file)
+	require.NoError(t, err)
+	list, err := s1.Feedbacks()
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+	fr, err := s1.Forensic("f")
+	require.NoError(t, err)
+	assert.Equal(t, "abuse", fr.FeedbackType)
+
+	_, err = s1.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "c"}})
+	require.NoError(t, err)
+	s2, err := NewFileStore(file)
+	require.NoError(t, err)
+	list, err = s2.Feedbacks()
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+}
+
+func TestFileStore_Legacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+	old := `{"feedbacks":[{"id":"1","added":"2020-01-01T00:00:00Z","report":{"Metadata":{"ReportID":"a"}}}],` +
+		`"forensic":[{"id":"2"}],"jobs":[{"id":"3","status":"done"}]}`
+	require.NoError(t, ioutil.WriteFile(file, []byte(old), 0600))
+
+	s, err := NewFileStore(file)
+	require.NoError(t, err)
+	list, err := s.Feedbacks()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "a", list[0].Report.Metadata.ReportID)
+	_, err = s.Forensic("2")
+	assert.NoError(t, err)
+	_, err = s.Job("3")
+	assert.NoError(t, err)
+
+	// Converted to lines, jobs moved to their own file
+	buf, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(buf, []byte("\n")))
+	_, err = os.Stat(file + ".jobs")
+	assert.NoError(t, err)
+
+	s1, err := NewFileStore(file)
+	require.NoError(t, err)
+	_, err = s1.AddFeedback("", report.Feedback{Metadata: report.ReportMetadata{ReportID: "a"}})
+	assert.Equal(t, ErrDuplicate, err)
+	_, err = s1.Job("3")
+	assert.NoError(t, err)
+}
+
+func TestFileStore_NewFeedback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "store.json")
+	r := testFeedback("good.xml")
+
+	s, err := NewFileStore(file)
+	require.NoError(t, err)
+
+	// Records are spooled next to the store until committed
+	fw, err := s.NewFeedback()
+	require.NoError(t, err)
+	for _, rec := range r.Records {
+		require.NoError(t, fw.Add(rec))
+	}
+	hdr := r
+	hdr.Records = nil
+	id, err := fw.Commit("acme", hdr)
+	require.NoError(t, err)
+
+	// Aborted reports leave nothing
+	fw, err = s.NewFeedback()
+	require.NoError(t, err)
+	require.NoError(t, fw.Add(r.Records[0]))
+	fw.Abort()
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// Only the index is in memory
+	assert.Empty(t, s.MemStore.feedbacks)
+	list, err := s.Feedbacks()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, id, list[0].ID)
+	assert.Equal(t, "acme", list[0].Tenant)
+	assert.Equal(t, r.Records, list[0].Report.Records)
+
+	_, err = s.AddFeedback("acme", r)
+	assert.Equal(t, ErrDuplicate, err)
+
+	// A report cut short by a crash is dropped
+	buf, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(file, append(buf, buf[:len(buf)-1]...), 0600))
+
+	s1, err := NewFileStore(file)
+	require.NoError(t, err)
+	list, err = s1.Feedbacks()
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	after, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, buf, after)
+}
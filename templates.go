@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/intel/tfortools"
+	"github.com/pkg/errors"
+)
+
+var (
+	// fTemplate is a template file replacing the built-in output
+	fTemplate string
+	// fTemplateDir holds the templates the API can use
+	fTemplateDir string
+)
+
+func init() {
+	flag.StringVar(&fTemplate, "template", "", "Go template file used instead of -o")
+	flag.StringVar(&fTemplateDir, "template-dir", "", "Directory of NAME.tmpl files for ?template=NAME (REST API)")
+}
+
+// ErrNoTemplate is returned for a template not in -template-dir
+var ErrNoTemplate = errors.New("no such template")
+
+// reTemplateName keeps API template names inside -template-dir
+var reTemplateName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// LoadTemplate parses file with the tfortools functions like table, sort
+// or cols available, it is run on analyze.TemplateData.
+func LoadTemplate(file string) (*template.Template, error) {
+	src, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "template")
+	}
+
+	t, err := tfortools.CreateTemplate(filepath.Base(file), string(src), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "template %s", file)
+	}
+	return t, nil
+}
+
+// cachedTemplate is a template of -template-dir as parsed
+type cachedTemplate struct {
+	mod  time.Time
+	size int64
+	t    *template.Template
+}
+
+var (
+	// templateCache keeps the templates of -template-dir by file, parsed
+	// again when they change
+	templateCache   = map[string]cachedTemplate{}
+	templateCacheMu sync.Mutex
+)
+
+// namedTemplate loads NAME.tmpl from -template-dir, once until it changes
+func namedTemplate(dir, name string) (*template.Template, error) {
+	if dir == "" || !reTemplateName.MatchString(name) {
+		return nil, errors.Wrap(ErrNoTemplate, name)
+	}
+
+	file := filepath.Join(dir, name+".tmpl")
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.Wrap(ErrNoTemplate, name)
+	}
+
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+
+	if c, ok := templateCache[file]; ok && c.mod.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.t, nil
+	}
+
+	t, err := LoadTemplate(file)
+	if err != nil {
+		return nil, err
+	}
+	templateCache[file] = cachedTemplate{mod: fi.ModTime(), size: fi.Size(), t: t}
+	return t, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kenmoini/dmarc-rest-api/pkg/analyze"
+	"github.com/kenmoini/dmarc-rest-api/pkg/report"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTemplate writes src as dir/name.tmpl
+func testTemplate(t *testing.T, dir, name, src string) string {
+	file := filepath.Join(dir, name+".tmpl")
+	require.NoError(t, ioutil.WriteFile(file, []byte(src), 0644))
+	return file
+}
+
+func TestLoadTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := testTemplate(t, dir, "slack",
+		"*{{.Report.Policy.Domain}}* {{.Stats.Messages}} msgs {{.Stats.PassPct}}% pass\n"+
+			"{{range .Rows}}- {{.IP}} {{.Count}}\n{{end}}"+
+			"{{with sort .Rows \"Count\" \"dsc\"}}{{(index . 0).IP}}{{end}}")
+
+	tmpl, err := LoadTemplate(file)
+	require.NoError(t, err)
+
+	a, err := analyze.New(analyze.Options{NoResolve: true, Format: analyze.OutputTemplate, Template: tmpl})
+	require.NoError(t, err)
+
+	r := goodFeedback()
+	txt, err := a.Render(r, a.Rows(r))
+	require.NoError(t, err)
+	assert.Contains(t, txt, "*keltia.net* 2 msgs 100% pass")
+	assert.Contains(t, txt, "- "+r.Records[0].Row.SourceIP.String()+" 2")
+
+	_, err = a.Render(report.Feedback{}, nil)
+	assert.Equal(t, analyze.ErrEmptyReport, err)
+}
+
+func TestLoadTemplate_Bad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = LoadTemplate(filepath.Join(dir, "none.tmpl"))
+	assert.Error(t, err)
+
+	_, err = LoadTemplate(testTemplate(t, dir, "bad", "{{.Report"))
+	assert.Error(t, err)
+}
+
+func TestNamedTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testTemplate(t, dir, "md", "# {{.Report.Policy.Domain}}")
+
+	_, err = namedTemplate(dir, "md")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"none", "../md", "md.tmpl", ""} {
+		_, err = namedTemplate(dir, name)
+		assert.Error(t, err, name)
+	}
+	_, err = namedTemplate("", "md")
+	assert.Error(t, err)
+}
+
+func TestNamedTemplate_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := testTemplate(t, dir, "md", "# {{.Report.Policy.Domain}}")
+
+	t1, err := namedTemplate(dir, "md")
+	require.NoError(t, err)
+	t2, err := namedTemplate(dir, "md")
+	require.NoError(t, err)
+	assert.True(t, t1 == t2)
+
+	// Changed templates are parsed again
+	testTemplate(t, dir, "md", "## {{.Report.Policy.Domain}}")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	t3, err := namedTemplate(dir, "md")
+	require.NoError(t, err)
+	assert.False(t, t1 == t3)
+}
+
+func TestListReports_Template(t *testing.T) {
+	ts, done := setupTestServer(t)
+	defer done()
+
+	dir, err := ioutil.TempDir("", "tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testTemplate(t, dir, "md", "# {{.Report.Policy.Domain}} {{.Stats.Messages}}\n")
+	testTemplate(t, dir, "broken", "{{.Nope}}")
+
+	fTemplateDir = dir
+	defer func() { fTemplateDir = "" }()
+
+	_, err = reportStore.AddFeedback("", goodFeedback())
+	require.NoError(t, err)
+
+	resp, err := http.Get(ts.URL + "/api/v1/reports?template=md")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "# keltia.net 2\n", string(body))
+
+	for name, code := range map[string]int{
+		"none":   http.StatusNotFound,
+		"..%2Fx": http.StatusNotFound,
+		"broken": http.StatusInternalServerError,
+	} {
+		resp, err := http.Get(ts.URL + "/api/v1/reports?template=" + name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode, name)
+	}
+}
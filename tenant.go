@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TenantConfig is a team owning a set of domains
+type TenantConfig struct {
+	ID      string   `json:"id"`
+	Domains []string `json:"domains"`
+}
+
+// Tenants maps domains to the tenant owning them
+type Tenants struct {
+	ids      map[string]bool
+	byDomain map[string]string
+}
+
+// NewTenants checks every domain has only one owner
+func NewTenants(list []TenantConfig) (*Tenants, error) {
+	t := &Tenants{
+		ids:      map[string]bool{},
+		byDomain: map[string]string{},
+	}
+
+	for _, tc := range list {
+		if tc.ID == "" {
+			return nil, errors.New("tenant without id")
+		}
+		if t.ids[tc.ID] {
+			return nil, errors.Errorf("duplicate tenant %s", tc.ID)
+		}
+		t.ids[tc.ID] = true
+
+		for _, d := range tc.Domains {
+			d = normDomain(d)
+			if owner, ok := t.byDomain[d]; ok {
+				return nil, errors.Errorf("domain %s owned by both %s and %s", d, owner, tc.ID)
+			}
+			t.byDomain[d] = tc.ID
+		}
+	}
+	return t, nil
+}
+
+// Exists is true if id is a known tenant
+func (t *Tenants) Exists(id string) bool {
+	if t == nil {
+		return false
+	}
+	return t.ids[id]
+}
+
+// Owner returns the tenant owning domain or one of its parents, empty if
+// none does.
+func (t *Tenants) Owner(domain string) string {
+	_, id := t.lookup(domain)
+	return id
+}
+
+// Domain returns the configured domain owning domain, itself or one of
+// its parents, empty if no tenant owns it.
+func (t *Tenants) Domain(domain string) string {
+	d, _ := t.lookup(domain)
+	return d
+}
+
+func (t *Tenants) lookup(domain string) (string, string) {
+	if t == nil {
+		return "", ""
+	}
+
+	d := normDomain(domain)
+	for d != "" {
+		if id, ok := t.byDomain[d]; ok {
+			return d, id
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return "", ""
+}
+
+func normDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// CanSee is true if p has access to data of tenant.  Principals without a
+// tenant see everything.
+func (p *Principal) CanSee(tenant string) bool {
+	return p == nil || p.Tenant == "" || p.Tenant == tenant
+}
+
+// requestTenant is the tenant of whoever made r, empty for any
+func requestTenant(r *http.Request) string {
+	if p := PrincipalFrom(r.Context()); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// canSee is CanSee for the author of r
+func canSee(r *http.Request, tenant string) bool {
+	return PrincipalFrom(r.Context()).CanSee(tenant)
+}
+
+// attribute returns the tenant owning domain and checks owner, the
+// tenant of the uploader if any, is allowed to submit for it.
+func (t *Tenants) attribute(domain, owner string) (string, error) {
+	tenant := t.Owner(domain)
+	if owner != "" && tenant != owner {
+		return "", stageError(StageAnalyze, CodeForbidden,
+			errors.Errorf("domain %s does not belong to tenant %s", domain, owner))
+	}
+	return tenant, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTenants_Bad(t *testing.T) {
+	td := [][]TenantConfig{
+		{{ID: ""}},
+		{{ID: "a"}, {ID: "a"}},
+		{{ID: "a", Domains: []string{"example.com"}}, {ID: "b", Domains: []string{"Example.COM."}}},
+	}
+
+	for _, list := range td {
+		_, err := NewTenants(list)
+		assert.Error(t, err)
+	}
+}
+
+func TestTenants_Owner(t *testing.T) {
+	tt, err := NewTenants([]TenantConfig{
+		{ID: "a", Domains: []string{"example.com"}},
+		{ID: "b", Domains: []string{"sub.example.com", "example.net"}},
+	})
+	require.NoError(t, err)
+
+	td := map[string]string{
+		"example.com":          "a",
+		"EXAMPLE.com.":         "a",
+		"mail.example.com":     "a",
+		"sub.example.com":      "b",
+		"foo.sub.example.com":  "b",
+		"example.net":          "b",
+		"example.org":          "",
+		"com":                  "",
+		"":                     "",
+		"notexample.com":       "",
+		"example.com.evil.org": "",
+	}
+	for d, owner := range td {
+		assert.Equal(t, owner, tt.Owner(d), d)
+	}
+
+	assert.True(t, tt.Exists("a"))
+	assert.False(t, tt.Exists("c"))
+
+	assert.Equal(t, "example.com", tt.Domain("Mail.Example.com"))
+	assert.Equal(t, "sub.example.com", tt.Domain("foo.sub.example.com"))
+	assert.Equal(t, "", tt.Domain("example.org"))
+}
+
+func TestTenants_Nil(t *testing.T) {
+	var tt *Tenants
+
+	assert.Equal(t, "", tt.Owner("example.com"))
+	assert.Equal(t, "", tt.Domain("example.com"))
+	assert.False(t, tt.Exists("a"))
+}
+
+func TestPrincipal_CanSee(t *testing.T) {
+	var p *Principal
+
+	assert.True(t, p.CanSee("a"))
+	assert.True(t, (&Principal{}).CanSee("a"))
+	assert.True(t, (&Principal{Tenant: "a"}).CanSee("a"))
+	assert.False(t, (&Principal{Tenant: "a"}).CanSee("b"))
+	assert.False(t, (&Principal{Tenant: "a"}).CanSee(""))
+}
+
+func TestAttribute(t *testing.T) {
+	tenants, _ := NewTenants([]TenantConfig{{ID: "a", Domains: []string{"keltia.net"}}})
+
+	tenant, err := tenants.attribute("keltia.net", "")
+	require.NoError(t, err)
+	assert.Equal(t, "a", tenant)
+
+	tenant, err = tenants.attribute("keltia.net", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "a", tenant)
+
+	_, err = tenants.attribute("keltia.net", "b")
+	assert.Equal(t, CodeForbidden, failureOf(err).Code)
+
+	_, err = tenants.attribute("example.org", "a")
+	assert.Error(t, err)
+
+	// Without tenants, reports belong to no one
+	var none *Tenants
+	tenant, err = none.attribute("keltia.net", "")
+	require.NoError(t, err)
+	assert.Equal(t, "", tenant)
+}
@@ -1,19 +1,19 @@
 package main
 
 import (
-	"log"
+	"fmt"
 )
 
-// debug displays only if fDebug is set
+// debug logs at debug level
 func debug(str string, a ...interface{}) {
-	if fDebug {
-		log.Printf(str, a...)
+	if logger.Enabled(LevelDebug) {
+		logger.Debug(fmt.Sprintf(str, a...))
 	}
 }
 
-// verbose displays only if fVerbose is set
+// verbose logs at info level only in verbose mode, see LogConfig
 func verbose(str string, a ...interface{}) {
-	if fVerbose {
-		log.Printf(str, a...)
+	if logger.IsVerbose() {
+		logger.Info(fmt.Sprintf(str, a...))
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"testing"
 )
 
@@ -9,9 +10,12 @@ func TestVerbose_No(t *testing.T) {
 }
 
 func TestVerbose_Yes(t *testing.T) {
-	fVerbose = true
+	saved := logger
+	defer func() { logger = saved }()
+
+	logger = NewLogger(ioutil.Discard, LevelInfo, LogFmt)
+	logger.out.verbose = true
 	verbose("yes")
-	fVerbose = false
 }
 
 func TestDebug_No(t *testing.T) {
@@ -19,7 +23,9 @@ func TestDebug_No(t *testing.T) {
 }
 
 func TestDebug_Yes(t *testing.T) {
-	fVerbose = true
-	verbose("yes")
-	fVerbose = false
+	saved := logger
+	defer func() { logger = saved }()
+
+	logger = NewLogger(ioutil.Discard, LevelDebug, LogFmt)
+	debug("yes")
 }